@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry/seaweedfs-broker/config"
@@ -19,10 +21,13 @@ import (
 type Client struct {
 	directorURL string
 	httpClient  *http.Client
-	token       string
-	tokenExpiry time.Time
 	clientID    string
 	clientSecret string
+
+	// mu guards the cached token, which concurrent operations share
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
 }
 
 // Release represents a BOSH release
@@ -86,6 +91,7 @@ type Task struct {
 	Description string `json:"description"`
 	Result      string `json:"result"`
 	Timestamp   int64  `json:"timestamp"`
+	ContextID   string `json:"context_id,omitempty"`
 }
 
 // Deployment represents a BOSH deployment
@@ -133,16 +139,19 @@ func NewClient(cfg *config.BOSHConfig) (*Client, error) {
 	}, nil
 }
 
-// authenticate gets an OAuth token from UAA
-func (c *Client) authenticate() error {
+// authenticate gets an OAuth token from UAA and returns it
+func (c *Client) authenticate() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.token != "" && time.Now().Before(c.tokenExpiry) {
-		return nil
+		return c.token, nil
 	}
 
 	// Get UAA URL from BOSH director info
 	infoResp, err := c.httpClient.Get(c.directorURL + "/info")
 	if err != nil {
-		return fmt.Errorf("failed to get director info: %w", err)
+		return "", fmt.Errorf("failed to get director info: %w", err)
 	}
 	defer infoResp.Body.Close()
 
@@ -155,7 +164,7 @@ func (c *Client) authenticate() error {
 		} `json:"user_authentication"`
 	}
 	if err := json.NewDecoder(infoResp.Body).Decode(&info); err != nil {
-		return fmt.Errorf("failed to decode director info: %w", err)
+		return "", fmt.Errorf("failed to decode director info: %w", err)
 	}
 
 	uaaURL := info.UserAuthentication.Options.URL
@@ -167,20 +176,20 @@ func (c *Client) authenticate() error {
 			c.clientID, c.clientSecret,
 		)))
 	if err != nil {
-		return fmt.Errorf("failed to create token request: %w", err)
+		return "", fmt.Errorf("failed to create token request: %w", err)
 	}
 	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	tokenReq.Header.Set("Accept", "application/json")
 
 	tokenResp, err := c.httpClient.Do(tokenReq)
 	if err != nil {
-		return fmt.Errorf("failed to get token: %w", err)
+		return "", fmt.Errorf("failed to get token: %w", err)
 	}
 	defer tokenResp.Body.Close()
 
 	if tokenResp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(tokenResp.Body)
-		return fmt.Errorf("failed to get token: %s - %s", tokenResp.Status, string(body))
+		return "", fmt.Errorf("failed to get token: %s - %s", tokenResp.Status, string(body))
 	}
 
 	var tokenData struct {
@@ -188,13 +197,13 @@ func (c *Client) authenticate() error {
 		ExpiresIn   int    `json:"expires_in"`
 	}
 	if err := json.NewDecoder(tokenResp.Body).Decode(&tokenData); err != nil {
-		return fmt.Errorf("failed to decode token response: %w", err)
+		return "", fmt.Errorf("failed to decode token response: %w", err)
 	}
 
 	c.token = tokenData.AccessToken
 	c.tokenExpiry = time.Now().Add(time.Duration(tokenData.ExpiresIn-60) * time.Second)
 
-	return nil
+	return c.token, nil
 }
 
 // doRequest performs an authenticated request to BOSH director
@@ -204,7 +213,15 @@ func (c *Client) doRequest(method, path string, body io.Reader) (*http.Response,
 
 // doRequestWithContentType performs an authenticated request with a specific content type
 func (c *Client) doRequestWithContentType(method, path string, body io.Reader, contentType string) (*http.Response, error) {
-	if err := c.authenticate(); err != nil {
+	return c.doTaskRequest(method, path, body, contentType, "")
+}
+
+// doTaskRequest performs an authenticated request that starts a task. A
+// non-empty contextID is recorded as the task's context ID, so the task can
+// be traced back to the broker request that started it.
+func (c *Client) doTaskRequest(method, path string, body io.Reader, contentType, contextID string) (*http.Response, error) {
+	token, err := c.authenticate()
+	if err != nil {
 		return nil, err
 	}
 
@@ -213,15 +230,18 @@ func (c *Client) doRequestWithContentType(method, path string, body io.Reader, c
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", contentType)
+	if contextID != "" {
+		req.Header.Set("X-Bosh-Context-Id", contextID)
+	}
 
 	return c.httpClient.Do(req)
 }
 
-// Deploy creates or updates a deployment
-func (c *Client) Deploy(manifest []byte) (*Task, error) {
-	resp, err := c.doRequestWithContentType("POST", "/deployments", bytes.NewReader(manifest), "text/yaml")
+// Deploy creates or updates a deployment. contextID is recorded on the task.
+func (c *Client) Deploy(manifest []byte, contextID string) (*Task, error) {
+	resp, err := c.doTaskRequest("POST", "/deployments", bytes.NewReader(manifest), "text/yaml", contextID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to deploy: %w", err)
 	}
@@ -243,8 +263,8 @@ func (c *Client) Deploy(manifest []byte) (*Task, error) {
 }
 
 // DeployWithRecreate redeploys a deployment and recreates all VMs (preserving persistent disks)
-func (c *Client) DeployWithRecreate(manifest []byte) (*Task, error) {
-	resp, err := c.doRequestWithContentType("POST", "/deployments?recreate=true", bytes.NewReader(manifest), "text/yaml")
+func (c *Client) DeployWithRecreate(manifest []byte, contextID string) (*Task, error) {
+	resp, err := c.doTaskRequest("POST", "/deployments?recreate=true", bytes.NewReader(manifest), "text/yaml", contextID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to deploy with recreate: %w", err)
 	}
@@ -264,9 +284,9 @@ func (c *Client) DeployWithRecreate(manifest []byte) (*Task, error) {
 	return c.GetTask(taskID)
 }
 
-// DeleteDeployment deletes a deployment
-func (c *Client) DeleteDeployment(name string) (*Task, error) {
-	resp, err := c.doRequest("DELETE", "/deployments/"+name+"?force=true", nil)
+// DeleteDeployment deletes a deployment. contextID is recorded on the task.
+func (c *Client) DeleteDeployment(name, contextID string) (*Task, error) {
+	resp, err := c.doTaskRequest("DELETE", "/deployments/"+name+"?force=true", nil, "application/json", contextID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to delete deployment: %w", err)
 	}
@@ -513,6 +533,113 @@ func (c *Client) GetCloudConfigAZsForNetwork(networkName string) ([]string, erro
 	return azs, nil
 }
 
+// LatestReleaseVersion returns the highest uploaded version of a release,
+// which is what "latest" resolves to in a manifest
+func (c *Client) LatestReleaseVersion(name string) (string, error) {
+	resp, err := c.doRequest("GET", "/releases", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to list releases: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("list releases failed: %s - %s", resp.Status, string(body))
+	}
+
+	var releases []struct {
+		Name            string `json:"name"`
+		ReleaseVersions []struct {
+			Version string `json:"version"`
+		} `json:"release_versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return "", fmt.Errorf("failed to decode releases: %w", err)
+	}
+
+	latest := ""
+	for _, release := range releases {
+		if release.Name != name {
+			continue
+		}
+		for _, rv := range release.ReleaseVersions {
+			if latest == "" || compareVersions(rv.Version, latest) > 0 {
+				latest = rv.Version
+			}
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("release %s has not been uploaded", name)
+	}
+	return latest, nil
+}
+
+// LatestStemcellVersion returns the highest uploaded stemcell version for an
+// operating system
+func (c *Client) LatestStemcellVersion(os string) (string, error) {
+	resp, err := c.doRequest("GET", "/stemcells", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to list stemcells: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("list stemcells failed: %s - %s", resp.Status, string(body))
+	}
+
+	var stemcells []struct {
+		OperatingSystem string `json:"operating_system"`
+		Version         string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stemcells); err != nil {
+		return "", fmt.Errorf("failed to decode stemcells: %w", err)
+	}
+
+	latest := ""
+	for _, stemcell := range stemcells {
+		if stemcell.OperatingSystem == os && (latest == "" || compareVersions(stemcell.Version, latest) > 0) {
+			latest = stemcell.Version
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no %s stemcell has been uploaded", os)
+	}
+	return latest, nil
+}
+
+// compareVersions compares dot-separated BOSH versions component by
+// component, numerically where both components are numbers. It returns -1,
+// 0 or 1.
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart string
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		aNum, aErr := strconv.Atoi(aPart)
+		bNum, bErr := strconv.Atoi(bPart)
+		switch {
+		case aErr == nil && bErr == nil && aNum != bNum:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && aPart != bPart:
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
 // extractTaskID extracts a task ID from a BOSH Location header.
 // The header may be an absolute URL (https://director:25555/tasks/123)
 // or a relative path (/tasks/123).
@@ -0,0 +1,308 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/gorilla/mux"
+)
+
+// errIAMUserExists is returned when the IAM user of a binding already
+// exists, so that cleanup leaves the user it did not create alone
+var errIAMUserExists = errors.New("IAM user already exists")
+
+// errBindingSuperseded is returned when a binding left the state a
+// background operation expected, and the operation should stop
+var errBindingSuperseded = errors.New("binding was taken over by another operation")
+
+// bindAsync reports whether a bind or unbind request should run in the
+// background. Only dedicated clusters are slow enough to need it.
+func bindAsync(r *http.Request, instance *store.ServiceInstance) bool {
+	return r.URL.Query().Get("accepts_incomplete") == "true" && instance.DeploymentName != ""
+}
+
+// createBindingCredentials creates the IAM user and keys of a binding. IAM
+// resources created before a failure are removed again.
+func (b *Broker) createBindingCredentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) error {
+	b.ensureDedicatedBucket(ctx, instance, binding.ID)
+
+	if err := b.createS3Credentials(ctx, instance, binding); err != nil {
+		if errors.Is(err, errIAMUserExists) {
+			return err
+		}
+		if cleanupErr := b.deleteS3Credentials(ctx, instance, binding); cleanupErr != nil {
+			logf(ctx, "Warning: failed to clean up credentials for binding %s: %v", binding.ID, cleanupErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// ensureDedicatedBucket creates the bucket of a dedicated cluster if it is
+// missing. Failures are logged; binding proceeds regardless.
+func (b *Broker) ensureDedicatedBucket(ctx context.Context, instance *store.ServiceInstance, bindingID string) {
+	if instance.DeploymentName == "" || instance.IAMEndpoint == "" || instance.BucketName == "" {
+		return
+	}
+
+	target, err := b.dedicatedBucket(instance)
+	if err != nil {
+		logf(ctx, "Binding %s: Warning: could not create S3 client for bucket check: %v", bindingID, err)
+		return
+	}
+
+	exists, err := target.client.BucketExists(ctx, instance.BucketName)
+	if err != nil {
+		logf(ctx, "Binding %s: Warning: could not check bucket existence: %v", bindingID, err)
+		return
+	}
+	if !exists {
+		logf(ctx, "Binding %s: Creating bucket %s on dedicated cluster", bindingID, instance.BucketName)
+		params, _ := parseBucketParameters(instance.Parameters)
+		if err := createBucket(ctx, target, params); err != nil {
+			logf(ctx, "Binding %s: Warning: could not create bucket: %v", bindingID, err)
+		}
+	}
+}
+
+// bindingUserName is the name of the IAM user of a binding. It is derived
+// from the binding ID so that a user whose creation was interrupted can
+// still be found and deleted.
+func bindingUserName(bindingID string) string {
+	return fmt.Sprintf("cf-binding-%s", bindingID[:min(len(bindingID), 16)])
+}
+
+// bindingPolicyName is the name of the IAM policy that grants a binding's
+// user access to its bucket
+func bindingPolicyName(bindingID string) string {
+	return fmt.Sprintf("bucket-access-%s", bindingID[:min(len(bindingID), 8)])
+}
+
+// bindingCredentialPath is the CredHub path of a binding's credentials
+func bindingCredentialPath(instanceID, bindingID string) string {
+	return fmt.Sprintf("/seaweedfs-broker/instances/%s/bindings/%s", instanceID, bindingID)
+}
+
+// storeBindingCredentials copies the credentials of a binding to CredHub if
+// it is configured
+func (b *Broker) storeBindingCredentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) {
+	if b.credhubClient == nil {
+		return
+	}
+	credPath := bindingCredentialPath(instance.ID, binding.ID)
+	if err := b.credhubClient.SetJSON(credPath, map[string]interface{}{
+		"access_key": binding.AccessKey,
+		"secret_key": binding.SecretKey,
+		"bucket":     primaryBucket(instance, binding),
+		"buckets":    bindingBuckets(instance, binding),
+	}); err != nil {
+		logf(ctx, "Warning: failed to store credentials in CredHub: %v", err)
+	}
+}
+
+// removeBindingCredentials revokes the credentials of a binding and removes
+// them from CredHub. Failures are logged so unbinding can always complete.
+func (b *Broker) removeBindingCredentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) {
+	if err := b.deleteS3Credentials(ctx, instance, binding); err != nil {
+		logf(ctx, "Warning: failed to delete S3 credentials: %v", err)
+	}
+
+	b.deleteStoredCredentials(ctx, instance, binding)
+}
+
+// deleteStoredCredentials removes the credentials of a binding from CredHub
+// if it is configured
+func (b *Broker) deleteStoredCredentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) {
+	if b.credhubClient == nil {
+		return
+	}
+	credPath := bindingCredentialPath(instance.ID, binding.ID)
+	if err := b.credhubClient.Delete(credPath); err != nil {
+		logf(ctx, "Warning: failed to delete credentials from CredHub: %v", err)
+	}
+}
+
+// createBindingInBackground creates the credentials of a binding saved in
+// the "binding" state
+func (b *Broker) createBindingInBackground(instance *store.ServiceInstance, binding *store.ServiceBinding, op *store.Operation) {
+	ctx := operationContext(op)
+	logf(ctx, "Binding %s: creating credentials in the background", binding.ID)
+
+	if err := b.createBindingCredentials(ctx, instance, binding); err != nil {
+		b.failBindingOperation(binding, op, "binding", fmt.Sprintf("Failed to create credentials: %v", err))
+		return
+	}
+
+	binding.State = "succeeded"
+	binding.StateMessage = ""
+	if err := b.saveBindingState(ctx, binding, "binding"); err != nil {
+		// Credentials must not outlive a record that does not point to them
+		logf(ctx, "Binding %s: could not record credentials, revoking them: %v", binding.ID, err)
+		if cleanupErr := b.deleteS3Credentials(ctx, instance, binding); cleanupErr != nil {
+			logf(ctx, "Warning: failed to clean up credentials for binding %s: %v", binding.ID, cleanupErr)
+		}
+		b.failBindingOperation(binding, op, "binding", fmt.Sprintf("Failed to record credentials: %v", err))
+		return
+	}
+
+	b.storeBindingCredentials(ctx, instance, binding)
+	b.retirePredecessor(ctx, binding)
+	b.finishOperation(op, nil)
+	logf(ctx, "Binding %s: credentials created", binding.ID)
+}
+
+// deleteBindingInBackground revokes the credentials of a binding saved in
+// the "unbinding" state and deletes its record
+func (b *Broker) deleteBindingInBackground(instance *store.ServiceInstance, binding *store.ServiceBinding, op *store.Operation) {
+	ctx := operationContext(op)
+	logf(ctx, "Binding %s: revoking credentials in the background", binding.ID)
+
+	b.removeBindingCredentials(ctx, instance, binding)
+
+	if err := b.store.DeleteBinding(binding.ID); err != nil {
+		b.failBindingOperation(binding, op, "unbinding", fmt.Sprintf("Failed to delete binding: %v", err))
+		return
+	}
+
+	b.finishOperation(op, nil)
+	logf(ctx, "Binding %s: deleted", binding.ID)
+}
+
+// saveBindingState persists a background operation's view of a binding. On
+// a revision conflict the operation's fields are re-applied to the latest
+// stored copy, unless the binding has left opState in the meantime.
+func (b *Broker) saveBindingState(ctx context.Context, binding *store.ServiceBinding, opState string) error {
+	for attempt := 1; ; attempt++ {
+		err := b.store.SaveBinding(binding)
+		if err == nil || !store.IsConflict(err) || attempt >= maxConflictRetries {
+			return err
+		}
+
+		latest, err := b.store.GetBinding(binding.ID)
+		if err != nil {
+			return err
+		}
+		if latest == nil || latest.State != opState {
+			return errBindingSuperseded
+		}
+		logf(ctx, "Binding %s: concurrent update detected, re-applying %s state", binding.ID, opState)
+		latest.AccessKey = binding.AccessKey
+		latest.SecretKey = binding.SecretKey
+		latest.IAMUserName = binding.IAMUserName
+		latest.State = binding.State
+		latest.StateMessage = binding.StateMessage
+		*binding = *latest
+	}
+}
+
+// failBindingOperation records a failed background operation on the binding
+// and in its operation history
+func (b *Broker) failBindingOperation(binding *store.ServiceBinding, op *store.Operation, opState, message string) {
+	binding.State = "failed"
+	binding.StateMessage = message
+	if err := b.saveBindingState(operationContext(op), binding, opState); err != nil {
+		logf(operationContext(op), "Binding %s: could not record failure %q: %v", binding.ID, message, err)
+	}
+	b.finishOperation(op, errors.New(message))
+}
+
+// recoverBindingOperations picks up binding operations interrupted by a
+// broker restart. Interrupted unbinds are resumed. Interrupted binds are
+// failed after revoking any IAM user and key they created; the platform's
+// unbind of the failed binding retries if that fails.
+func (b *Broker) recoverBindingOperations() {
+	bindings, err := b.store.ListBindings()
+	if err != nil {
+		log.Printf("Warning: could not list bindings to recover interrupted operations: %v", err)
+		return
+	}
+
+	for _, binding := range bindings {
+		if binding.State != "binding" && binding.State != "unbinding" {
+			continue
+		}
+
+		instance, err := b.store.GetInstance(binding.InstanceID)
+		if err != nil {
+			log.Printf("Warning: could not recover binding %s: %v", binding.ID, err)
+			continue
+		}
+		op := b.interruptedOperation(binding)
+
+		if binding.State == "unbinding" && instance != nil {
+			log.Printf("Binding %s: resuming interrupted unbind", binding.ID)
+			go b.deleteBindingInBackground(instance, binding, op)
+			continue
+		}
+
+		log.Printf("Binding %s: failing %s interrupted by a broker restart", binding.ID, binding.State)
+		if instance != nil {
+			if err := b.deleteS3Credentials(operationContext(op), instance, binding); err != nil {
+				log.Printf("Warning: could not revoke credentials of interrupted binding %s: %v", binding.ID, err)
+			} else {
+				binding.AccessKey = ""
+				binding.SecretKey = ""
+			}
+		}
+		b.failBindingOperation(binding, op, binding.State, "Interrupted by a broker restart")
+	}
+}
+
+// interruptedOperation returns the in-progress history entry of a binding
+// operation, or a new one if none was recorded
+func (b *Broker) interruptedOperation(binding *store.ServiceBinding) *store.Operation {
+	opType := store.OperationBind
+	if binding.State == "unbinding" {
+		opType = store.OperationUnbind
+	}
+
+	ops, err := b.store.ListOperationsForInstance(binding.InstanceID)
+	if err != nil {
+		log.Printf("Warning: could not read operation history of binding %s: %v", binding.ID, err)
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if op.BindingID == binding.ID && op.Type == opType && op.State == store.OperationInProgress {
+			return op
+		}
+	}
+	return b.startOperation(nil, opType, binding.InstanceID, binding.ID)
+}
+
+// bindingLastOperationHandler reports the progress of an asynchronous bind
+// or unbind. A binding that no longer exists has been unbound.
+func (b *Broker) bindingLastOperationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bindingID := vars["binding_id"]
+
+	binding, err := b.store.GetBinding(bindingID)
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+	if binding == nil || binding.InstanceID != vars["instance_id"] {
+		b.writeError(w, http.StatusGone, "BindingNotFound", "Service binding not found")
+		return
+	}
+
+	state := "succeeded"
+	switch binding.State {
+	case "binding", "unbinding":
+		state = "in progress"
+	case "failed":
+		state = "failed"
+	}
+
+	response := map[string]any{
+		"state": state,
+	}
+	if binding.StateMessage != "" {
+		response["description"] = binding.StateMessage
+	}
+
+	b.writeJSON(w, http.StatusOK, response)
+}
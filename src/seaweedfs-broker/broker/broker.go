@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -27,11 +28,19 @@ const (
 	// OSB API version
 	OSBAPIVersion = "2.17"
 
+	// maxConflictRetries bounds how often a background operation re-applies
+	// its state after losing a revision race
+	maxConflictRetries = 5
+
 	// Plan types
 	PlanTypeShared    = "shared"
 	PlanTypeDedicated = "dedicated"
 )
 
+// errOperationSuperseded is returned when another request has taken over an
+// instance while a background operation was running
+var errOperationSuperseded = errors.New("instance was taken over by another operation")
+
 // Broker implements the Open Service Broker API
 type Broker struct {
 	config       *config.Config
@@ -40,12 +49,15 @@ type Broker struct {
 	s3Client     *minio.Client
 	iamClient    *iam.Client
 	credhubClient *credhub.Client
+
+	// maintenanceInfo is advertised for dedicated plans; nil if unknown
+	maintenanceInfo *MaintenanceInfo
 }
 
 // New creates a new broker instance
 func New(cfg *config.Config) (*Broker, error) {
 	// Initialize state store
-	stateStore, err := store.NewFileStore(cfg.StateStore.Path)
+	stateStore, err := newStateStore(&cfg.StateStore)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create state store: %w", err)
 	}
@@ -64,6 +76,9 @@ func New(cfg *config.Config) (*Broker, error) {
 		b.boshClient = boshClient
 	}
 
+	// Advertise the release and stemcell versions new deployments use
+	b.maintenanceInfo = b.resolveMaintenanceInfo()
+
 	// Initialize S3 client for shared cluster
 	if cfg.SharedCluster.S3Endpoint != "" {
 		s3Client, err := minio.New(cfg.SharedCluster.S3Endpoint, &minio.Options{
@@ -114,9 +129,144 @@ func New(cfg *config.Config) (*Broker, error) {
 		log.Printf("Initialized CredHub client for %s", cfg.CredHub.URL)
 	}
 
+	// Encrypt secrets at rest if encryption keys are configured
+	if cfg.StateStore.Encryption.Enabled() {
+		if err := b.enableStoreEncryption(); err != nil {
+			return nil, fmt.Errorf("failed to enable state store encryption: %w", err)
+		}
+	}
+
+	// Bring records written by older broker versions up to date
+	if err := store.Migrate(b.store, b.stateMigrations()); err != nil {
+		return nil, fmt.Errorf("failed to migrate state store: %w", err)
+	}
+
+	if encrypted, ok := b.store.(*store.EncryptedStore); ok {
+		go b.rotateStoreKeys(encrypted)
+	}
+
+	// Resume or fail binding operations interrupted by a restart
+	b.recoverBindingOperations()
+
+	// Purge tombstoned instances whose retention period has ended
+	go b.runReaper()
+	go b.runKeySweeper()
+	go b.runUsageScanner()
+
 	return b, nil
 }
 
+// OpenStateStore opens the configured state store, with encryption applied
+// if it is enabled, without starting the broker. It is used by the export
+// and import commands.
+func OpenStateStore(cfg *config.Config) (store.Store, error) {
+	stateStore, err := newStateStore(&cfg.StateStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state store: %w", err)
+	}
+
+	b := &Broker{
+		config: cfg,
+		store:  stateStore,
+	}
+
+	if cfg.StateStore.Encryption.Enabled() {
+		if cfg.CredHub.URL != "" {
+			credhubClient, err := credhub.NewClient(
+				cfg.CredHub.URL,
+				cfg.CredHub.ClientID,
+				cfg.CredHub.ClientSecret,
+				cfg.CredHub.CACert,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create CredHub client: %w", err)
+			}
+			b.credhubClient = credhubClient
+		}
+		if err := b.enableStoreEncryption(); err != nil {
+			return nil, fmt.Errorf("failed to enable state store encryption: %w", err)
+		}
+	}
+
+	return b.store, nil
+}
+
+// enableStoreEncryption wraps the state store in a store.EncryptedStore and
+// verifies that every existing record can be decrypted
+func (b *Broker) enableStoreEncryption() error {
+	keyring, err := b.loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	encrypted := store.NewEncryptedStore(b.store, keyring)
+	if err := encrypted.Verify(); err != nil {
+		return fmt.Errorf("state store verification failed: %w", err)
+	}
+	b.store = encrypted
+	log.Printf("State store encryption enabled (active key: %s)", keyring.ActiveKeyID())
+
+	return nil
+}
+
+// rotateStoreKeys re-encrypts plaintext records and records sealed with a
+// retired key
+func (b *Broker) rotateStoreKeys(encrypted *store.EncryptedStore) {
+	rotated, err := encrypted.Rotate()
+	if err != nil {
+		log.Printf("Warning: state store key rotation incomplete after re-encrypting %d record(s): %v", rotated, err)
+		return
+	}
+	if rotated > 0 {
+		log.Printf("Re-encrypted %d state store record(s)", rotated)
+	}
+}
+
+// loadKeyring builds the encryption keyring from CredHub or the broker config
+func (b *Broker) loadKeyring() (*store.Keyring, error) {
+	encCfg := b.config.StateStore.Encryption
+
+	if encCfg.CredHubKeyPath == "" {
+		keys := make(map[string]string, len(encCfg.Keys))
+		for _, key := range encCfg.Keys {
+			keys[key.ID] = key.Secret
+		}
+		return store.NewKeyring(encCfg.ActiveKeyID, keys)
+	}
+
+	if b.credhubClient == nil {
+		return nil, fmt.Errorf("credhub_key_path is set but CredHub is not configured")
+	}
+	value, err := b.credhubClient.GetJSON(encCfg.CredHubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	activeKeyID, _ := value["active_key_id"].(string)
+	keyValues, _ := value["keys"].(map[string]any)
+	keys := make(map[string]string, len(keyValues))
+	for id, v := range keyValues {
+		if secret, ok := v.(string); ok {
+			keys[id] = secret
+		}
+	}
+	return store.NewKeyring(activeKeyID, keys)
+}
+
+// newStateStore creates the state store selected by StateStoreConfig.Type
+func newStateStore(cfg *config.StateStoreConfig) (store.Store, error) {
+	switch cfg.Type {
+	case "file":
+		log.Printf("Using file state store at %s (%d snapshots)", cfg.Path, cfg.SnapshotCount)
+		return store.NewFileStore(cfg.Path, cfg.SnapshotCount)
+	case "database":
+		log.Printf("Using database state store")
+		return store.NewPostgresStore(cfg.DatabaseURL, cfg.PsqlPath)
+	default:
+		return nil, fmt.Errorf("unknown state store type %q", cfg.Type)
+	}
+}
+
 // Router returns the HTTP router for the broker
 func (b *Broker) Router() http.Handler {
 	r := mux.NewRouter()
@@ -130,23 +280,33 @@ func (b *Broker) Router() http.Handler {
 	// OSB API endpoints
 	api := r.PathPrefix("/v2").Subrouter()
 	api.Use(b.authMiddleware)
+	api.Use(b.identityMiddleware)
 	api.Use(b.osbVersionMiddleware)
 
 	api.HandleFunc("/catalog", b.catalogHandler).Methods("GET")
 	api.HandleFunc("/service_instances/{instance_id}", b.provisionHandler).Methods("PUT")
+	api.HandleFunc("/service_instances/{instance_id}", b.updateHandler).Methods("PATCH")
 	api.HandleFunc("/service_instances/{instance_id}", b.deprovisionHandler).Methods("DELETE")
 	api.HandleFunc("/service_instances/{instance_id}", b.getInstanceHandler).Methods("GET")
 	api.HandleFunc("/service_instances/{instance_id}/last_operation", b.lastOperationHandler).Methods("GET")
 	api.HandleFunc("/service_instances/{instance_id}/service_bindings/{binding_id}", b.bindHandler).Methods("PUT")
 	api.HandleFunc("/service_instances/{instance_id}/service_bindings/{binding_id}", b.unbindHandler).Methods("DELETE")
 	api.HandleFunc("/service_instances/{instance_id}/service_bindings/{binding_id}", b.getBindingHandler).Methods("GET")
+	api.HandleFunc("/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", b.bindingLastOperationHandler).Methods("GET")
 
 	// Admin API endpoints (for upgrade-all and recreate-all errands)
 	admin := r.PathPrefix("/admin").Subrouter()
 	admin.Use(b.authMiddleware)
+	admin.Use(b.identityMiddleware)
 	admin.HandleFunc("/deployments", b.listDeploymentsHandler).Methods("GET")
 	admin.HandleFunc("/deployments/{deployment}/upgrade", b.upgradeDeploymentHandler).Methods("POST")
 	admin.HandleFunc("/deployments/{deployment}/recreate", b.recreateDeploymentHandler).Methods("POST")
+	admin.HandleFunc("/instances/{instance_id}/operations", b.listOperationsHandler).Methods("GET")
+	admin.HandleFunc("/tombstones", b.listTombstonesHandler).Methods("GET")
+	admin.HandleFunc("/usage", b.listUsageHandler).Methods("GET")
+	admin.HandleFunc("/instances/{instance_id}/restore", b.restoreInstanceHandler).Methods("POST")
+	admin.HandleFunc("/state/export", b.exportStateHandler).Methods("GET")
+	admin.HandleFunc("/state/import", b.importStateHandler).Methods("POST")
 
 	return r
 }
@@ -200,24 +360,26 @@ func (b *Broker) provisionHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
 
+	// Parse request
+	var req ProvisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "Invalid JSON body")
+		return
+	}
+
 	// Check if instance already exists
 	existing, err := b.store.GetInstance(instanceID)
 	if err != nil {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if existing != nil {
-		// Return 200 if same parameters, 409 if different
-		b.writeJSON(w, http.StatusOK, map[string]any{
-			"dashboard_url": b.getDashboardURL(existing),
-		})
+	if existing != nil && existing.Tombstoned() {
+		b.writeError(w, http.StatusConflict, "InstanceTombstoned",
+			"A deprovisioned service instance with this ID is awaiting purge")
 		return
 	}
-
-	// Parse request
-	var req ProvisionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		b.writeError(w, http.StatusBadRequest, "BadRequest", "Invalid JSON body")
+	if existing != nil {
+		b.writeExistingInstance(w, r, existing, &req)
 		return
 	}
 
@@ -228,6 +390,16 @@ func (b *Broker) provisionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateParameters(planSchemas(plan).InstanceCreate, req.Parameters); err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+
+	if err := b.checkMaintenanceInfo(plan, req.MaintenanceInfo); err != nil {
+		b.writeError(w, http.StatusUnprocessableEntity, "MaintenanceInfoConflict", err.Error())
+		return
+	}
+
 	// Check async requirement for dedicated plans
 	acceptsAsync := r.URL.Query().Get("accepts_incomplete") == "true"
 	if plan.PlanType == PlanTypeDedicated && !acceptsAsync {
@@ -236,6 +408,27 @@ func (b *Broker) provisionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate bucket parameters before creating anything
+	bucketParams, err := parseBucketParameters(req.Parameters)
+	if err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+	if plan.PlanType != PlanTypeShared && bucketParams.Buckets != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", "invalid parameters: buckets is only supported by shared plans")
+		return
+	}
+	if bucketParams.BucketName != nil {
+		if plan.PlanType != PlanTypeShared {
+			b.writeError(w, http.StatusBadRequest, "InvalidParameters", "invalid parameters: bucket_name is only supported by shared plans")
+			return
+		}
+		if err := b.checkBucketNamePolicy(*bucketParams.BucketName); err != nil {
+			b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+			return
+		}
+	}
+
 	// Create instance
 	instance := &store.ServiceInstance{
 		ID:               instanceID,
@@ -247,33 +440,97 @@ func (b *Broker) provisionHandler(w http.ResponseWriter, r *http.Request) {
 		Context:          req.Context,
 		CreatedAt:        time.Now(),
 		State:            "provisioning",
+
+		OriginatingIdentity: callerIdentity(r.Context()),
+		RequestIdentity:     requestIdentity(r.Context()),
 	}
 
+	op := b.startOperation(r, store.OperationProvision, instanceID, "")
+
 	if plan.PlanType == PlanTypeShared {
 		// Provision shared bucket synchronously
-		if err := b.provisionSharedBucket(instance); err != nil {
-			b.writeError(w, http.StatusInternalServerError, "ProvisionError", err.Error())
+		ctx := operationContext(op)
+		if err := b.provisionSharedBucket(ctx, instance, bucketParams); err != nil {
+			b.finishOperation(op, err)
+			if errors.Is(err, errBucketNameTaken) {
+				b.writeError(w, http.StatusConflict, "BucketNameTaken", err.Error())
+			} else {
+				b.writeError(w, http.StatusInternalServerError, "ProvisionError", err.Error())
+			}
+			return
+		}
+		err := b.reconcileBuckets(ctx, instance, bucketParams.Buckets, bucketParams)
+		if err == nil {
+			err = b.configureSharedBuckets(ctx, instance, bucketParams)
+		}
+		if err != nil {
+			// The buckets are still empty; removing them frees their names
+			// for a retry
+			if cleanupErr := b.deleteSharedBuckets(ctx, instance); cleanupErr != nil {
+				logf(r.Context(), "Warning: failed to clean up buckets of instance %s: %v", instanceID, cleanupErr)
+			}
+			b.finishOperation(op, err)
+			if errors.Is(err, errBucketNameTaken) {
+				b.writeError(w, http.StatusConflict, "BucketNameTaken", err.Error())
+			} else {
+				b.writeError(w, http.StatusInternalServerError, "ProvisionError", err.Error())
+			}
 			return
 		}
 		instance.State = "succeeded"
 		if err := b.store.SaveInstance(instance); err != nil {
-			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			b.finishOperation(op, err)
+			b.writeStoreError(w, err)
 			return
 		}
+		b.finishOperation(op, nil)
 		b.writeJSON(w, http.StatusCreated, map[string]any{
 			"dashboard_url": b.getDashboardURL(instance),
 		})
 	} else {
 		// Provision dedicated cluster asynchronously
 		if err := b.store.SaveInstance(instance); err != nil {
-			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			b.finishOperation(op, err)
+			b.writeStoreError(w, err)
 			return
 		}
-		go b.provisionDedicatedCluster(instance, plan)
+		// The background provision owns instance from here on
+		dashboardURL := b.getDashboardURL(instance)
+		go b.provisionDedicatedCluster(instance, plan, op)
 		b.writeJSON(w, http.StatusAccepted, map[string]any{
-			"dashboard_url": b.getDashboardURL(instance),
+			"dashboard_url": dashboardURL,
+			"operation":     "provision",
+		})
+	}
+}
+
+// writeExistingInstance answers a provision request for an instance ID that
+// is already in use: 200 for a retry of a completed provision, 202 for a
+// retry of one still in progress, and 409 if any attribute differs
+func (b *Broker) writeExistingInstance(w http.ResponseWriter, r *http.Request, existing *store.ServiceInstance, req *ProvisionRequest) {
+	if conflicts := provisionConflicts(existing, req); len(conflicts) > 0 {
+		b.writeConflict(w, "service instance", conflicts)
+		return
+	}
+
+	switch existing.State {
+	case "provisioning":
+		if r.URL.Query().Get("accepts_incomplete") != "true" {
+			b.writeError(w, http.StatusUnprocessableEntity, "AsyncRequired",
+				"This plan requires asynchronous provisioning")
+			return
+		}
+		b.writeJSON(w, http.StatusAccepted, map[string]any{
+			"dashboard_url": b.getDashboardURL(existing),
 			"operation":     "provision",
 		})
+	case "failed", "deprovisioning":
+		b.writeError(w, http.StatusConflict, "Conflict",
+			fmt.Sprintf("A service instance with this ID already exists in state %q", existing.State))
+	default:
+		b.writeJSON(w, http.StatusOK, map[string]any{
+			"dashboard_url": b.getDashboardURL(existing),
+		})
 	}
 }
 
@@ -286,7 +543,7 @@ func (b *Broker) deprovisionHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if instance == nil {
+	if instance == nil || instance.Tombstoned() {
 		b.writeError(w, http.StatusGone, "InstanceNotFound", "Service instance not found")
 		return
 	}
@@ -294,6 +551,19 @@ func (b *Broker) deprovisionHandler(w http.ResponseWriter, r *http.Request) {
 	plan := b.findPlan(instance.ServiceID, instance.PlanID)
 	acceptsAsync := r.URL.Query().Get("accepts_incomplete") == "true"
 
+	// A retry while the deprovision runs joins it instead of starting another
+	if instance.State == "deprovisioning" {
+		if !acceptsAsync {
+			b.writeError(w, http.StatusUnprocessableEntity, "AsyncRequired",
+				"This plan requires asynchronous deprovisioning")
+			return
+		}
+		b.writeJSON(w, http.StatusAccepted, map[string]any{
+			"operation": "deprovision",
+		})
+		return
+	}
+
 	// Check for existing bindings
 	bindings, err := b.store.ListBindingsForInstance(instanceID)
 	if err != nil {
@@ -314,22 +584,51 @@ func (b *Broker) deprovisionHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		instance.State = "deprovisioning"
 		if err := b.store.SaveInstance(instance); err != nil {
-			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			b.writeStoreError(w, err)
 			return
 		}
-		go b.deprovisionDedicatedCluster(instance)
+		op := b.startOperation(r, store.OperationDeprovision, instanceID, "")
+		go b.deprovisionDedicatedCluster(instance, op)
 		b.writeJSON(w, http.StatusAccepted, map[string]any{
 			"operation": "deprovision",
 		})
+	} else if b.config.SharedCluster.RetentionDays > 0 {
+		// Keep the bucket, locked, until the reaper purges it
+		op := b.startOperation(r, store.OperationDeprovision, instanceID, "")
+		if err := b.tombstoneSharedInstance(operationContext(op), instance); err != nil {
+			b.finishOperation(op, err)
+			if store.IsConflict(err) {
+				b.writeStoreError(w, err)
+			} else {
+				b.writeError(w, http.StatusInternalServerError, "DeprovisionError", err.Error())
+			}
+			return
+		}
+		b.finishOperation(op, nil)
+		b.writeJSON(w, http.StatusOK, map[string]any{})
 	} else {
 		// Deprovision shared bucket synchronously
-		if err := b.deprovisionSharedBucket(instance); err != nil {
-			log.Printf("Warning: failed to delete bucket: %v", err)
+		op := b.startOperation(r, store.OperationDeprovision, instanceID, "")
+		if b.s3Client != nil {
+			// The record is kept while a bucket remains, so the deprovision
+			// can be retried instead of leaving an untracked bucket
+			if err := b.deleteSharedBuckets(operationContext(op), instance); err != nil {
+				b.finishOperation(op, err)
+				if errors.Is(err, errBucketRetained) {
+					b.writeError(w, http.StatusUnprocessableEntity, "BucketRetained",
+						fmt.Sprintf("Cannot deprovision instance while object lock retention protects its objects: %v", err))
+				} else {
+					b.writeError(w, http.StatusInternalServerError, "DeprovisionError", err.Error())
+				}
+				return
+			}
 		}
 		if err := b.store.DeleteInstance(instanceID); err != nil {
+			b.finishOperation(op, err)
 			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 			return
 		}
+		b.finishOperation(op, nil)
 		b.writeJSON(w, http.StatusOK, map[string]any{})
 	}
 }
@@ -343,17 +642,24 @@ func (b *Broker) getInstanceHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if instance == nil {
+	if instance == nil || instance.Tombstoned() {
 		b.writeError(w, http.StatusNotFound, "InstanceNotFound", "Service instance not found")
 		return
 	}
 
-	b.writeJSON(w, http.StatusOK, map[string]any{
+	response := map[string]any{
 		"service_id":    instance.ServiceID,
 		"plan_id":       instance.PlanID,
 		"dashboard_url": b.getDashboardURL(instance),
 		"parameters":    instance.Parameters,
-	})
+	}
+	if instance.MaintenanceVersion != "" {
+		response["maintenance_info"] = MaintenanceInfo{Version: instance.MaintenanceVersion}
+	}
+	if usage := b.usageAttributes(instance); usage != nil {
+		response["metadata"] = map[string]any{"attributes": usage}
+	}
+	b.writeJSON(w, http.StatusOK, response)
 }
 
 func (b *Broker) lastOperationHandler(w http.ResponseWriter, r *http.Request) {
@@ -365,7 +671,7 @@ func (b *Broker) lastOperationHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if instance == nil {
+	if instance == nil || instance.Tombstoned() {
 		b.writeError(w, http.StatusGone, "InstanceNotFound", "Service instance not found")
 		return
 	}
@@ -374,6 +680,14 @@ func (b *Broker) lastOperationHandler(w http.ResponseWriter, r *http.Request) {
 	switch instance.State {
 	case "succeeded":
 		state = "succeeded"
+		failed, err := b.lastOperationFailed(instance.ID)
+		if err != nil {
+			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			return
+		}
+		if failed {
+			state = "failed"
+		}
 	case "failed":
 		state = "failed"
 	}
@@ -398,15 +712,15 @@ func (b *Broker) bindHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if instance == nil {
+	if instance == nil || instance.Tombstoned() {
 		b.writeError(w, http.StatusNotFound, "InstanceNotFound", "Service instance not found")
 		return
 	}
 
-	// Check if instance is ready
-	if instance.State != "succeeded" {
-		b.writeError(w, http.StatusUnprocessableEntity, "InstanceNotReady",
-			"Service instance is not ready")
+	// Parse request
+	var req BindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "Invalid JSON body")
 		return
 	}
 
@@ -417,74 +731,160 @@ func (b *Broker) bindHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if existing != nil {
-		b.writeJSON(w, http.StatusOK, b.buildCredentials(instance, existing))
+		// A retry must match the original request exactly
+		if conflicts := bindingConflicts(instance, existing, &req); len(conflicts) > 0 {
+			b.writeConflict(w, "service binding", conflicts)
+			return
+		}
+		switch {
+		case existing.Ready():
+			b.writeJSON(w, http.StatusOK, b.buildCredentials(r.Context(), instance, existing))
+		case existing.State == "binding" && bindAsync(r, instance):
+			b.writeJSON(w, http.StatusAccepted, map[string]any{
+				"operation": "bind",
+			})
+		case existing.State == "failed":
+			b.writeError(w, http.StatusConflict, "BindingFailed",
+				"A failed service binding with this ID exists; unbind it first")
+		default:
+			b.writeError(w, http.StatusUnprocessableEntity, "ConcurrencyError",
+				"Another operation for this service binding is in progress")
+		}
 		return
 	}
 
-	// Parse request
-	var req BindRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		b.writeError(w, http.StatusBadRequest, "BadRequest", "Invalid JSON body")
+	// Check if instance is ready
+	if instance.State != "succeeded" {
+		b.writeError(w, http.StatusUnprocessableEntity, "InstanceNotReady",
+			"Service instance is not ready")
+		return
+	}
+
+	maxTTLHours := 0
+	if plan := b.findPlan(instance.ServiceID, instance.PlanID); plan != nil {
+		if err := validateParameters(planSchemas(plan).BindingCreate, req.Parameters); err != nil {
+			b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+			return
+		}
+		maxTTLHours = plan.MaxBindingTTLHours
+	}
+
+	// A rotation creates a new IAM user with the same access as the binding it
+	// replaces, inheriting its parameters unless new ones are given
+	var predecessor *store.ServiceBinding
+	if req.PredecessorBindingID != "" {
+		predecessor, err = b.store.GetBinding(req.PredecessorBindingID)
+		if err != nil {
+			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			return
+		}
+		if predecessor == nil || predecessor.InstanceID != instanceID || !predecessor.Ready() {
+			b.writeError(w, http.StatusUnprocessableEntity, "InvalidPredecessor",
+				"predecessor_binding_id must name a completed binding of this service instance")
+			return
+		}
+		if len(req.Parameters) == 0 {
+			req.Parameters = predecessor.Parameters
+		}
+	}
+
+	bindParams, err := parseBindingParameters(req.Parameters)
+	if err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+	if predecessor != nil {
+		inheritScope(bindParams, predecessor)
+	}
+	if bindParams.Buckets != nil {
+		if instance.DeploymentName != "" {
+			b.writeError(w, http.StatusBadRequest, "InvalidParameters", "invalid parameters: buckets is only supported by shared plans")
+			return
+		}
+		if err := checkBindingBuckets(instance, bindParams.Buckets); err != nil {
+			b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+			return
+		}
+	}
+	now := time.Now()
+	expiresAt, err := bindingExpiry(bindParams, maxTTLHours, now)
+	if err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
 		return
 	}
 
 	binding := &store.ServiceBinding{
 		ID:         bindingID,
 		InstanceID: instanceID,
-		AppGUID:    req.AppGUID,
+		AppGUID:    bindAppGUID(&req),
 		Parameters: req.Parameters,
-		CreatedAt:  time.Now(),
+		CreatedAt:  now,
+		ExpiresAt:  expiresAt,
+		SpaceGUID:  bindSpaceGUID(&req),
+		Buckets:    bindParams.Buckets,
+		// Saved before the user is created, so that an interrupted bind can
+		// still be cleaned up
+		IAMUserName: bindingUserName(bindingID),
+
+		PredecessorBindingID: req.PredecessorBindingID,
+
+		OriginatingIdentity: callerIdentity(r.Context()),
+		RequestIdentity:     requestIdentity(r.Context()),
+	}
+	binding.Access = bindingAccess(instance, binding)
+	binding.Permissions, err = bindingPermissions(binding.Access, bindParams.Permissions)
+	if err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+	if bindParams.Prefix != nil {
+		binding.Prefix = *bindParams.Prefix
 	}
 
-	// For dedicated clusters, ensure the bucket exists before creating credentials
-	if instance.DeploymentName != "" && instance.IAMEndpoint != "" && instance.BucketName != "" {
-		dedicatedS3, err := minio.New(instance.IAMEndpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(instance.AdminAccessKey, instance.AdminSecretKey, ""),
-			Secure: false,
-			Region: b.config.SharedCluster.Region,
-		})
-		if err != nil {
-			log.Printf("Binding %s: Warning: could not create S3 client for bucket check: %v", bindingID, err)
-		} else {
-			ctx := context.Background()
-			exists, err := dedicatedS3.BucketExists(ctx, instance.BucketName)
-			if err != nil {
-				log.Printf("Binding %s: Warning: could not check bucket existence: %v", bindingID, err)
-			} else if !exists {
-				log.Printf("Binding %s: Creating bucket %s on dedicated cluster", bindingID, instance.BucketName)
-				if err := dedicatedS3.MakeBucket(ctx, instance.BucketName, minio.MakeBucketOptions{
-					Region: b.config.SharedCluster.Region,
-				}); err != nil {
-					log.Printf("Binding %s: Warning: could not create bucket: %v", bindingID, err)
-				}
-			}
+	if bindAsync(r, instance) {
+		// Dedicated clusters can be slow to answer; create the credentials in
+		// the background so the platform request does not time out
+		binding.State = "binding"
+		binding.StateMessage = "Creating credentials"
+		if err := b.store.SaveBinding(binding); err != nil {
+			b.writeStoreError(w, err)
+			return
 		}
+		op := b.startOperation(r, store.OperationBind, instanceID, bindingID)
+		go b.createBindingInBackground(instance, binding, op)
+		b.writeJSON(w, http.StatusAccepted, map[string]any{
+			"operation": "bind",
+		})
+		return
 	}
 
+	op := b.startOperation(r, store.OperationBind, instanceID, bindingID)
+
 	// Create per-binding IAM credentials (for both shared and dedicated clusters)
-	if err := b.createS3Credentials(instance, binding); err != nil {
+	if err := b.createBindingCredentials(r.Context(), instance, binding); err != nil {
+		b.finishOperation(op, err)
 		b.writeError(w, http.StatusInternalServerError, "BindError", err.Error())
 		return
 	}
 
+	binding.State = "succeeded"
 	if err := b.store.SaveBinding(binding); err != nil {
-		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		b.finishOperation(op, err)
+		// Another request saved this binding first; revoke the credentials we just created
+		if store.IsConflict(err) {
+			if cleanupErr := b.deleteS3Credentials(r.Context(), instance, binding); cleanupErr != nil {
+				logf(r.Context(), "Warning: failed to clean up credentials for binding %s: %v", bindingID, cleanupErr)
+			}
+		}
+		b.writeStoreError(w, err)
 		return
 	}
 
-	// Store credentials in CredHub if configured
-	if b.credhubClient != nil {
-		credPath := fmt.Sprintf("/seaweedfs-broker/instances/%s/bindings/%s", instanceID, bindingID)
-		if err := b.credhubClient.SetJSON(credPath, map[string]interface{}{
-			"access_key": binding.AccessKey,
-			"secret_key": binding.SecretKey,
-			"bucket":     instance.BucketName,
-		}); err != nil {
-			log.Printf("Warning: failed to store credentials in CredHub: %v", err)
-		}
-	}
+	b.storeBindingCredentials(r.Context(), instance, binding)
+	b.retirePredecessor(r.Context(), binding)
 
-	b.writeJSON(w, http.StatusCreated, b.buildCredentials(instance, binding))
+	b.finishOperation(op, nil)
+	b.writeJSON(w, http.StatusCreated, b.buildCredentials(r.Context(), instance, binding))
 }
 
 func (b *Broker) unbindHandler(w http.ResponseWriter, r *http.Request) {
@@ -497,7 +897,7 @@ func (b *Broker) unbindHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if instance == nil {
+	if instance == nil || instance.Tombstoned() {
 		b.writeError(w, http.StatusGone, "InstanceNotFound", "Service instance not found")
 		return
 	}
@@ -512,24 +912,47 @@ func (b *Broker) unbindHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Revoke S3 credentials
-	if err := b.deleteS3Credentials(instance, binding); err != nil {
-		log.Printf("Warning: failed to delete S3 credentials: %v", err)
+	switch binding.State {
+	case "unbinding":
+		if bindAsync(r, instance) {
+			b.writeJSON(w, http.StatusAccepted, map[string]any{
+				"operation": "unbind",
+			})
+			return
+		}
+		fallthrough
+	case "binding":
+		b.writeError(w, http.StatusUnprocessableEntity, "ConcurrencyError",
+			"Another operation for this service binding is in progress")
+		return
 	}
 
-	// Delete credentials from CredHub if configured
-	if b.credhubClient != nil {
-		credPath := fmt.Sprintf("/seaweedfs-broker/instances/%s/bindings/%s", instanceID, bindingID)
-		if err := b.credhubClient.Delete(credPath); err != nil {
-			log.Printf("Warning: failed to delete credentials from CredHub: %v", err)
+	if bindAsync(r, instance) {
+		binding.State = "unbinding"
+		binding.StateMessage = "Revoking credentials"
+		if err := b.store.SaveBinding(binding); err != nil {
+			b.writeStoreError(w, err)
+			return
 		}
+		op := b.startOperation(r, store.OperationUnbind, instanceID, bindingID)
+		go b.deleteBindingInBackground(instance, binding, op)
+		b.writeJSON(w, http.StatusAccepted, map[string]any{
+			"operation": "unbind",
+		})
+		return
 	}
 
+	op := b.startOperation(r, store.OperationUnbind, instanceID, bindingID)
+
+	b.removeBindingCredentials(r.Context(), instance, binding)
+
 	if err := b.store.DeleteBinding(bindingID); err != nil {
+		b.finishOperation(op, err)
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
 
+	b.finishOperation(op, nil)
 	b.writeJSON(w, http.StatusOK, map[string]any{})
 }
 
@@ -543,7 +966,7 @@ func (b *Broker) getBindingHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if instance == nil {
+	if instance == nil || instance.Tombstoned() {
 		b.writeError(w, http.StatusNotFound, "InstanceNotFound", "Service instance not found")
 		return
 	}
@@ -553,12 +976,13 @@ func (b *Broker) getBindingHandler(w http.ResponseWriter, r *http.Request) {
 		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
 		return
 	}
-	if binding == nil {
+	// Bindings that are still being created, or failed, are not retrievable
+	if binding == nil || !binding.Ready() {
 		b.writeError(w, http.StatusNotFound, "BindingNotFound", "Service binding not found")
 		return
 	}
 
-	b.writeJSON(w, http.StatusOK, b.buildCredentials(instance, binding))
+	b.writeJSON(w, http.StatusOK, b.buildCredentials(r.Context(), instance, binding))
 }
 
 // Admin API handlers
@@ -629,24 +1053,36 @@ func (b *Broker) upgradeDeploymentHandler(w http.ResponseWriter, r *http.Request
 
 	// Regenerate manifest with current release version and redeploy
 	manifest := b.generateDedicatedManifest(instance, plan)
-	log.Printf("Upgrading deployment %s with current release version", deploymentName)
+	logf(r.Context(), "Upgrading deployment %s with current release version", deploymentName)
+	op := b.startOperation(r, store.OperationUpgrade, instance.ID, "")
 
-	task, err := b.boshClient.Deploy(manifest)
+	task, err := b.boshClient.Deploy(manifest, requestIdentity(r.Context()))
 	if err != nil {
+		b.finishOperation(op, err)
 		b.writeError(w, http.StatusInternalServerError, "DeployError",
 			fmt.Sprintf("Failed to start deployment: %v", err))
 		return
 	}
+	b.recordTask(op, task.ID)
 
 	// Wait synchronously so the errand knows success/failure
 	task, err = b.boshClient.WaitForTask(task.ID, 30*time.Minute)
 	if err != nil {
+		b.finishOperation(op, err)
 		b.writeError(w, http.StatusInternalServerError, "DeployFailed",
 			fmt.Sprintf("Deployment failed: %v", err))
 		return
 	}
+	b.finishOperation(op, nil)
 
-	log.Printf("Upgrade of deployment %s completed successfully (task %d)", deploymentName, task.ID)
+	if info := b.planMaintenanceInfo(plan); info != nil && instance.MaintenanceVersion != info.Version {
+		instance.MaintenanceVersion = info.Version
+		if err := b.store.SaveInstance(instance); err != nil {
+			logf(r.Context(), "Warning: could not record maintenance version of instance %s: %v", instance.ID, err)
+		}
+	}
+
+	logf(r.Context(), "Upgrade of deployment %s completed successfully (task %d)", deploymentName, task.ID)
 	b.writeJSON(w, http.StatusOK, map[string]any{
 		"deployment": deploymentName,
 		"task_id":    task.ID,
@@ -693,24 +1129,29 @@ func (b *Broker) recreateDeploymentHandler(w http.ResponseWriter, r *http.Reques
 
 	// Regenerate manifest and redeploy with recreate flag (VMs recreated, persistent disks preserved)
 	manifest := b.generateDedicatedManifest(instance, plan)
-	log.Printf("Recreating deployment %s (persistent disks preserved)", deploymentName)
+	logf(r.Context(), "Recreating deployment %s (persistent disks preserved)", deploymentName)
+	op := b.startOperation(r, store.OperationRecreate, instance.ID, "")
 
-	task, err := b.boshClient.DeployWithRecreate(manifest)
+	task, err := b.boshClient.DeployWithRecreate(manifest, requestIdentity(r.Context()))
 	if err != nil {
+		b.finishOperation(op, err)
 		b.writeError(w, http.StatusInternalServerError, "RecreateError",
 			fmt.Sprintf("Failed to start recreate: %v", err))
 		return
 	}
+	b.recordTask(op, task.ID)
 
 	// Wait synchronously so the errand knows success/failure
 	task, err = b.boshClient.WaitForTask(task.ID, 30*time.Minute)
 	if err != nil {
+		b.finishOperation(op, err)
 		b.writeError(w, http.StatusInternalServerError, "RecreateFailed",
 			fmt.Sprintf("Recreate failed: %v", err))
 		return
 	}
+	b.finishOperation(op, nil)
 
-	log.Printf("Recreate of deployment %s completed successfully (task %d)", deploymentName, task.ID)
+	logf(r.Context(), "Recreate of deployment %s completed successfully (task %d)", deploymentName, task.ID)
 	b.writeJSON(w, http.StatusOK, map[string]any{
 		"deployment": deploymentName,
 		"task_id":    task.ID,
@@ -733,6 +1174,85 @@ func (b *Broker) writeError(w http.ResponseWriter, status int, errorCode, descri
 	})
 }
 
+// writeStoreError reports a state store failure. Revision conflicts are
+// returned as the OSB ConcurrencyError so the platform retries the request.
+func (b *Broker) writeStoreError(w http.ResponseWriter, err error) {
+	if store.IsConflict(err) {
+		b.writeError(w, http.StatusUnprocessableEntity, "ConcurrencyError",
+			"Another operation for this resource is in progress")
+		return
+	}
+	b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+}
+
+// saveOperationState persists a background operation's view of an instance.
+// On a revision conflict the operation-owned fields are re-applied to the
+// latest stored copy, unless the instance has left opState in the meantime
+// (for example a deprovision arrived while provisioning), in which case
+// errOperationSuperseded is returned and the operation should stop.
+func (b *Broker) saveOperationState(ctx context.Context, instance *store.ServiceInstance, opState string) error {
+	for attempt := 1; ; attempt++ {
+		err := b.store.SaveInstance(instance)
+		if err == nil || !store.IsConflict(err) || attempt >= maxConflictRetries {
+			return err
+		}
+
+		latest, err := b.store.GetInstance(instance.ID)
+		if err != nil {
+			return err
+		}
+		if latest == nil || latest.State != opState {
+			return errOperationSuperseded
+		}
+		logf(ctx, "Instance %s: concurrent update detected, re-applying %s state", instance.ID, opState)
+		copyOperationFields(latest, instance)
+		*instance = *latest
+	}
+}
+
+// failOperation records a failed background operation on the instance and
+// in its operation history. Only a failed provision leaves the instance
+// failed; after a failed update or deprovision the instance keeps serving its
+// previous deployment and returns to succeeded, and last_operation reports the
+// failure from the operation history. The operation is finished first so that
+// last_operation never sees the instance succeeded while it is still running.
+func (b *Broker) failOperation(instance *store.ServiceInstance, op *store.Operation, opState, message string) {
+	b.finishOperation(op, errors.New(message))
+
+	instance.State = "succeeded"
+	if opState == "provisioning" {
+		instance.State = "failed"
+	}
+	instance.StateMessage = message
+	instance.UpdatePlanID = ""
+	if err := b.saveOperationState(operationContext(op), instance, opState); err != nil {
+		logf(operationContext(op), "Instance %s: could not record failure %q: %v", instance.ID, message, err)
+	}
+}
+
+// copyOperationFields copies the fields written by provisioning, update and
+// deprovisioning operations from src to dst
+func copyOperationFields(dst, src *store.ServiceInstance) {
+	dst.PlanID = src.PlanID
+	dst.BucketName = src.BucketName
+	dst.Buckets = src.Buckets
+	dst.DeploymentName = src.DeploymentName
+	dst.S3Endpoint = src.S3Endpoint
+	dst.IAMEndpoint = src.IAMEndpoint
+	dst.FilerEndpoint = src.FilerEndpoint
+	dst.ConsoleURL = src.ConsoleURL
+	dst.FilerURL = src.FilerURL
+	dst.VolumeURL = src.VolumeURL
+	dst.AdminURL = src.AdminURL
+	dst.AdminAccessKey = src.AdminAccessKey
+	dst.AdminSecretKey = src.AdminSecretKey
+	dst.AdminPassword = src.AdminPassword
+	dst.MaintenanceVersion = src.MaintenanceVersion
+	dst.UpdatePlanID = src.UpdatePlanID
+	dst.State = src.State
+	dst.StateMessage = src.StateMessage
+}
+
 func (b *Broker) findPlan(serviceID, planID string) *config.PlanConfig {
 	for _, service := range b.config.Catalog.Services {
 		if service.ID == serviceID {
@@ -777,6 +1297,12 @@ func (b *Broker) buildCatalog() map[string]any {
 					"bullets":     plan.Metadata.Bullets,
 				},
 			}
+			if info := b.planMaintenanceInfo(&plan); info != nil {
+				planData["maintenance_info"] = info
+			}
+			if schemas := catalogSchemas(&plan); schemas != nil {
+				planData["schemas"] = schemas
+			}
 			plans = append(plans, planData)
 		}
 
@@ -793,7 +1319,8 @@ func (b *Broker) buildCatalog() map[string]any {
 			"bindable":              svc.Bindable,
 			"instances_retrievable": true,
 			"bindings_retrievable":  true,
-			"plan_updateable":       false,
+			"binding_rotatable":     true,
+			"plan_updateable":       true,
 			"plans":                 plans,
 			"tags":                  svc.Tags,
 			"metadata": map[string]any{
@@ -803,6 +1330,7 @@ func (b *Broker) buildCatalog() map[string]any {
 				"providerDisplayName": svc.Metadata.ProviderDisplayName,
 				"documentationUrl":    svc.Metadata.DocumentationURL,
 				"supportUrl":          svc.Metadata.SupportURL,
+				"shareable":           svc.Metadata.Shareable,
 			},
 		}
 
@@ -814,7 +1342,7 @@ func (b *Broker) buildCatalog() map[string]any {
 	}
 }
 
-func (b *Broker) buildCredentials(instance *store.ServiceInstance, binding *store.ServiceBinding) map[string]any {
+func (b *Broker) buildCredentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) map[string]any {
 	var endpoint, bucket string
 	var useSSL bool
 
@@ -824,12 +1352,12 @@ func (b *Broker) buildCredentials(instance *store.ServiceInstance, binding *stor
 		bucket = instance.BucketName
 		useSSL = !strings.Contains(endpoint, ":8333")
 		if endpoint == "" {
-			log.Printf("WARNING: Building credentials for dedicated cluster %s but S3Endpoint is empty!", instance.DeploymentName)
+			logf(ctx, "WARNING: Building credentials for dedicated cluster %s but S3Endpoint is empty!", instance.DeploymentName)
 		}
 	} else {
 		// Shared cluster
 		endpoint = b.config.SharedCluster.S3Endpoint
-		bucket = instance.BucketName
+		bucket = primaryBucket(instance, binding)
 		useSSL = b.config.SharedCluster.UseSSL
 	}
 
@@ -856,6 +1384,14 @@ func (b *Broker) buildCredentials(instance *store.ServiceInstance, binding *stor
 		"uri":          fmt.Sprintf("s3://%s:%s@%s/%s", accessKey, secretKey, endpoint, bucket),
 	}
 
+	if instance.DeploymentName == "" {
+		creds["buckets"] = bindingBuckets(instance, binding)
+	}
+	creds["permissions"] = effectivePermissions(binding)
+	if binding.Prefix != "" {
+		creds["prefix"] = binding.Prefix
+	}
+
 	// Include management URLs for dedicated clusters
 	if instance.DeploymentName != "" {
 		if instance.ConsoleURL != "" {
@@ -874,9 +1410,13 @@ func (b *Broker) buildCredentials(instance *store.ServiceInstance, binding *stor
 		}
 	}
 
-	return map[string]any{
+	response := map[string]any{
 		"credentials": creds,
 	}
+	if metadata := bindingMetadata(binding); metadata != nil {
+		response["metadata"] = metadata
+	}
+	return response
 }
 
 func generateAccessKey() string {
@@ -899,86 +1439,91 @@ func getMapKeys(m map[string]any) []string {
 	return keys
 }
 
+// vmJobName returns the instance group name of a VM reported by BOSH, which
+// is spread across different fields depending on the Director version
+func vmJobName(vm map[string]any) string {
+	if j, ok := vm["job_name"].(string); ok && j != "" {
+		return j
+	}
+	if j, ok := vm["job"].(string); ok && j != "" {
+		return j
+	}
+	if inst, ok := vm["instance"].(string); ok && inst != "" {
+		if idx := strings.Index(inst, "/"); idx > 0 {
+			return inst[:idx]
+		}
+	}
+	return ""
+}
+
 // Request/Response types
 
 type ProvisionRequest struct {
-	ServiceID        string         `json:"service_id"`
-	PlanID           string         `json:"plan_id"`
-	OrganizationGUID string         `json:"organization_guid"`
-	SpaceGUID        string         `json:"space_guid"`
-	Parameters       map[string]any `json:"parameters,omitempty"`
-	Context          map[string]any `json:"context,omitempty"`
+	ServiceID        string           `json:"service_id"`
+	PlanID           string           `json:"plan_id"`
+	OrganizationGUID string           `json:"organization_guid"`
+	SpaceGUID        string           `json:"space_guid"`
+	Parameters       map[string]any   `json:"parameters,omitempty"`
+	Context          map[string]any   `json:"context,omitempty"`
+	MaintenanceInfo  *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+type UpdateRequest struct {
+	ServiceID       string           `json:"service_id"`
+	PlanID          string           `json:"plan_id,omitempty"`
+	Parameters      map[string]any   `json:"parameters,omitempty"`
+	Context         map[string]any   `json:"context,omitempty"`
+	PreviousValues  map[string]any   `json:"previous_values,omitempty"`
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
 }
 
 type BindRequest struct {
-	ServiceID  string         `json:"service_id"`
-	PlanID     string         `json:"plan_id"`
-	AppGUID    string         `json:"app_guid,omitempty"`
-	BindResource map[string]any `json:"bind_resource,omitempty"`
-	Parameters map[string]any `json:"parameters,omitempty"`
+	ServiceID            string         `json:"service_id"`
+	PlanID               string         `json:"plan_id"`
+	AppGUID              string         `json:"app_guid,omitempty"`
+	BindResource         map[string]any `json:"bind_resource,omitempty"`
+	Parameters           map[string]any `json:"parameters,omitempty"`
+	PredecessorBindingID string         `json:"predecessor_binding_id,omitempty"`
+	Context              map[string]any `json:"context,omitempty"`
 }
 
 // Provisioning implementations
 
-func (b *Broker) provisionSharedBucket(instance *store.ServiceInstance) error {
+func (b *Broker) provisionSharedBucket(ctx context.Context, instance *store.ServiceInstance, params *bucketParameters) error {
 	if b.s3Client == nil {
 		return fmt.Errorf("shared cluster not configured")
 	}
 
-	// Generate bucket name
+	// Generate bucket name unless one was given
 	bucketName := fmt.Sprintf("cf-%s-%s", instance.SpaceGUID[:8], instance.ID[:8])
-	instance.BucketName = bucketName
-
-	// Create bucket
-	ctx := context.Background()
-	err := b.s3Client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{
-		Region: b.config.SharedCluster.Region,
-	})
-	if err != nil {
-		// Check if bucket already exists
-		exists, errBucketExists := b.s3Client.BucketExists(ctx, bucketName)
-		if errBucketExists != nil || !exists {
-			return fmt.Errorf("failed to create bucket: %w", err)
-		}
+	if params.BucketName != nil {
+		bucketName = *params.BucketName
 	}
-
-	log.Printf("Created bucket %s for instance %s", bucketName, instance.ID)
-	return nil
-}
-
-func (b *Broker) deprovisionSharedBucket(instance *store.ServiceInstance) error {
-	if b.s3Client == nil || instance.BucketName == "" {
-		return nil
+	names := []string{bucketName}
+	for _, name := range params.Buckets {
+		names = append(names, fmt.Sprintf("%s-%s", bucketName, name))
 	}
-
-	ctx := context.Background()
-
-	// Delete all objects in bucket first
-	objectsCh := b.s3Client.ListObjects(ctx, instance.BucketName, minio.ListObjectsOptions{
-		Recursive: true,
-	})
-
-	for object := range objectsCh {
-		if object.Err != nil {
-			log.Printf("Error listing objects: %v", object.Err)
-			continue
-		}
-		err := b.s3Client.RemoveObject(ctx, instance.BucketName, object.Key, minio.RemoveObjectOptions{})
-		if err != nil {
-			log.Printf("Error removing object %s: %v", object.Key, err)
-		}
+	if err := b.checkBucketNamesAvailable(instance.ID, names); err != nil {
+		return err
 	}
 
-	// Delete bucket
-	if err := b.s3Client.RemoveBucket(ctx, instance.BucketName); err != nil {
-		return fmt.Errorf("failed to delete bucket: %w", err)
+	// Create bucket. A custom name must be new on the cluster, unless an
+	// earlier attempt left it empty; an existing bucket with the generated
+	// name is left from an earlier attempt and reused.
+	if params.BucketName != nil {
+		if err := createNewBucket(ctx, b.sharedBucket(bucketName), params); err != nil {
+			return err
+		}
+	} else if err := createBucket(ctx, b.sharedBucket(bucketName), params); err != nil {
+		return err
 	}
+	instance.BucketName = bucketName
 
-	log.Printf("Deleted bucket %s for instance %s", instance.BucketName, instance.ID)
+	logf(ctx, "Created bucket %s for instance %s", bucketName, instance.ID)
 	return nil
 }
 
-func (b *Broker) createS3Credentials(instance *store.ServiceInstance, binding *store.ServiceBinding) error {
+func (b *Broker) createS3Credentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) error {
 	// Determine which IAM client to use
 	var iamClient *iam.Client
 
@@ -986,14 +1531,26 @@ func (b *Broker) createS3Credentials(instance *store.ServiceInstance, binding *s
 		// Dedicated cluster: create IAM client for the on-demand cluster
 		iamEndpoint := instance.IAMEndpoint
 		if iamEndpoint == "" {
+			permissions := effectivePermissions(binding)
+			if (permissions != permissionReadWrite && permissions != permissionAdmin) || binding.Prefix != "" {
+				return fmt.Errorf("dedicated cluster %s has no IAM endpoint to create credentials with %s permissions or a prefix",
+					instance.DeploymentName, permissions)
+			}
+			// The admin key cannot be deactivated when the binding expires
+			if binding.ExpiresAt != nil {
+				return fmt.Errorf("dedicated cluster %s has no IAM endpoint to create credentials that expire",
+					instance.DeploymentName)
+			}
 			// Fall back to admin credentials without per-binding IAM
-			log.Printf("Binding %s: No IAM endpoint for dedicated cluster %s, using admin credentials", binding.ID, instance.DeploymentName)
+			logf(ctx, "Binding %s: No IAM endpoint for dedicated cluster %s, using admin credentials", binding.ID, instance.DeploymentName)
 			binding.AccessKey = instance.AdminAccessKey
 			binding.SecretKey = instance.AdminSecretKey
+			binding.Permissions = permissionAdmin
+			binding.IAMUserName = ""
 			return nil
 		}
 		iamClient = iam.NewClient(iamEndpoint, instance.AdminAccessKey, instance.AdminSecretKey, b.config.SharedCluster.Region, false)
-		log.Printf("Binding %s: Created IAM client for dedicated cluster at %s", binding.ID, iamEndpoint)
+		logf(ctx, "Binding %s: Created IAM client for dedicated cluster at %s", binding.ID, iamEndpoint)
 	} else {
 		// Shared cluster: use the pre-configured IAM client
 		if b.iamClient == nil {
@@ -1001,89 +1558,126 @@ func (b *Broker) createS3Credentials(instance *store.ServiceInstance, binding *s
 		}
 		iamClient = b.iamClient
 	}
+	iamClient = iamClient.WithRequestID(requestIdentity(ctx))
 
 	// Create per-binding IAM credentials (same flow for shared and dedicated)
-	userName := fmt.Sprintf("cf-binding-%s", binding.ID[:min(len(binding.ID), 16)])
-	log.Printf("Binding %s: Creating IAM user %s via SeaweedFS IAM API", binding.ID, userName)
+	userName := bindingUserName(binding.ID)
+	logf(ctx, "Binding %s: Creating IAM user %s via SeaweedFS IAM API", binding.ID, userName)
 
+	// Recorded before the call, so that cleanup also covers a user whose
+	// creation did not report back
+	binding.IAMUserName = userName
 	if err := iamClient.CreateUser(userName); err != nil {
-		log.Printf("Binding %s: IAM CreateUser failed: %v", binding.ID, err)
+		logf(ctx, "Binding %s: IAM CreateUser failed: %v", binding.ID, err)
+		if iam.IsEntityAlreadyExists(err) {
+			return fmt.Errorf("failed to create IAM user %s: %w", userName, errIAMUserExists)
+		}
 		return fmt.Errorf("failed to create IAM user: %w", err)
 	}
 
 	accessKey, err := iamClient.CreateAccessKey(userName)
 	if err != nil {
-		log.Printf("Binding %s: IAM CreateAccessKey failed: %v", binding.ID, err)
+		logf(ctx, "Binding %s: IAM CreateAccessKey failed: %v", binding.ID, err)
 		return fmt.Errorf("failed to create S3 credentials via IAM API: %w", err)
 	}
 
-	binding.IAMUserName = userName
 	binding.AccessKey = accessKey.AccessKeyID
 	binding.SecretKey = accessKey.SecretAccessKey
 
-	log.Printf("Binding %s: Created IAM credentials for user %s, access_key=%s",
+	logf(ctx, "Binding %s: Created IAM credentials for user %s, access_key=%s",
 		binding.ID, userName, accessKey.AccessKeyID)
 
-	// Optionally attach a policy to restrict access to only this binding's bucket
-	policyName := fmt.Sprintf("bucket-access-%s", binding.ID[:min(len(binding.ID), 8)])
-	if err := iamClient.PutUserPolicy(userName, policyName, instance.BucketName); err != nil {
-		log.Printf("Warning: Could not attach bucket policy for user %s: %v", userName, err)
+	// Without its policy the user may have no access, or more than the
+	// binding allows, depending on the gateway configuration. The caller
+	// removes the user and key when this fails.
+	if err := b.putBindingPolicy(iamClient, instance, binding); err != nil {
+		if b.config.Bindings.PolicyFailOpen {
+			logf(ctx, "Warning: Could not attach bucket policy for user %s: %v", userName, err)
+			return nil
+		}
+		logf(ctx, "Binding %s: Could not attach bucket policy for user %s: %v", binding.ID, userName, err)
+		return fmt.Errorf("failed to attach bucket policy: %w", err)
 	}
 
 	return nil
 }
 
-func (b *Broker) deleteS3Credentials(instance *store.ServiceInstance, binding *store.ServiceBinding) error {
-	if binding.IAMUserName == "" {
-		log.Printf("Binding %s: No IAM credentials to delete", binding.ID)
-		return nil
-	}
-
-	// Determine which IAM client to use
-	var iamClient *iam.Client
-
-	if instance.DeploymentName != "" {
-		iamEndpoint := instance.IAMEndpoint
-		if iamEndpoint == "" {
-			log.Printf("Binding %s: No IAM endpoint for dedicated cluster, skipping credential cleanup", binding.ID)
+// deleteS3Credentials deletes the IAM user of a binding with its policy and
+// access keys. Bindings that did not record a user name, because they were
+// interrupted before or created by older broker versions, are looked up by
+// the derived name. A user that does not exist counts as deleted.
+func (b *Broker) deleteS3Credentials(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) error {
+	userName := binding.IAMUserName
+	if userName == "" {
+		if instance.DeploymentName != "" && binding.AccessKey != "" && binding.AccessKey == instance.AdminAccessKey {
+			logf(ctx, "Binding %s: Uses the cluster's admin credentials, no IAM user to delete", binding.ID)
 			return nil
 		}
-		iamClient = iam.NewClient(iamEndpoint, instance.AdminAccessKey, instance.AdminSecretKey, b.config.SharedCluster.Region, false)
-	} else {
-		if b.iamClient == nil {
-			log.Printf("Binding %s: No IAM client available for cleanup", binding.ID)
-			return nil
-		}
-		iamClient = b.iamClient
+		userName = bindingUserName(binding.ID)
+	}
+
+	iamClient := b.instanceIAMClient(instance)
+	if iamClient == nil {
+		logf(ctx, "Binding %s: No IAM client available, skipping credential cleanup", binding.ID)
+		return nil
 	}
+	iamClient = iamClient.WithRequestID(requestIdentity(ctx))
 
-	log.Printf("Binding %s: Deleting IAM credentials for user %s", binding.ID, binding.IAMUserName)
+	logf(ctx, "Binding %s: Deleting IAM credentials for user %s", binding.ID, userName)
 
 	// Delete the user policy first (best effort)
-	policyName := fmt.Sprintf("bucket-access-%s", binding.ID[:min(len(binding.ID), 8)])
-	if err := iamClient.DeleteUserPolicy(binding.IAMUserName, policyName); err != nil {
-		log.Printf("Warning: Could not delete user policy: %v", err)
+	policyName := bindingPolicyName(binding.ID)
+	if err := iamClient.DeleteUserPolicy(userName, policyName); err != nil && !iam.IsNoSuchEntity(err) {
+		logf(ctx, "Warning: Could not delete user policy: %v", err)
 	}
 
-	if binding.AccessKey != "" {
-		if err := iamClient.DeleteAccessKey(binding.IAMUserName, binding.AccessKey); err != nil {
-			log.Printf("Warning: Could not delete access key %s: %v", binding.AccessKey, err)
+	// The key may have been created without being recorded
+	keyIDs := make([]string, 0, 1)
+	keys, err := iamClient.ListAccessKeys(userName)
+	switch {
+	case iam.IsNoSuchEntity(err):
+		logf(ctx, "Binding %s: IAM user %s does not exist", binding.ID, userName)
+		return nil
+	case err != nil:
+		logf(ctx, "Warning: Could not list access keys of IAM user %s: %v", userName, err)
+		if binding.AccessKey != "" {
+			keyIDs = append(keyIDs, binding.AccessKey)
+		}
+	default:
+		for _, key := range keys {
+			keyIDs = append(keyIDs, key.AccessKeyID)
+		}
+	}
+	for _, keyID := range keyIDs {
+		if err := iamClient.DeleteAccessKey(userName, keyID); err != nil && !iam.IsNoSuchEntity(err) {
+			logf(ctx, "Warning: Could not delete access key %s: %v", keyID, err)
 		}
 	}
 
-	if err := iamClient.DeleteUser(binding.IAMUserName); err != nil {
-		log.Printf("Warning: Could not delete IAM user %s: %v", binding.IAMUserName, err)
+	if err := iamClient.DeleteUser(userName); err != nil && !iam.IsNoSuchEntity(err) {
+		return fmt.Errorf("could not delete IAM user %s: %w", userName, err)
 	}
 
-	log.Printf("Binding %s: Deleted IAM credentials and user %s", binding.ID, binding.IAMUserName)
+	logf(ctx, "Binding %s: Deleted IAM credentials and user %s", binding.ID, userName)
 	return nil
 }
 
-func (b *Broker) provisionDedicatedCluster(instance *store.ServiceInstance, plan *config.PlanConfig) {
+// instanceIAMClient returns a client for the IAM API that manages the
+// credentials of an instance's bindings, or nil if there is none
+func (b *Broker) instanceIAMClient(instance *store.ServiceInstance) *iam.Client {
+	if instance.DeploymentName != "" {
+		if instance.IAMEndpoint == "" {
+			return nil
+		}
+		return iam.NewClient(instance.IAMEndpoint, instance.AdminAccessKey, instance.AdminSecretKey, b.config.SharedCluster.Region, false)
+	}
+	return b.iamClient
+}
+
+func (b *Broker) provisionDedicatedCluster(instance *store.ServiceInstance, plan *config.PlanConfig, op *store.Operation) {
+	ctx := operationContext(op)
 	if b.boshClient == nil {
-		instance.State = "failed"
-		instance.StateMessage = "BOSH director not configured"
-		b.store.SaveInstance(instance)
+		b.failOperation(instance, op, "provisioning", "BOSH director not configured")
 		return
 	}
 
@@ -1096,91 +1690,160 @@ func (b *Broker) provisionDedicatedCluster(instance *store.ServiceInstance, plan
 	instance.AdminPassword = generateSecretKey()
 	instance.BucketName = "default"
 
-	// Use AZs from plan config (passed from tile's availability_zone_names).
-	// Fall back to BOSH cloud config discovery if plan AZs are empty.
-	if plan.DedicatedConfig != nil {
-		if len(plan.DedicatedConfig.AZs) > 0 {
-			log.Printf("Using configured AZs for network %s: %v", plan.DedicatedConfig.Network, plan.DedicatedConfig.AZs)
-		} else if plan.DedicatedConfig.Network != "" {
-			log.Printf("No AZs configured, attempting to discover from BOSH cloud config for network %s", plan.DedicatedConfig.Network)
-			azs, err := b.boshClient.GetCloudConfigAZsForNetwork(plan.DedicatedConfig.Network)
-			if err != nil {
-				log.Printf("Warning: could not discover AZs from cloud config: %v, using fallback [z1]", err)
-				plan.DedicatedConfig.AZs = []string{"z1"}
-			} else {
-				log.Printf("Discovered AZs for network %s: %v", plan.DedicatedConfig.Network, azs)
-				plan.DedicatedConfig.AZs = azs
-			}
-		}
+	// Record the deployment name before deploying, so a deprovision that
+	// arrives while the deploy is being started still deletes it
+	instance.StateMessage = "Starting deployment"
+	if err := b.saveOperationState(ctx, instance, "provisioning"); err != nil {
+		logf(ctx, "Instance %s: stopping provisioning: %v", instance.ID, err)
+		b.finishOperation(op, err)
+		return
 	}
 
+	plan = b.resolvePlanAZs(ctx, plan)
+
 	// Generate manifest
 	manifest := b.generateDedicatedManifest(instance, plan)
-	log.Printf("Generated manifest for deployment %s:\n%s", deploymentName, string(manifest))
+	logf(ctx, "Generated manifest for deployment %s:\n%s", deploymentName, string(manifest))
 
 	// Deploy
-	task, err := b.boshClient.Deploy(manifest)
+	task, err := b.boshClient.Deploy(manifest, op.RequestIdentity)
 	if err != nil {
-		instance.State = "failed"
-		instance.StateMessage = fmt.Sprintf("Failed to start deployment: %v", err)
-		b.store.SaveInstance(instance)
+		b.failProvision(instance, op, fmt.Sprintf("Failed to start deployment: %v", err))
 		return
 	}
+	b.recordTask(op, task.ID)
 
 	instance.StateMessage = fmt.Sprintf("Deployment started, task ID: %d", task.ID)
-	b.store.SaveInstance(instance)
+	if err := b.saveOperationState(ctx, instance, "provisioning"); err != nil {
+		logf(ctx, "Instance %s: stopping provisioning: %v", instance.ID, err)
+		b.finishOperation(op, err)
+		return
+	}
 
 	// Wait for deployment
 	task, err = b.boshClient.WaitForTask(task.ID, 30*time.Minute)
 	if err != nil {
-		instance.State = "failed"
-		instance.StateMessage = fmt.Sprintf("Deployment failed: %v", err)
-		b.store.SaveInstance(instance)
+		b.failProvision(instance, op, fmt.Sprintf("Deployment failed: %v", err))
 		return
 	}
 
-	// Discover S3 VM internal endpoint for IAM operations
+	// Discover the S3 endpoints of the new deployment
+	b.discoverDedicatedEndpoints(ctx, instance, plan)
+
+	// Create the default bucket on the dedicated cluster using admin
+	// credentials. Binding retries a failed creation, but bucket features
+	// the developer asked for must be in place when provisioning succeeds.
+	bucketParams, err := parseBucketParameters(instance.Parameters)
+	if err != nil {
+		b.failProvision(instance, op, err.Error())
+		return
+	}
+	if instance.IAMEndpoint != "" || bucketParams.configuresBucket() {
+		logf(ctx, "Creating default bucket on dedicated cluster at %s", instance.IAMEndpoint)
+		target, err := b.dedicatedBucket(instance)
+		if err == nil {
+			err = createBucket(ctx, target, bucketParams)
+		}
+		if err != nil && bucketParams.configuresBucket() {
+			b.failProvision(instance, op, fmt.Sprintf("Could not create default bucket: %v", err))
+			return
+		} else if err != nil {
+			logf(ctx, "Warning: could not create default bucket: %v", err)
+		} else {
+			logf(ctx, "Created default bucket %s on dedicated cluster", instance.BucketName)
+			if err := applyBucketParameters(ctx, target, bucketParams); err != nil {
+				b.failProvision(instance, op, fmt.Sprintf("Could not configure default bucket: %v", err))
+				return
+			}
+		}
+	}
+
+	if info := b.planMaintenanceInfo(plan); info != nil {
+		instance.MaintenanceVersion = info.Version
+	}
+	instance.State = "succeeded"
+	instance.StateMessage = "Deployment complete"
+	if err := b.saveOperationState(ctx, instance, "provisioning"); err != nil {
+		logf(ctx, "Instance %s: could not record completed provisioning: %v", instance.ID, err)
+		b.finishOperation(op, err)
+		return
+	}
+	b.finishOperation(op, nil)
+
+	logf(ctx, "Provisioned dedicated cluster %s for instance %s", deploymentName, instance.ID)
+}
+
+// resolvePlanAZs returns a copy of a dedicated plan with its AZs filled in.
+// The copy is needed because the plan's dedicated config is shared with the
+// broker config and other in-flight requests.
+func (b *Broker) resolvePlanAZs(ctx context.Context, plan *config.PlanConfig) *config.PlanConfig {
+	if plan.DedicatedConfig == nil {
+		return plan
+	}
+	planCopy := *plan
+	dedicatedCopy := *plan.DedicatedConfig
+	planCopy.DedicatedConfig = &dedicatedCopy
+	plan = &planCopy
+
+	// Use AZs from plan config (passed from tile's availability_zone_names).
+	// Fall back to BOSH cloud config discovery if plan AZs are empty.
+	if len(plan.DedicatedConfig.AZs) > 0 {
+		logf(ctx, "Using configured AZs for network %s: %v", plan.DedicatedConfig.Network, plan.DedicatedConfig.AZs)
+	} else if plan.DedicatedConfig.Network != "" {
+		logf(ctx, "No AZs configured, attempting to discover from BOSH cloud config for network %s", plan.DedicatedConfig.Network)
+		azs, err := b.boshClient.GetCloudConfigAZsForNetwork(plan.DedicatedConfig.Network)
+		if err != nil {
+			logf(ctx, "Warning: could not discover AZs from cloud config: %v, using fallback [z1]", err)
+			plan.DedicatedConfig.AZs = []string{"z1"}
+		} else {
+			logf(ctx, "Discovered AZs for network %s: %v", plan.DedicatedConfig.Network, azs)
+			plan.DedicatedConfig.AZs = azs
+		}
+	}
+	return plan
+}
+
+// discoverDedicatedEndpoints sets the S3, IAM and route URLs of a dedicated
+// instance from its deployment's VMs and the plan's route settings
+func (b *Broker) discoverDedicatedEndpoints(ctx context.Context, instance *store.ServiceInstance, plan *config.PlanConfig) {
+	// Route URLs are only kept for routes the plan still enables
+	instance.ConsoleURL = ""
+	instance.FilerURL = ""
+	instance.VolumeURL = ""
+	instance.AdminURL = ""
+
 	hasCFDeployment := b.config.CF.DeploymentName != "" && b.config.CF.SystemDomain != ""
-	vms, err := b.boshClient.GetDeploymentVMs(deploymentName)
+	vms, err := b.boshClient.GetDeploymentVMs(instance.DeploymentName)
 	if err != nil {
-		log.Printf("Warning: could not get deployment VMs for %s: %v", deploymentName, err)
+		logf(ctx, "Warning: could not get deployment VMs for %s: %v", instance.DeploymentName, err)
 	} else {
-		log.Printf("Got %d VMs for deployment %s", len(vms), deploymentName)
+		logf(ctx, "Got %d VMs for deployment %s", len(vms), instance.DeploymentName)
 		for i, vm := range vms {
-			jobName := ""
-			if j, ok := vm["job_name"].(string); ok && j != "" {
-				jobName = j
-			} else if j, ok := vm["job"].(string); ok && j != "" {
-				jobName = j
-			} else if inst, ok := vm["instance"].(string); ok && inst != "" {
-				if idx := strings.Index(inst, "/"); idx > 0 {
-					jobName = inst[:idx]
-				}
-			}
+			jobName := vmJobName(vm)
 
 			if i == 0 {
-				log.Printf("VM fields available: %v", getMapKeys(vm))
+				logf(ctx, "VM fields available: %v", getMapKeys(vm))
 			}
-			log.Printf("VM %d: jobName=%s, instance=%v, dns=%v, ips=%v", i, jobName, vm["instance"], vm["dns"], vm["ips"])
+			logf(ctx, "VM %d: jobName=%s, instance=%v, dns=%v, ips=%v", i, jobName, vm["instance"], vm["dns"], vm["ips"])
 
 			if jobName == "seaweedfs-s3" {
 				// Always capture internal endpoint for IAM operations (IP-based, no TLS)
 				if ips, ok := vm["ips"].([]any); ok && len(ips) > 0 {
 					instance.IAMEndpoint = fmt.Sprintf("%v:8333", ips[0])
-					log.Printf("Set IAMEndpoint from IP: %s", instance.IAMEndpoint)
+					logf(ctx, "Set IAMEndpoint from IP: %s", instance.IAMEndpoint)
 				}
 				// Set S3Endpoint for bindings - prefer DNS for stable addressing
 				if dns, ok := vm["dns"].([]any); ok && len(dns) > 0 {
 					instance.S3Endpoint = fmt.Sprintf("%v:8333", dns[0])
-					log.Printf("Set S3Endpoint from DNS: %s", instance.S3Endpoint)
+					logf(ctx, "Set S3Endpoint from DNS: %s", instance.S3Endpoint)
 				} else if ips, ok := vm["ips"].([]any); ok && len(ips) > 0 {
 					instance.S3Endpoint = fmt.Sprintf("%v:8333", ips[0])
-					log.Printf("Set S3Endpoint from IP: %s", instance.S3Endpoint)
+					logf(ctx, "Set S3Endpoint from IP: %s", instance.S3Endpoint)
 				}
 			}
 		}
 		if instance.S3Endpoint == "" {
-			log.Printf("Warning: No seaweedfs-s3 job found in deployment VMs")
+			logf(ctx, "Warning: No seaweedfs-s3 job found in deployment VMs")
 		}
 	}
 
@@ -1191,107 +1854,60 @@ func (b *Broker) provisionDedicatedCluster(instance *store.ServiceInstance, plan
 	if hasCFDeployment && hasNATSConfig {
 		s3RouteHost := fmt.Sprintf("seaweedfs-%s.%s", instance.ID[:8], b.config.CF.SystemDomain)
 		instance.S3Endpoint = s3RouteHost
-		log.Printf("Set S3Endpoint to gorouter route: %s", instance.S3Endpoint)
+		logf(ctx, "Set S3Endpoint to gorouter route: %s", instance.S3Endpoint)
 		if cfg != nil && cfg.EnableMasterRoute {
 			masterConsoleHost := fmt.Sprintf("seaweedfs-console-%s.%s", instance.ID[:8], b.config.CF.SystemDomain)
 			instance.ConsoleURL = fmt.Sprintf("https://%s", masterConsoleHost)
-			log.Printf("Set ConsoleURL to master route: %s", instance.ConsoleURL)
+			logf(ctx, "Set ConsoleURL to master route: %s", instance.ConsoleURL)
 		}
 		if cfg != nil && cfg.EnableFilerRoute {
 			filerHost := fmt.Sprintf("seaweedfs-filer-%s.%s", instance.ID[:8], b.config.CF.SystemDomain)
 			instance.FilerURL = fmt.Sprintf("https://%s", filerHost)
-			log.Printf("Set FilerURL to filer route: %s", instance.FilerURL)
+			logf(ctx, "Set FilerURL to filer route: %s", instance.FilerURL)
 		}
 		if cfg != nil && cfg.EnableVolumeRoute {
 			volumeHost := fmt.Sprintf("seaweedfs-volume-%s.%s", instance.ID[:8], b.config.CF.SystemDomain)
 			instance.VolumeURL = fmt.Sprintf("https://%s", volumeHost)
-			log.Printf("Set VolumeURL to volume route: %s", instance.VolumeURL)
+			logf(ctx, "Set VolumeURL to volume route: %s", instance.VolumeURL)
 		}
 		if cfg != nil && cfg.EnableAdminRoute {
 			adminHost := fmt.Sprintf("seaweedfs-admin-%s.%s", instance.ID[:8], b.config.CF.SystemDomain)
 			instance.AdminURL = fmt.Sprintf("https://%s", adminHost)
-			log.Printf("Set AdminURL to admin route: %s", instance.AdminURL)
+			logf(ctx, "Set AdminURL to admin route: %s", instance.AdminURL)
 		}
 	}
-
-	// Create the default bucket on the dedicated cluster using admin credentials
-	if instance.IAMEndpoint != "" {
-		log.Printf("Creating default bucket on dedicated cluster at %s", instance.IAMEndpoint)
-		dedicatedS3, err := minio.New(instance.IAMEndpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(instance.AdminAccessKey, instance.AdminSecretKey, ""),
-			Secure: false,
-			Region: b.config.SharedCluster.Region,
-		})
-		if err != nil {
-			log.Printf("Warning: could not create S3 client for dedicated cluster: %v", err)
-		} else {
-			ctx := context.Background()
-			err = dedicatedS3.MakeBucket(ctx, instance.BucketName, minio.MakeBucketOptions{
-				Region: b.config.SharedCluster.Region,
-			})
-			if err != nil {
-				// Check if bucket already exists
-				exists, existErr := dedicatedS3.BucketExists(ctx, instance.BucketName)
-				if existErr != nil || !exists {
-					log.Printf("Warning: could not create default bucket: %v", err)
-				} else {
-					log.Printf("Default bucket %s already exists", instance.BucketName)
-				}
-			} else {
-				log.Printf("Created default bucket %s on dedicated cluster", instance.BucketName)
-			}
-		}
-	}
-
-	instance.State = "succeeded"
-	instance.StateMessage = "Deployment complete"
-	b.store.SaveInstance(instance)
-
-	log.Printf("Provisioned dedicated cluster %s for instance %s", deploymentName, instance.ID)
 }
 
-func (b *Broker) deprovisionDedicatedCluster(instance *store.ServiceInstance) {
-	if b.boshClient == nil || instance.DeploymentName == "" {
-		b.store.DeleteInstance(instance.ID)
-		return
-	}
-
-	// Check if the deployment actually exists before trying to delete it
-	deployment, err := b.boshClient.GetDeployment(instance.DeploymentName)
-	if err != nil {
-		log.Printf("Warning: could not check deployment %s: %v", instance.DeploymentName, err)
-	}
-
-	if deployment == nil {
-		// Deployment doesn't exist (never created or already deleted) - just clean up state
-		log.Printf("Deployment %s does not exist, cleaning up broker state", instance.DeploymentName)
-		b.store.DeleteInstance(instance.ID)
+func (b *Broker) deprovisionDedicatedCluster(instance *store.ServiceInstance, op *store.Operation) {
+	if b.boshClient == nil {
+		b.finishOperation(op, b.store.DeleteInstance(instance.ID))
 		return
 	}
-
-	task, err := b.boshClient.DeleteDeployment(instance.DeploymentName)
-	if err != nil {
-		instance.State = "failed"
-		instance.StateMessage = fmt.Sprintf("Failed to delete deployment: %v", err)
-		b.store.SaveInstance(instance)
-		return
+	if instance.DeploymentName == "" {
+		// Records saved by older brokers may lack the name while a deploy
+		// is starting; it is derived the same way provisioning does
+		instance.DeploymentName = fmt.Sprintf("%s-%s", b.config.BOSH.DeploymentPrefix, instance.ID[:min(len(instance.ID), 8)])
 	}
 
-	_, err = b.boshClient.WaitForTask(task.ID, 15*time.Minute)
+	// Waits for a provision still deploying, and succeeds if the deployment
+	// was never created or is already gone
+	attempts, err := b.deleteDeploymentWithRetry(instance, op)
 	if err != nil {
-		instance.State = "failed"
-		instance.StateMessage = fmt.Sprintf("Delete deployment failed: %v", err)
-		b.store.SaveInstance(instance)
+		b.failOperation(instance, op, "deprovisioning",
+			fmt.Sprintf("Delete deployment failed after %d attempt(s): %v", attempts, err))
 		return
 	}
 
-	b.store.DeleteInstance(instance.ID)
-	log.Printf("Deprovisioned dedicated cluster %s for instance %s", instance.DeploymentName, instance.ID)
+	b.finishOperation(op, b.store.DeleteInstance(instance.ID))
+	logf(operationContext(op), "Deprovisioned dedicated cluster %s for instance %s", instance.DeploymentName, instance.ID)
 }
 
 func (b *Broker) generateDedicatedManifest(instance *store.ServiceInstance, plan *config.PlanConfig) []byte {
-	cfg := plan.DedicatedConfig
-	if cfg == nil {
+	var cfg *config.DedicatedPlanConfig
+	if plan.DedicatedConfig != nil {
+		cfgCopy := *plan.DedicatedConfig
+		cfg = &cfgCopy
+	} else {
 		cfg = &config.DedicatedPlanConfig{
 			VMType:      "default",
 			DiskType:    "default",
@@ -1849,4 +2465,3 @@ func formatCertForYAML(cert string, indent int) string {
 	}
 	return strings.Join(lines, "\n")
 }
-
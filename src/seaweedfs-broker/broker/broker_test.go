@@ -0,0 +1,400 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/cloudfoundry/seaweedfs-broker/bosh"
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+const (
+	testServiceID = "seaweedfs-service"
+	testPlanID    = "dedicated-plan"
+)
+
+// fakeDirector answers the BOSH director API calls the broker makes. Every
+// task it starts is done immediately, or fails if failTasks is set.
+type fakeDirector struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	failTasks   bool
+	nextTask    int
+	deployments map[string]bool
+	deploys     map[string]int
+}
+
+func newFakeDirector(t *testing.T) *fakeDirector {
+	d := &fakeDirector{
+		deployments: make(map[string]bool),
+		deploys:     make(map[string]int),
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *fakeDirector) startTask(w http.ResponseWriter) {
+	d.nextTask++
+	w.Header().Set("Location", fmt.Sprintf("%s/tasks/%d", d.URL, d.nextTask))
+	w.WriteHeader(http.StatusFound)
+}
+
+func (d *fakeDirector) serve(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case path == "/info":
+		fmt.Fprintf(w, `{"user_authentication": {"type": "uaa", "options": {"url": %q}}}`, d.URL)
+	case path == "/oauth/token":
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+	case path == "/deployments" && r.Method == http.MethodPost:
+		var manifest struct {
+			Name string `yaml:"name"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := yaml.Unmarshal(body, &manifest); err != nil || manifest.Name == "" {
+			http.Error(w, "invalid manifest", http.StatusBadRequest)
+			return
+		}
+		d.deployments[manifest.Name] = true
+		d.deploys[manifest.Name]++
+		d.startTask(w)
+	case strings.HasPrefix(path, "/tasks/"):
+		var id int
+		fmt.Sscanf(path, "/tasks/%d", &id)
+		state := "done"
+		if d.failTasks {
+			state = "error"
+		}
+		fmt.Fprintf(w, `{"id": %d, "state": %q}`, id, state)
+	case strings.HasSuffix(path, "/vms"):
+		fmt.Fprint(w, `[]`)
+	case strings.HasPrefix(path, "/deployments/"):
+		name := strings.TrimPrefix(path, "/deployments/")
+		if r.Method == http.MethodDelete {
+			delete(d.deployments, name)
+			d.startTask(w)
+			return
+		}
+		if !d.deployments[name] {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"name": %q}`, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *fakeDirector) deployCount(name string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deploys[name]
+}
+
+// newTestBroker returns a broker with a file store and a fake BOSH director,
+// serving the OSB API
+func newTestBroker(t *testing.T) (*Broker, *fakeDirector, *httptest.Server) {
+	director := newFakeDirector(t)
+	cfg := &config.Config{
+		Auth: config.AuthConfig{Username: "admin", Password: "secret"},
+		BOSH: config.BOSHConfig{
+			URL:              director.URL,
+			DeploymentPrefix: "seaweedfs",
+			ReleaseName:      "seaweedfs",
+			OrphanMitigation: config.OrphanMitigationConfig{MaxAttempts: 1},
+		},
+		Catalog: config.CatalogConfig{Services: []config.ServiceConfig{{
+			ID:       testServiceID,
+			Name:     "seaweedfs",
+			Bindable: true,
+			Plans: []config.PlanConfig{{
+				ID:       testPlanID,
+				Name:     "dedicated",
+				PlanType: PlanTypeDedicated,
+				DedicatedConfig: &config.DedicatedPlanConfig{
+					MasterNodes: 1,
+					VolumeNodes: 1,
+					FilerNodes:  1,
+					Network:     "default",
+					AZs:         []string{"z1"},
+				},
+			}},
+		}}},
+	}
+
+	fileStore, err := store.NewFileStore(filepath.Join(t.TempDir(), "state.json"), 1)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	boshClient, err := bosh.NewClient(&cfg.BOSH)
+	if err != nil {
+		t.Fatalf("bosh.NewClient: %v", err)
+	}
+	b := &Broker{
+		config:          cfg,
+		store:           fileStore,
+		boshClient:      boshClient,
+		maintenanceInfo: &MaintenanceInfo{Version: "2.0.0"},
+	}
+
+	server := httptest.NewServer(b.Router())
+	t.Cleanup(server.Close)
+	// Background operations must be done before the state directory is removed
+	t.Cleanup(func() { waitForOperations(t, b) })
+	return b, director, server
+}
+
+func osbRequest(t *testing.T, server *httptest.Server, method, path string, body any) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("X-Broker-API-Version", OSBAPIVersion)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Errorf("%s %s: %v", method, path, err)
+		return 0
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+// waitFor polls until done returns true
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForOperations(t *testing.T, b *Broker) {
+	waitFor(t, "background operations", func() bool {
+		ops, err := b.store.ListOperations()
+		if err != nil {
+			return false
+		}
+		for _, op := range ops {
+			if op.State == store.OperationInProgress {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func instanceState(b *Broker, instanceID string) string {
+	instance, err := b.store.GetInstance(instanceID)
+	if err != nil || instance == nil {
+		return ""
+	}
+	return instance.State
+}
+
+// runConcurrently runs every request at the same time and returns their
+// status codes in order
+func runConcurrently(requests ...func() int) []int {
+	codes := make([]int, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request func() int) {
+			defer wg.Done()
+			codes[i] = request()
+		}(i, request)
+	}
+	wg.Wait()
+	return codes
+}
+
+func countCodes(codes []int, code int) int {
+	n := 0
+	for _, c := range codes {
+		if c == code {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConcurrentProvisionBindUpgrade(t *testing.T) {
+	b, director, server := newTestBroker(t)
+
+	instanceIDs := []string{"aaaaaaaa-1111", "bbbbbbbb-2222", "cccccccc-3333"}
+	provision := func(instanceID string) func() int {
+		return func() int {
+			return osbRequest(t, server, http.MethodPut, "/v2/service_instances/"+instanceID+"?accepts_incomplete=true",
+				ProvisionRequest{ServiceID: testServiceID, PlanID: testPlanID, OrganizationGUID: "org", SpaceGUID: "space"})
+		}
+	}
+
+	// Each instance is provisioned twice at once, as by a retrying platform
+	var requests []func() int
+	for _, id := range instanceIDs {
+		requests = append(requests, provision(id), provision(id))
+	}
+	for _, code := range runConcurrently(requests...) {
+		if code != http.StatusAccepted && code != http.StatusUnprocessableEntity {
+			t.Errorf("unexpected provision status %d", code)
+		}
+	}
+	for _, id := range instanceIDs {
+		waitFor(t, "provisioning of "+id, func() bool { return instanceState(b, id) == "succeeded" })
+		if n := director.deployCount("seaweedfs-" + id[:8]); n != 1 {
+			t.Errorf("instance %s: expected 1 deploy, got %d", id, n)
+		}
+	}
+	waitForOperations(t, b)
+
+	// Pretend the clusters were deployed by an older broker release
+	for _, id := range instanceIDs {
+		instance, _ := b.store.GetInstance(id)
+		instance.MaintenanceVersion = "1.0.0"
+		if err := b.store.SaveInstance(instance); err != nil {
+			t.Fatalf("SaveInstance: %v", err)
+		}
+	}
+
+	// Bind while two upgrades of the same instance race each other. The
+	// second either joins the first or loses the race to save the instance.
+	requests = nil
+	var bindingIDs []string
+	for _, id := range instanceIDs {
+		id := id
+		upgrade := func() int {
+			return osbRequest(t, server, http.MethodPatch, "/v2/service_instances/"+id+"?accepts_incomplete=true",
+				UpdateRequest{ServiceID: testServiceID, MaintenanceInfo: &MaintenanceInfo{Version: "2.0.0"}})
+		}
+		requests = append(requests, upgrade, upgrade)
+		for i := 0; i < 3; i++ {
+			bindingID := fmt.Sprintf("%s-binding-%d", id, i)
+			bindingIDs = append(bindingIDs, bindingID)
+			requests = append(requests, func() int {
+				return osbRequest(t, server, http.MethodPut,
+					"/v2/service_instances/"+id+"/service_bindings/"+bindingID+"?accepts_incomplete=true",
+					BindRequest{ServiceID: testServiceID, PlanID: testPlanID, AppGUID: "app"})
+			})
+		}
+	}
+	codes := runConcurrently(requests...)
+	for i, id := range instanceIDs {
+		upgrades := codes[i*5 : i*5+2]
+		if countCodes(upgrades, http.StatusAccepted) == 0 || countCodes(upgrades, http.StatusAccepted)+countCodes(upgrades, http.StatusUnprocessableEntity) != 2 {
+			t.Errorf("instance %s: expected an accepted upgrade and an accepted or rejected retry, got %v", id, upgrades)
+		}
+		for _, code := range codes[i*5+2 : i*5+5] {
+			if code != http.StatusAccepted && code != http.StatusUnprocessableEntity {
+				t.Errorf("instance %s: unexpected bind status %d", id, code)
+			}
+		}
+	}
+
+	for _, id := range instanceIDs {
+		waitFor(t, "upgrade of "+id, func() bool { return instanceState(b, id) == "succeeded" })
+	}
+	waitForOperations(t, b)
+
+	for _, id := range instanceIDs {
+		instance, _ := b.store.GetInstance(id)
+		if instance.MaintenanceVersion != "2.0.0" {
+			t.Errorf("instance %s: expected maintenance version 2.0.0, got %q", id, instance.MaintenanceVersion)
+		}
+		if n := director.deployCount(instance.DeploymentName); n != 2 {
+			t.Errorf("instance %s: expected 2 deploys, got %d", id, n)
+		}
+	}
+	for _, bindingID := range bindingIDs {
+		binding, err := b.store.GetBinding(bindingID)
+		if err != nil {
+			t.Fatalf("GetBinding: %v", err)
+		}
+		if binding != nil && !binding.Ready() {
+			t.Errorf("binding %s left in state %q: %s", bindingID, binding.State, binding.StateMessage)
+		}
+	}
+}
+
+func TestFailedUpgradeKeepsInstanceUsable(t *testing.T) {
+	b, director, server := newTestBroker(t)
+	seedInstance(t, b, "aaaaaaaa-instance", "succeeded")
+	director.mu.Lock()
+	director.failTasks = true
+	director.mu.Unlock()
+
+	path := "/v2/service_instances/aaaaaaaa-instance?accepts_incomplete=true"
+	upgrade := UpdateRequest{ServiceID: testServiceID, MaintenanceInfo: &MaintenanceInfo{Version: "2.0.0"}}
+	if code := osbRequest(t, server, http.MethodPatch, path, upgrade); code != http.StatusAccepted {
+		t.Fatalf("upgrade: expected 202, got %d", code)
+	}
+	waitForOperations(t, b)
+
+	if state := instanceState(b, "aaaaaaaa-instance"); state != "succeeded" {
+		t.Errorf("expected the instance to return to succeeded, got %q", state)
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/v2/service_instances/aaaaaaaa-instance/last_operation", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("X-Broker-API-Version", OSBAPIVersion)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var lastOperation struct {
+		State       string `json:"state"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&lastOperation); err != nil {
+		t.Fatal(err)
+	}
+	if lastOperation.State != "failed" || !strings.HasPrefix(lastOperation.Description, "Update failed") {
+		t.Errorf("expected last_operation to report the failed update, got %+v", lastOperation)
+	}
+
+	// The instance can be upgraded again once the director recovers
+	director.mu.Lock()
+	director.failTasks = false
+	director.mu.Unlock()
+	if code := osbRequest(t, server, http.MethodPatch, path, upgrade); code != http.StatusAccepted {
+		t.Fatalf("second upgrade: expected 202, got %d", code)
+	}
+	waitForOperations(t, b)
+	instance, err := b.store.GetInstance("aaaaaaaa-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.State != "succeeded" || instance.MaintenanceVersion != "2.0.0" {
+		t.Errorf("expected the second upgrade to succeed, got state %q version %q", instance.State, instance.MaintenanceVersion)
+	}
+}
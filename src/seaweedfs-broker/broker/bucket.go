@@ -0,0 +1,659 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/minio/minio-go/v7/pkg/sse"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// expirationRuleID is the ID of the lifecycle rule set by expiration_days
+const expirationRuleID = "seaweedfs-broker-expiration"
+
+// Values of the encryption parameter's algorithm
+const (
+	encryptionSSES3  = "AES256"
+	encryptionSSEKMS = "aws:kms"
+	encryptionNone   = "none"
+)
+
+// corsMethods are the HTTP methods CORS rules may allow
+var corsMethods = []string{"GET", "PUT", "POST", "DELETE", "HEAD"}
+
+// bucketParameters are the parameters accepted for buckets on provision and
+// update. Nil fields were not given and are left unchanged.
+type bucketParameters struct {
+	// Versioning enables or suspends object versioning
+	Versioning *bool
+	// ExpirationDays expires objects this many days after creation; 0 removes the rule
+	ExpirationDays *int
+	// LifecycleRules are the bucket's lifecycle rules besides the
+	// expiration_days rule; an empty list removes them
+	LifecycleRules []lifecycleRuleParameters
+	// ObjectLock creates the bucket with object lock enabled, and sets its
+	// default retention
+	ObjectLock *objectLockParameters
+	// CORSRules replace the bucket's CORS rules; an empty list removes them
+	CORSRules []corsRule
+	// Encryption sets or removes the bucket's default encryption
+	Encryption *encryptionParameters
+	// Tags replace the bucket's tags; an empty map removes them
+	Tags map[string]string
+	// SharedAccess is the access of bindings from spaces the instance is
+	// shared with; it is read from the stored parameters when binding
+	SharedAccess *string
+	// Buckets names the additional buckets of a shared instance
+	Buckets []string
+	// BucketName is the custom name of a shared instance's default bucket
+	BucketName *string
+}
+
+// lifecycleRuleParameters is an element of the lifecycle_rules parameter
+type lifecycleRuleParameters struct {
+	ID                       string `json:"id"`
+	Prefix                   string `json:"prefix"`
+	ExpirationDays           int    `json:"expiration_days"`
+	NoncurrentExpirationDays int    `json:"noncurrent_expiration_days"`
+	TransitionDays           int    `json:"transition_days"`
+	TransitionStorageClass   string `json:"transition_storage_class"`
+}
+
+// objectLockParameters is the object_lock parameter. Mode and Days are
+// either both set or both empty.
+type objectLockParameters struct {
+	Mode string `json:"mode"`
+	Days int    `json:"days"`
+}
+
+// corsRule is an element of the cors_rules parameter, and of the body of a
+// PutBucketCors request
+type corsRule struct {
+	AllowedOrigins []string `json:"allowed_origins" xml:"AllowedOrigin"`
+	AllowedMethods []string `json:"allowed_methods" xml:"AllowedMethod"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty" xml:"AllowedHeader,omitempty"`
+	ExposeHeaders  []string `json:"expose_headers,omitempty" xml:"ExposeHeader,omitempty"`
+	MaxAgeSeconds  int      `json:"max_age_seconds,omitempty" xml:"MaxAgeSeconds,omitempty"`
+}
+
+// encryptionParameters is the encryption parameter
+type encryptionParameters struct {
+	Algorithm string `json:"algorithm"`
+	KMSKeyID  string `json:"kms_key_id"`
+}
+
+// supportedBucketParameters lists the parameter names parseBucketParameters accepts
+var supportedBucketParameters = []string{
+	"versioning", "expiration_days", "lifecycle_rules", "object_lock", "cors_rules", "encryption", "tags", "shared_access", "buckets", "bucket_name",
+}
+
+// bucketParametersSchema is the default JSON Schema for instance
+// parameters; it must describe what parseBucketParameters accepts, except
+// that only shared plans accept buckets and bucket_name
+func bucketParametersSchema(plan *config.PlanConfig) map[string]any {
+	positiveDays := func(description string) map[string]any {
+		return map[string]any{
+			"type":        "integer",
+			"minimum":     1,
+			"maximum":     math.MaxInt32,
+			"description": description,
+		}
+	}
+	stringList := func(description string) map[string]any {
+		return map[string]any{
+			"type":        "array",
+			"items":       map[string]any{"type": "string"},
+			"description": description,
+		}
+	}
+
+	properties := map[string]any{
+		"versioning": map[string]any{
+			"type":        "boolean",
+			"description": "Enable (true) or suspend (false) object versioning on the bucket",
+		},
+		"expiration_days": map[string]any{
+			"type":        "integer",
+			"minimum":     0,
+			"maximum":     math.MaxInt32,
+			"description": "Expire objects this many days after creation; 0 removes the expiration rule",
+		},
+		"lifecycle_rules": map[string]any{
+			"type":        "array",
+			"description": "Lifecycle rules of the bucket, replacing any set before; an empty list removes them",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"id":                         map[string]any{"type": "string", "minLength": 1, "maxLength": 255},
+					"prefix":                     map[string]any{"type": "string", "description": "Only apply the rule to objects with this key prefix"},
+					"expiration_days":            positiveDays("Expire objects this many days after creation"),
+					"noncurrent_expiration_days": positiveDays("Delete noncurrent object versions this many days after they become noncurrent"),
+					"transition_days":            positiveDays("Move objects to transition_storage_class this many days after creation"),
+					"transition_storage_class":   map[string]any{"type": "string", "minLength": 1},
+				},
+				"additionalProperties": false,
+			},
+		},
+		"object_lock": map[string]any{
+			"type":        "object",
+			"description": "Create the bucket with object lock enabled, optionally with a default retention; only accepted when the instance is created",
+			"properties": map[string]any{
+				"mode": map[string]any{"type": "string", "enum": []any{string(minio.Governance), string(minio.Compliance)}},
+				"days": positiveDays("Default retention period of new objects, in days"),
+			},
+			"additionalProperties": false,
+		},
+		"cors_rules": map[string]any{
+			"type":        "array",
+			"description": "CORS rules of the bucket, replacing any set before; an empty list removes them",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"allowed_origins": stringList("Origins allowed to make cross-origin requests"),
+					"allowed_methods": map[string]any{
+						"type":     "array",
+						"minItems": 1,
+						"items":    map[string]any{"type": "string", "enum": stringsToAny(corsMethods)},
+					},
+					"allowed_headers": stringList("Request headers allowed in preflight requests"),
+					"expose_headers":  stringList("Response headers exposed to browsers"),
+					"max_age_seconds": map[string]any{"type": "integer", "minimum": 0, "maximum": math.MaxInt32},
+				},
+				"required":             []any{"allowed_origins", "allowed_methods"},
+				"additionalProperties": false,
+			},
+		},
+		"encryption": map[string]any{
+			"type":        "object",
+			"description": "Default server-side encryption of new objects; algorithm none removes it",
+			"properties": map[string]any{
+				"algorithm":  map[string]any{"type": "string", "enum": []any{encryptionSSES3, encryptionSSEKMS, encryptionNone}},
+				"kms_key_id": map[string]any{"type": "string", "description": "KMS key of the aws:kms algorithm"},
+			},
+			"required":             []any{"algorithm"},
+			"additionalProperties": false,
+		},
+		"tags": map[string]any{
+			"type":                 "object",
+			"description":          "Tags of the bucket, replacing any set before; an empty object removes them",
+			"additionalProperties": map[string]any{"type": "string", "maxLength": 256},
+		},
+		"shared_access": sharedAccessSchema(),
+	}
+	if plan.PlanType == PlanTypeShared {
+		properties["buckets"] = bucketNamesSchema()
+		properties["bucket_name"] = map[string]any{
+			"type":        "string",
+			"minLength":   3,
+			"maxLength":   63,
+			"pattern":     `^[a-z0-9][a-z0-9.-]*[a-z0-9]$`,
+			"description": "Name of the default bucket, unique on the cluster and following S3 bucket naming rules; only accepted on create (default generated from the space and instance IDs)",
+		}
+	}
+
+	return map[string]any{
+		"$schema":              jsonSchemaDraft04,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// parseBucketParameters validates the parameters of a provision or update
+// request
+func parseBucketParameters(params map[string]any) (*bucketParameters, error) {
+	p := &bucketParameters{}
+	problems := make([]string, 0)
+
+	for key, value := range params {
+		switch key {
+		case "versioning":
+			v, ok := value.(bool)
+			if !ok {
+				problems = append(problems, "versioning must be true or false")
+				continue
+			}
+			p.Versioning = &v
+		case "expiration_days":
+			n, ok := nonNegativeInt(value)
+			if !ok {
+				problems = append(problems, "expiration_days must be a non-negative integer")
+				continue
+			}
+			p.ExpirationDays = &n
+		case "lifecycle_rules":
+			rules := make([]lifecycleRuleParameters, 0)
+			if err := decodeParameter(value, &rules); err != nil {
+				problems = append(problems, fmt.Sprintf("lifecycle_rules: %v", err))
+				continue
+			}
+			if problem := checkLifecycleRules(rules); problem != "" {
+				problems = append(problems, problem)
+				continue
+			}
+			p.LifecycleRules = rules
+		case "object_lock":
+			var lock objectLockParameters
+			if err := decodeParameter(value, &lock); err != nil {
+				problems = append(problems, fmt.Sprintf("object_lock: %v", err))
+				continue
+			}
+			if (lock.Mode == "") != (lock.Days == 0) {
+				problems = append(problems, "object_lock mode and days must be given together")
+				continue
+			}
+			if lock.Mode != "" && !minio.RetentionMode(lock.Mode).IsValid() {
+				problems = append(problems, fmt.Sprintf("object_lock mode must be %s or %s", minio.Governance, minio.Compliance))
+				continue
+			}
+			if lock.Days < 0 {
+				problems = append(problems, "object_lock days must be a positive integer")
+				continue
+			}
+			p.ObjectLock = &lock
+		case "cors_rules":
+			rules := make([]corsRule, 0)
+			if err := decodeParameter(value, &rules); err != nil {
+				problems = append(problems, fmt.Sprintf("cors_rules: %v", err))
+				continue
+			}
+			if problem := checkCORSRules(rules); problem != "" {
+				problems = append(problems, problem)
+				continue
+			}
+			p.CORSRules = rules
+		case "encryption":
+			var encryption encryptionParameters
+			if err := decodeParameter(value, &encryption); err != nil {
+				problems = append(problems, fmt.Sprintf("encryption: %v", err))
+				continue
+			}
+			switch {
+			case encryption.Algorithm != encryptionSSES3 && encryption.Algorithm != encryptionSSEKMS && encryption.Algorithm != encryptionNone:
+				problems = append(problems, fmt.Sprintf("encryption algorithm must be %s, %s or %s", encryptionSSES3, encryptionSSEKMS, encryptionNone))
+				continue
+			case (encryption.Algorithm == encryptionSSEKMS) != (encryption.KMSKeyID != ""):
+				problems = append(problems, "encryption kms_key_id is required by, and only accepted with, the aws:kms algorithm")
+				continue
+			}
+			p.Encryption = &encryption
+		case "tags":
+			bucketTags := make(map[string]string)
+			if err := decodeParameter(value, &bucketTags); err != nil {
+				problems = append(problems, fmt.Sprintf("tags: %v", err))
+				continue
+			}
+			if _, err := tags.MapToBucketTags(bucketTags); err != nil {
+				problems = append(problems, fmt.Sprintf("tags: %v", err))
+				continue
+			}
+			p.Tags = bucketTags
+		case "shared_access":
+			access, err := parseSharedAccess(value)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			p.SharedAccess = &access
+		case "buckets":
+			names, err := parseBucketNames(value)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			p.Buckets = names
+		case "bucket_name":
+			name, err := parseBucketName(value)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			p.BucketName = &name
+		default:
+			problems = append(problems, fmt.Sprintf("unknown parameter %q (supported: %s)", key, strings.Join(supportedBucketParameters, ", ")))
+		}
+	}
+
+	if p.ObjectLock != nil && p.Versioning != nil && !*p.Versioning {
+		problems = append(problems, "object_lock requires versioning, which cannot be suspended")
+	}
+	if p.BucketName != nil {
+		for _, name := range p.Buckets {
+			if len(*p.BucketName)+1+len(name) > maxBucketNameLength {
+				problems = append(problems, fmt.Sprintf("bucket %q does not fit after bucket_name within %d characters", name, maxBucketNameLength))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid parameters: %s", strings.Join(problems, "; "))
+	}
+	return p, nil
+}
+
+// checkBucketUpdate validates update parameters against the parameters the
+// instance was created or last updated with
+func checkBucketUpdate(stored map[string]any, update *bucketParameters) error {
+	if _, locked := stored["object_lock"]; update.ObjectLock != nil && !locked {
+		return fmt.Errorf("invalid parameters: object_lock can only be enabled when the instance is created")
+	}
+	if update.BucketName != nil && stored["bucket_name"] != *update.BucketName {
+		return fmt.Errorf("invalid parameters: bucket_name cannot be changed after the instance is created")
+	}
+	return nil
+}
+
+// checkLifecycleRules validates lifecycle_rules and fills in missing rule
+// IDs, returning a problem description or an empty string
+func checkLifecycleRules(rules []lifecycleRuleParameters) string {
+	ids := make(map[string]bool, len(rules))
+	for i := range rules {
+		rule := &rules[i]
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		switch {
+		case ids[rule.ID] || rule.ID == expirationRuleID:
+			return fmt.Sprintf("lifecycle_rules[%d]: id %q is already used", i, rule.ID)
+		case rule.ExpirationDays < 0 || rule.NoncurrentExpirationDays < 0 || rule.TransitionDays < 0:
+			return fmt.Sprintf("lifecycle_rules[%d]: days must be positive integers", i)
+		case rule.ExpirationDays == 0 && rule.NoncurrentExpirationDays == 0 && rule.TransitionDays == 0:
+			return fmt.Sprintf("lifecycle_rules[%d]: needs expiration_days, noncurrent_expiration_days or transition_days", i)
+		case (rule.TransitionDays == 0) != (rule.TransitionStorageClass == ""):
+			return fmt.Sprintf("lifecycle_rules[%d]: transition_days and transition_storage_class must be given together", i)
+		}
+		ids[rule.ID] = true
+	}
+	return ""
+}
+
+// checkCORSRules validates cors_rules, returning a problem description or an
+// empty string
+func checkCORSRules(rules []corsRule) string {
+	for i, rule := range rules {
+		if len(rule.AllowedOrigins) == 0 || len(rule.AllowedMethods) == 0 {
+			return fmt.Sprintf("cors_rules[%d]: allowed_origins and allowed_methods are required", i)
+		}
+		for _, method := range rule.AllowedMethods {
+			if !slices.Contains(corsMethods, method) {
+				return fmt.Sprintf("cors_rules[%d]: allowed_methods must be among %s", i, strings.Join(corsMethods, ", "))
+			}
+		}
+		if rule.MaxAgeSeconds < 0 {
+			return fmt.Sprintf("cors_rules[%d]: max_age_seconds must be a non-negative integer", i)
+		}
+	}
+	return ""
+}
+
+// decodeParameter converts a JSON parameter value into target, rejecting
+// unknown fields
+func decodeParameter(value any, target any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+// nonNegativeInt converts a JSON number to an int
+func nonNegativeInt(value any) (int, bool) {
+	f, ok := value.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// configuresBucket reports whether p changes the configuration of the
+// bucket itself, rather than only how the broker binds to it
+func (p *bucketParameters) configuresBucket() bool {
+	return p.Versioning != nil || p.ExpirationDays != nil || p.LifecycleRules != nil || p.ObjectLock != nil ||
+		p.CORSRules != nil || p.Encryption != nil || p.Tags != nil
+}
+
+// bucketTarget is a bucket together with the S3 client and credentials
+// used to configure it
+type bucketTarget struct {
+	client    *minio.Client
+	name      string
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// sharedBucket returns the target of a bucket on the shared cluster
+func (b *Broker) sharedBucket(bucketName string) *bucketTarget {
+	return &bucketTarget{
+		client:    b.s3Client,
+		name:      bucketName,
+		accessKey: b.config.SharedCluster.AccessKey,
+		secretKey: b.config.SharedCluster.SecretKey,
+		region:    b.config.SharedCluster.Region,
+	}
+}
+
+// dedicatedBucket returns the target of the default bucket of a dedicated
+// cluster, using its admin credentials
+func (b *Broker) dedicatedBucket(instance *store.ServiceInstance) (*bucketTarget, error) {
+	if instance.IAMEndpoint == "" {
+		return nil, fmt.Errorf("dedicated cluster %s has no S3 endpoint", instance.DeploymentName)
+	}
+	client, err := minio.New(instance.IAMEndpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(instance.AdminAccessKey, instance.AdminSecretKey, ""),
+		Secure: false,
+		Region: b.config.SharedCluster.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create S3 client for dedicated cluster: %w", err)
+	}
+	return &bucketTarget{
+		client:    client,
+		name:      instance.BucketName,
+		accessKey: instance.AdminAccessKey,
+		secretKey: instance.AdminSecretKey,
+		region:    b.config.SharedCluster.Region,
+	}, nil
+}
+
+// applyBucketParameters configures a bucket according to p. Lifecycle
+// rules are rebuilt from both expiration_days and lifecycle_rules, so p
+// should hold the instance's complete parameters rather than only those of
+// an update.
+func applyBucketParameters(ctx context.Context, t *bucketTarget, p *bucketParameters) error {
+	client, bucketName := t.client, t.name
+
+	if p.Versioning != nil {
+		var err error
+		if *p.Versioning {
+			err = client.EnableVersioning(ctx, bucketName)
+		} else {
+			err = client.SuspendVersioning(ctx, bucketName)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set versioning on bucket %s: %w", bucketName, err)
+		}
+	}
+
+	if p.ObjectLock != nil {
+		// Nil mode, validity and unit remove the default retention
+		var mode *minio.RetentionMode
+		var validity *uint
+		var unit *minio.ValidityUnit
+		if p.ObjectLock.Mode != "" {
+			m := minio.RetentionMode(p.ObjectLock.Mode)
+			days := uint(p.ObjectLock.Days)
+			u := minio.Days
+			mode, validity, unit = &m, &days, &u
+		}
+		if err := client.SetObjectLockConfig(ctx, bucketName, mode, validity, unit); err != nil {
+			return fmt.Errorf("failed to set object lock retention on bucket %s: %w", bucketName, err)
+		}
+	}
+
+	if p.ExpirationDays != nil || p.LifecycleRules != nil {
+		// An empty configuration removes the bucket's lifecycle rules
+		config := lifecycle.NewConfiguration()
+		if p.ExpirationDays != nil && *p.ExpirationDays > 0 {
+			config.Rules = append(config.Rules, lifecycle.Rule{
+				ID:         expirationRuleID,
+				Status:     "Enabled",
+				RuleFilter: lifecycle.Filter{Prefix: ""},
+				Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(*p.ExpirationDays)},
+			})
+		}
+		for _, rule := range p.LifecycleRules {
+			config.Rules = append(config.Rules, lifecycle.Rule{
+				ID:                          rule.ID,
+				Status:                      "Enabled",
+				RuleFilter:                  lifecycle.Filter{Prefix: rule.Prefix},
+				Expiration:                  lifecycle.Expiration{Days: lifecycle.ExpirationDays(rule.ExpirationDays)},
+				NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{NoncurrentDays: lifecycle.ExpirationDays(rule.NoncurrentExpirationDays)},
+				Transition: lifecycle.Transition{
+					Days:         lifecycle.ExpirationDays(rule.TransitionDays),
+					StorageClass: rule.TransitionStorageClass,
+				},
+			})
+		}
+		if err := client.SetBucketLifecycle(ctx, bucketName, config); err != nil {
+			return fmt.Errorf("failed to set lifecycle on bucket %s: %w", bucketName, err)
+		}
+	}
+
+	if p.CORSRules != nil {
+		if err := setBucketCORS(ctx, t, p.CORSRules); err != nil {
+			return fmt.Errorf("failed to set CORS rules on bucket %s: %w", bucketName, err)
+		}
+	}
+
+	if p.Encryption != nil {
+		var err error
+		switch p.Encryption.Algorithm {
+		case encryptionSSES3:
+			err = client.SetBucketEncryption(ctx, bucketName, sse.NewConfigurationSSES3())
+		case encryptionSSEKMS:
+			err = client.SetBucketEncryption(ctx, bucketName, sse.NewConfigurationSSEKMS(p.Encryption.KMSKeyID))
+		default:
+			err = client.RemoveBucketEncryption(ctx, bucketName)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set encryption on bucket %s: %w", bucketName, err)
+		}
+	}
+
+	if p.Tags != nil {
+		var err error
+		if len(p.Tags) == 0 {
+			err = client.RemoveBucketTagging(ctx, bucketName)
+		} else {
+			var bucketTags *tags.Tags
+			if bucketTags, err = tags.MapToBucketTags(p.Tags); err == nil {
+				err = client.SetBucketTagging(ctx, bucketName, bucketTags)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set tags on bucket %s: %w", bucketName, err)
+		}
+	}
+
+	return nil
+}
+
+// createBucket creates a bucket, with object lock enabled if p asks for it.
+// A bucket that already exists is left as it is.
+func createBucket(ctx context.Context, t *bucketTarget, p *bucketParameters) error {
+	err := t.client.MakeBucket(ctx, t.name, minio.MakeBucketOptions{
+		Region:        t.region,
+		ObjectLocking: p != nil && p.ObjectLock != nil,
+	})
+	if err != nil {
+		exists, errBucketExists := t.client.BucketExists(ctx, t.name)
+		if errBucketExists != nil || !exists {
+			return fmt.Errorf("failed to create bucket: %w", err)
+		}
+	}
+	return nil
+}
+
+// createNewBucket creates a bucket that must not exist yet, returning
+// errBucketNameTaken if it does. Callers check that no instance claims the
+// name, so an empty bucket the broker already owns was left by an attempt
+// whose instance record was never saved, and is reused.
+func createNewBucket(ctx context.Context, t *bucketTarget, p *bucketParameters) error {
+	err := t.client.MakeBucket(ctx, t.name, minio.MakeBucketOptions{
+		Region:        t.region,
+		ObjectLocking: p != nil && p.ObjectLock != nil,
+	})
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "BucketAlreadyOwnedByYou":
+		if empty, emptyErr := bucketEmpty(ctx, t.client, t.name); emptyErr == nil && empty {
+			return nil
+		}
+		return fmt.Errorf("%w: %s exists on the cluster", errBucketNameTaken, t.name)
+	case "BucketAlreadyExists":
+		return fmt.Errorf("%w: %s exists on the cluster", errBucketNameTaken, t.name)
+	default:
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+}
+
+// bucketEmpty reports whether a bucket holds no objects, object versions or
+// delete markers. A bucket that does not exist is empty.
+func bucketEmpty(ctx context.Context, client *minio.Client, bucketName string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
+		Recursive:    true,
+		WithVersions: true,
+		MaxKeys:      1,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			if minio.ToErrorResponse(object.Err).Code == "NoSuchBucket" {
+				return true, nil
+			}
+			return false, object.Err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// mergeParameters returns the stored parameters with updates applied
+func mergeParameters(stored, updates map[string]any) map[string]any {
+	merged := make(map[string]any, len(stored)+len(updates))
+	for k, v := range stored {
+		merged[k] = v
+	}
+	for k, v := range updates {
+		merged[k] = v
+	}
+	return merged
+}
+
+// stringsToAny converts a string slice to the []any form of JSON Schema
+// enums
+func stringsToAny(values []string) []any {
+	result := make([]any, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
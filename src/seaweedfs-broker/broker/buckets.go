@@ -0,0 +1,372 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/minio/minio-go/v7"
+)
+
+// defaultBucketName identifies an instance's first bucket, named BucketName
+// on the cluster, in binding parameters and credentials
+const defaultBucketName = "default"
+
+// errBucketNotEmpty is returned when removing a bucket from the buckets
+// parameter would delete objects
+var errBucketNotEmpty = errors.New("bucket is not empty")
+
+// errBucketNameTaken is returned when a bucket name is used by another
+// instance or by a bucket on the cluster
+var errBucketNameTaken = errors.New("bucket name is taken")
+
+// errBucketRetained is returned when a bucket cannot be deleted because
+// object lock retention still protects some of its objects
+var errBucketRetained = errors.New("bucket objects are under object lock retention")
+
+// maxBuckets bounds the additional buckets of a shared instance
+const maxBuckets = 20
+
+// maxBucketNameLength is the longest bucket name S3 allows
+const maxBucketNameLength = 63
+
+// bucketNamePattern matches the names of additional buckets. They are
+// appended to the instance's bucket name, which leaves room for 40
+// characters after a generated name.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// s3BucketNamePattern matches the characters S3 allows in bucket names
+var s3BucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// generatedBucketNamePattern matches the names generated for instances
+// without bucket_name, which custom names may not take
+var generatedBucketNamePattern = regexp.MustCompile(`^cf-[0-9a-f]{8}-[0-9a-f]{8}$`)
+
+// parseBucketName validates the bucket_name parameter against the S3 bucket
+// naming rules
+func parseBucketName(value any) (string, error) {
+	name, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("bucket_name must be a string")
+	}
+	switch {
+	case !s3BucketNamePattern.MatchString(name):
+		return "", fmt.Errorf("bucket_name %q must be 3-63 lowercase letters, digits, dots and hyphens, starting and ending with a letter or digit", name)
+	case strings.Contains(name, "..") || strings.Contains(name, ".-") || strings.Contains(name, "-."):
+		return "", fmt.Errorf("bucket_name %q must not have adjacent dots, or dots next to hyphens", name)
+	case net.ParseIP(name) != nil:
+		return "", fmt.Errorf("bucket_name %q must not be an IP address", name)
+	case strings.HasPrefix(name, "xn--") || strings.HasPrefix(name, "sthree-"):
+		return "", fmt.Errorf("bucket_name %q must not start with xn-- or sthree-", name)
+	case strings.HasSuffix(name, "-s3alias") || strings.HasSuffix(name, "--ol-s3"):
+		return "", fmt.Errorf("bucket_name %q must not end with -s3alias or --ol-s3", name)
+	case generatedBucketNamePattern.MatchString(name):
+		return "", fmt.Errorf("bucket_name %q is reserved for generated bucket names", name)
+	}
+	return name, nil
+}
+
+// checkBucketNamePolicy validates a custom bucket name against the prefix
+// the operator requires
+func (b *Broker) checkBucketNamePolicy(name string) error {
+	prefix := b.config.SharedCluster.BucketNamePrefix
+	if prefix != "" && !strings.HasPrefix(name, prefix) {
+		return fmt.Errorf("invalid parameters: bucket_name must start with %q", prefix)
+	}
+	return nil
+}
+
+// checkBucketNamesAvailable returns errBucketNameTaken if another instance,
+// including tombstoned ones whose buckets are retained, uses one of names
+func (b *Broker) checkBucketNamesAvailable(instanceID string, names []string) error {
+	instances, err := b.store.ListInstances()
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if instance.ID == instanceID || instance.DeploymentName != "" {
+			continue
+		}
+		for _, bucketName := range instance.AllBuckets() {
+			if slices.Contains(names, bucketName) {
+				return fmt.Errorf("%w: %s is used by another service instance", errBucketNameTaken, bucketName)
+			}
+		}
+	}
+	return nil
+}
+
+// bucketNamesSchema describes the buckets instance parameter
+func bucketNamesSchema() map[string]any {
+	return map[string]any{
+		"type":        "array",
+		"maxItems":    maxBuckets,
+		"description": "Names of additional buckets to create besides the default bucket; removing a name deletes its bucket, which must be empty",
+		"items": map[string]any{
+			"type":    "string",
+			"pattern": bucketNamePattern.String(),
+		},
+	}
+}
+
+// parseBucketNames validates the buckets instance parameter
+func parseBucketNames(value any) ([]string, error) {
+	names := make([]string, 0)
+	if err := decodeParameter(value, &names); err != nil {
+		return nil, fmt.Errorf("buckets must be a list of names")
+	}
+	if len(names) > maxBuckets {
+		return nil, fmt.Errorf("buckets must have at most %d names", maxBuckets)
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch {
+		case !bucketNamePattern.MatchString(name):
+			return nil, fmt.Errorf("bucket name %q must be 1-40 lowercase letters, digits and hyphens, starting with a letter or digit", name)
+		case name == defaultBucketName:
+			return nil, fmt.Errorf("bucket name %q is reserved for the default bucket", name)
+		case seen[name]:
+			return nil, fmt.Errorf("bucket name %q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
+
+// instanceBuckets returns the buckets of an instance by the names used in
+// binding parameters and credentials
+func instanceBuckets(instance *store.ServiceInstance) map[string]string {
+	buckets := map[string]string{defaultBucketName: instance.BucketName}
+	for _, bucket := range instance.Buckets {
+		buckets[bucket.Name] = bucket.BucketName
+	}
+	return buckets
+}
+
+// checkBindingBuckets validates the buckets bind parameter against the
+// buckets of the instance
+func checkBindingBuckets(instance *store.ServiceInstance, names []string) error {
+	buckets := instanceBuckets(instance)
+	for _, name := range names {
+		if _, ok := buckets[name]; !ok {
+			known := make([]string, 0, len(buckets))
+			for bucket := range buckets {
+				known = append(known, bucket)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("invalid parameters: unknown bucket %q (instance buckets: %s)", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// bindingBuckets returns the buckets a binding can access, by the names
+// used in binding parameters and credentials
+func bindingBuckets(instance *store.ServiceInstance, binding *store.ServiceBinding) map[string]string {
+	buckets := instanceBuckets(instance)
+	if len(binding.Buckets) == 0 {
+		return buckets
+	}
+	chosen := make(map[string]string, len(binding.Buckets))
+	for _, name := range binding.Buckets {
+		if bucketName, ok := buckets[name]; ok {
+			chosen[name] = bucketName
+		}
+	}
+	return chosen
+}
+
+// bindingBucketNames returns the names on the cluster of the buckets a
+// binding can access, for its IAM policy
+func bindingBucketNames(instance *store.ServiceInstance, binding *store.ServiceBinding) []string {
+	names := make([]string, 0)
+	for _, bucketName := range bindingBuckets(instance, binding) {
+		names = append(names, bucketName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// primaryBucket returns the bucket named in a binding's bucket credential:
+// the default bucket if the binding can access it, or else the first of its
+// buckets
+func primaryBucket(instance *store.ServiceInstance, binding *store.ServiceBinding) string {
+	buckets := bindingBuckets(instance, binding)
+	if bucketName, ok := buckets[defaultBucketName]; ok {
+		return bucketName
+	}
+	if len(binding.Buckets) > 0 {
+		return buckets[binding.Buckets[0]]
+	}
+	return instance.BucketName
+}
+
+// reconcileBuckets creates and deletes the additional buckets of a shared
+// instance to match names. instance.Buckets is updated as buckets are
+// created and deleted, so it stays accurate if an error stops the work.
+func (b *Broker) reconcileBuckets(ctx context.Context, instance *store.ServiceInstance, names []string, params *bucketParameters) error {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	// Deleting first fails early on buckets that still hold objects
+	kept := make([]store.Bucket, 0, len(names))
+	for i, bucket := range instance.Buckets {
+		if wanted[bucket.Name] {
+			kept = append(kept, bucket)
+			continue
+		}
+		if err := b.s3Client.RemoveBucket(ctx, bucket.BucketName); err != nil {
+			instance.Buckets = append(kept, instance.Buckets[i:]...)
+			if minio.ToErrorResponse(err).Code == "BucketNotEmpty" {
+				return fmt.Errorf("%w: delete the objects of bucket %s before removing it", errBucketNotEmpty, bucket.Name)
+			}
+			return fmt.Errorf("could not delete bucket %s: %w", bucket.Name, err)
+		}
+		logf(ctx, "Deleted bucket %s of instance %s", bucket.BucketName, instance.ID)
+	}
+	instance.Buckets = kept
+
+	existing := instanceBuckets(instance)
+	added := make(map[string]string)
+	for _, name := range names {
+		if _, ok := existing[name]; !ok {
+			added[name] = fmt.Sprintf("%s-%s", instance.BucketName, name)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	bucketNames := make([]string, 0, len(added))
+	for _, bucketName := range added {
+		bucketNames = append(bucketNames, bucketName)
+	}
+	if err := b.checkBucketNamesAvailable(instance.ID, bucketNames); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		bucketName, ok := added[name]
+		if !ok {
+			continue
+		}
+		if err := createNewBucket(ctx, b.sharedBucket(bucketName), params); err != nil {
+			return fmt.Errorf("bucket %s: %w", name, err)
+		}
+		instance.Buckets = append(instance.Buckets, store.Bucket{Name: name, BucketName: bucketName})
+		logf(ctx, "Created bucket %s for instance %s", bucketName, instance.ID)
+	}
+	return nil
+}
+
+// checkBucketRemoval rejects removing buckets that bindings were scoped to
+func checkBucketRemoval(bindings []*store.ServiceBinding, names []string) error {
+	wanted := map[string]bool{defaultBucketName: true}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, binding := range bindings {
+		for _, name := range binding.Buckets {
+			if !wanted[name] {
+				return fmt.Errorf("bucket %s is used by binding %s; unbind it before removing the bucket", name, binding.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// configureSharedBuckets applies bucket parameters to every bucket of a
+// shared instance
+func (b *Broker) configureSharedBuckets(ctx context.Context, instance *store.ServiceInstance, params *bucketParameters) error {
+	for _, bucketName := range instance.AllBuckets() {
+		if err := applyBucketParameters(ctx, b.sharedBucket(bucketName), params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshBindingPolicies rewrites the IAM policies of an instance's
+// bindings, after its buckets or quota state changed
+func (b *Broker) refreshBindingPolicies(ctx context.Context, instance *store.ServiceInstance) error {
+	iamClient := b.instanceIAMClient(instance)
+	if iamClient == nil {
+		return fmt.Errorf("no IAM client available for instance %s", instance.ID)
+	}
+	iamClient = iamClient.WithRequestID(requestIdentity(ctx))
+	bindings, err := b.store.ListBindingsForInstance(instance.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, binding := range bindings {
+		if binding.IAMUserName == "" || binding.KeyDeactivated || !binding.Ready() {
+			continue
+		}
+		if err := b.putBindingPolicy(iamClient, instance, binding); err != nil {
+			return fmt.Errorf("binding %s: %w", binding.ID, err)
+		}
+	}
+	return nil
+}
+
+// deleteSharedBuckets deletes every bucket of a shared instance with its
+// objects
+func (b *Broker) deleteSharedBuckets(ctx context.Context, instance *store.ServiceInstance) error {
+	var errs []error
+	for _, bucketName := range instance.AllBuckets() {
+		if err := b.deleteSharedBucket(bucketName); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logf(ctx, "Deleted bucket %s for instance %s", bucketName, instance.ID)
+	}
+	return errors.Join(errs...)
+}
+
+// deleteSharedBucket deletes a bucket and every version of its objects. A
+// bucket with objects still under object lock retention is left in place
+// and errBucketRetained returned.
+func (b *Broker) deleteSharedBucket(bucketName string) error {
+	ctx := context.Background()
+
+	// Delete all object versions and delete markers in bucket first, as
+	// a versioned bucket keeps them after its current objects are removed
+	objectsCh := b.s3Client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
+		Recursive:    true,
+		WithVersions: true,
+	})
+
+	var errs []error
+	for object := range objectsCh {
+		if object.Err != nil {
+			errs = append(errs, fmt.Errorf("failed to list objects of bucket %s: %w", bucketName, object.Err))
+			break
+		}
+		err := b.s3Client.RemoveObject(ctx, bucketName, object.Key, minio.RemoveObjectOptions{
+			VersionID: object.VersionID,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove object %s (version %s): %w", object.Key, object.VersionID, err))
+		}
+	}
+	if len(errs) > 0 {
+		if objectLock, _, _, _, err := b.s3Client.GetObjectLockConfig(ctx, bucketName); err == nil && objectLock == "Enabled" {
+			return fmt.Errorf("%w: bucket %s: %w", errBucketRetained, bucketName, errors.Join(errs...))
+		}
+		return errors.Join(errs...)
+	}
+
+	// Delete bucket
+	if err := b.s3Client.RemoveBucket(ctx, bucketName); err != nil {
+		return fmt.Errorf("failed to delete bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
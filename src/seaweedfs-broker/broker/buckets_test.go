@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+func TestProvisionSharedBucketResumesLeftoverBucket(t *testing.T) {
+	custom := "custom"
+	tests := []struct {
+		name      string
+		leftover  int64 // size of an object in the leftover bucket, or -1 for none
+		claimedBy string
+		wantErr   error
+	}{
+		{name: "new name", leftover: -1},
+		{name: "empty bucket of an unsaved attempt", leftover: 0},
+		{name: "bucket with data", leftover: 3, wantErr: errBucketNameTaken},
+		{name: "bucket of another instance", leftover: 0, claimedBy: "other", wantErr: errBucketNameTaken},
+	}
+	for _, test := range tests {
+		b := newStoreBroker(t)
+		s3 := newFakeS3(t)
+		b.s3Client = s3.client(t)
+		switch {
+		case test.leftover > 0:
+			s3.put("custom", "data", test.leftover)
+		case test.leftover == 0:
+			s3.put("custom", "", 0)
+		}
+		if test.claimedBy != "" {
+			if err := b.store.SaveInstance(&store.ServiceInstance{ID: test.claimedBy, BucketName: "custom"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		instance := &store.ServiceInstance{ID: "instance-1", SpaceGUID: "space-guid"}
+		err := b.provisionSharedBucket(context.Background(), instance, &bucketParameters{BucketName: &custom})
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if err == nil && instance.BucketName != "custom" {
+			t.Errorf("%s: expected bucket custom, got %q", test.name, instance.BucketName)
+		}
+	}
+}
+
+func TestReconcileBucketsResumesLeftoverBucket(t *testing.T) {
+	b := newStoreBroker(t)
+	s3 := newFakeS3(t)
+	b.s3Client = s3.client(t)
+	s3.put("custom", "data", 3)
+	s3.put("custom-logs", "", 0)
+	s3.put("custom-media", "photo", 5)
+
+	instance := &store.ServiceInstance{ID: "instance-1", BucketName: "custom"}
+	if err := b.reconcileBuckets(context.Background(), instance, []string{"logs"}, &bucketParameters{}); err != nil {
+		t.Fatalf("expected the leftover empty bucket to be reused, got %v", err)
+	}
+	if len(instance.Buckets) != 1 || instance.Buckets[0].BucketName != "custom-logs" {
+		t.Errorf("expected bucket custom-logs, got %v", instance.Buckets)
+	}
+
+	err := b.reconcileBuckets(context.Background(), instance, []string{"logs", "media"}, &bucketParameters{})
+	if !errors.Is(err, errBucketNameTaken) {
+		t.Errorf("expected a bucket holding data to be taken, got %v", err)
+	}
+}
+
+func TestParseBucketName(t *testing.T) {
+	for _, name := range []any{"my-bucket", "logs.example.com", "abc"} {
+		if _, err := parseBucketName(name); err != nil {
+			t.Errorf("bucket_name %v: unexpected error %v", name, err)
+		}
+	}
+	for _, name := range []any{
+		"ab", "My-Bucket", "-bucket", "bucket-", "my..bucket", "my.-bucket", "192.168.1.1",
+		"xn--bucket", "sthree-bucket", "bucket-s3alias", "bucket--ol-s3", "cf-0123abcd-4567cdef", 1,
+	} {
+		if _, err := parseBucketName(name); err == nil {
+			t.Errorf("bucket_name %v: expected an error", name)
+		}
+	}
+}
+
+func TestCheckBucketNamePolicy(t *testing.T) {
+	b := newStoreBroker(t)
+	if err := b.checkBucketNamePolicy("anything"); err != nil {
+		t.Errorf("expected any name without a required prefix, got %v", err)
+	}
+	b.config.SharedCluster.BucketNamePrefix = "team-"
+	if err := b.checkBucketNamePolicy("team-logs"); err != nil {
+		t.Errorf("expected a name with the required prefix, got %v", err)
+	}
+	if err := b.checkBucketNamePolicy("logs"); err == nil {
+		t.Error("expected an error for a name without the required prefix")
+	}
+}
+
+func TestParseBucketNames(t *testing.T) {
+	tooMany := make([]any, maxBuckets+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("b%d", i)
+	}
+	tests := []struct {
+		name    string
+		value   any
+		wantErr bool
+	}{
+		{name: "names", value: []any{"logs", "media-1"}},
+		{name: "empty", value: []any{}},
+		{name: "not a list", value: "logs", wantErr: true},
+		{name: "invalid name", value: []any{"Logs"}, wantErr: true},
+		{name: "too long", value: []any{strings.Repeat("a", 41)}, wantErr: true},
+		{name: "default bucket", value: []any{defaultBucketName}, wantErr: true},
+		{name: "duplicate", value: []any{"logs", "logs"}, wantErr: true},
+		{name: "too many", value: tooMany, wantErr: true},
+	}
+	for _, test := range tests {
+		if _, err := parseBucketNames(test.value); (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestCheckBucketNamesAvailable(t *testing.T) {
+	b := newStoreBroker(t)
+	tombstonedAt := time.Now()
+	for _, instance := range []*store.ServiceInstance{
+		{ID: "instance-1", BucketName: "own"},
+		{ID: "tombstoned", BucketName: "retained", TombstonedAt: &tombstonedAt},
+		{ID: "dedicated", BucketName: "dedicated", DeploymentName: "seaweedfs-dedicated"},
+		{ID: "shared", BucketName: "shared", Buckets: []store.Bucket{{Name: "logs", BucketName: "shared-logs"}}},
+	} {
+		if err := b.store.SaveInstance(instance); err != nil {
+			t.Fatalf("SaveInstance: %v", err)
+		}
+	}
+
+	if err := b.checkBucketNamesAvailable("instance-1", []string{"own", "dedicated", "new"}); err != nil {
+		t.Errorf("expected the instance's own and dedicated bucket names to be available, got %v", err)
+	}
+	for _, name := range []string{"retained", "shared", "shared-logs"} {
+		if err := b.checkBucketNamesAvailable("instance-1", []string{name}); !errors.Is(err, errBucketNameTaken) {
+			t.Errorf("%s: expected the name to be taken, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/signer"
+)
+
+// corsConfiguration is the body of a PutBucketCors request
+type corsConfiguration struct {
+	XMLName xml.Name   `xml:"CORSConfiguration"`
+	Rules   []corsRule `xml:"CORSRule"`
+}
+
+// corsHTTPClient sends the bucket CORS requests
+var corsHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// setBucketCORS replaces the CORS rules of a bucket; no rules removes them.
+// minio-go has no bucket CORS API, so the request is signed here the same
+// way the IAM client signs its requests.
+func setBucketCORS(ctx context.Context, t *bucketTarget, rules []corsRule) error {
+	method := http.MethodDelete
+	var body []byte
+	if len(rules) > 0 {
+		method = http.MethodPut
+		var err error
+		body, err = xml.Marshal(corsConfiguration{Rules: rules})
+		if err != nil {
+			return err
+		}
+	}
+
+	endpoint := *t.client.EndpointURL()
+	endpoint.Path = "/" + t.name
+	endpoint.RawQuery = "cors="
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if len(body) > 0 {
+		// PutBucketCors requires Content-MD5
+		md5Sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+		req.Header.Set("Content-Type", "application/xml")
+	}
+
+	signedReq := signer.SignV4(*req, t.accessKey, t.secretKey, "", t.region)
+	resp, err := corsHTTPClient.Do(signedReq)
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s bucket CORS failed with status %d: %s", method, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
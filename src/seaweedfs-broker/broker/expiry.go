@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// keySweepInterval is how often the access keys of expired and rotated
+// bindings are deactivated
+const keySweepInterval = 5 * time.Minute
+
+// bindingParameters are the parameters accepted on bind. Nil fields were not
+// given.
+type bindingParameters struct {
+	// TTLHours expires the binding's credentials this many hours after they
+	// are created
+	TTLHours *int
+	// Buckets limits the binding to these buckets of a shared instance, by
+	// the names in its buckets parameter and "default"
+	Buckets []string
+	// Permissions are the permissions of the binding's key
+	Permissions *string
+	// Prefix restricts the binding to object keys starting with it
+	Prefix *string
+}
+
+// supportedBindingParameters lists the parameter names parseBindingParameters accepts
+var supportedBindingParameters = []string{"buckets", "permissions", "prefix", "ttl_hours"}
+
+// bindingParametersSchema is the default JSON Schema for bind parameters; it
+// must describe what parseBindingParameters accepts
+func bindingParametersSchema(plan *config.PlanConfig) map[string]any {
+	ttl := map[string]any{
+		"type":        "integer",
+		"minimum":     1,
+		"maximum":     math.MaxInt32,
+		"description": "Expire the binding's credentials this many hours after they are created",
+	}
+	if plan.MaxBindingTTLHours > 0 {
+		ttl["maximum"] = plan.MaxBindingTTLHours
+		ttl["description"] = fmt.Sprintf("Expire the binding's credentials this many hours after they are created (at most %d, the default)",
+			plan.MaxBindingTTLHours)
+	}
+
+	properties := map[string]any{
+		"ttl_hours":   ttl,
+		"permissions": permissionsSchema(),
+		"prefix":      prefixSchema(),
+	}
+	if plan.PlanType == PlanTypeShared {
+		properties["buckets"] = map[string]any{
+			"type":        "array",
+			"minItems":    1,
+			"description": "Limit the binding to these buckets of the instance, by name; \"default\" is the default bucket (default all buckets)",
+			"items":       map[string]any{"type": "string"},
+		}
+	}
+
+	return map[string]any{
+		"$schema":              jsonSchemaDraft04,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// parseBindingParameters validates the parameters of a bind request
+func parseBindingParameters(params map[string]any) (*bindingParameters, error) {
+	p := &bindingParameters{}
+	problems := make([]string, 0)
+
+	for key, value := range params {
+		switch key {
+		case "ttl_hours":
+			n, ok := nonNegativeInt(value)
+			if !ok || n == 0 {
+				problems = append(problems, "ttl_hours must be a positive integer")
+				continue
+			}
+			p.TTLHours = &n
+		case "buckets":
+			names := make([]string, 0)
+			if err := decodeParameter(value, &names); err != nil || len(names) == 0 {
+				problems = append(problems, "buckets must be a non-empty list of bucket names")
+				continue
+			}
+			p.Buckets = names
+		case "permissions":
+			permissions, err := parsePermissions(value)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			p.Permissions = &permissions
+		case "prefix":
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			p.Prefix = &prefix
+		default:
+			problems = append(problems, fmt.Sprintf("unknown parameter %q (supported: %s)", key, strings.Join(supportedBindingParameters, ", ")))
+		}
+	}
+
+	if p.Prefix != nil && p.Permissions != nil && *p.Permissions == permissionAdmin {
+		problems = append(problems, "prefix cannot be combined with admin permissions, which apply to whole buckets")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid parameters: %s", strings.Join(problems, "; "))
+	}
+	return p, nil
+}
+
+// bindingExpiry returns when the credentials of a binding created at now
+// expire, given its parameters and the maximum TTL of its plan, or nil if
+// they do not expire
+func bindingExpiry(p *bindingParameters, maxTTLHours int, now time.Time) (*time.Time, error) {
+	ttl := maxTTLHours
+	if p.TTLHours != nil {
+		if maxTTLHours > 0 && *p.TTLHours > maxTTLHours {
+			return nil, fmt.Errorf("invalid parameters: ttl_hours must be at most %d for this plan", maxTTLHours)
+		}
+		ttl = *p.TTLHours
+	}
+	if ttl <= 0 {
+		return nil, nil
+	}
+	expiresAt := now.Add(time.Duration(ttl) * time.Hour)
+	return &expiresAt, nil
+}
+
+// bindingMetadata returns the OSB metadata object of a binding, or nil if
+// its credentials do not expire. Credentials with a TTL should be renewed,
+// by rotating the binding, once four fifths of their lifetime have passed.
+func bindingMetadata(binding *store.ServiceBinding) map[string]any {
+	expiry := binding.KeyExpiry()
+	if expiry == nil {
+		return nil
+	}
+
+	metadata := map[string]any{
+		"expires_at": expiry.UTC().Format(time.RFC3339),
+	}
+	if binding.ExpiresAt != nil && expiry.Equal(*binding.ExpiresAt) && !binding.CreatedAt.IsZero() {
+		renewBefore := expiry.Add(-expiry.Sub(binding.CreatedAt) / 5)
+		metadata["renew_before"] = renewBefore.UTC().Format(time.RFC3339)
+	}
+	return metadata
+}
+
+// runKeySweeper deactivates the access keys of expired and rotated bindings
+// every keySweepInterval
+func (b *Broker) runKeySweeper() {
+	ticker := time.NewTicker(keySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		b.deactivateExpiredKeys()
+		<-ticker.C
+	}
+}
+
+// deactivateExpiredKeys deactivates the access keys of bindings that expired
+// or whose rotation overlap has ended, and removes their credentials from
+// CredHub. Failed deactivations are retried on the next run.
+func (b *Broker) deactivateExpiredKeys() {
+	ctx := context.Background()
+	bindings, err := b.store.ListBindings()
+	if err != nil {
+		logf(ctx, "Warning: could not list bindings to deactivate expired keys: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, binding := range bindings {
+		expiry := binding.KeyExpiry()
+		if binding.KeyDeactivated || expiry == nil || expiry.After(now) || !binding.Ready() {
+			continue
+		}
+
+		reason := "expired"
+		if binding.ExpiresAt == nil || binding.ExpiresAt.After(now) {
+			reason = fmt.Sprintf("replaced by binding %s", binding.SuccessorBindingID)
+		}
+
+		instance, err := b.store.GetInstance(binding.InstanceID)
+		if err != nil || instance == nil {
+			logf(ctx, "Warning: could not find instance of binding %s to deactivate its key: %v", binding.ID, err)
+			continue
+		}
+		if binding.IAMUserName == "" {
+			// Left active, so it is not recorded as deactivated
+			logf(ctx, "Warning: binding %s (%s) uses the admin credentials of its cluster, which cannot be deactivated", binding.ID, reason)
+			continue
+		}
+		if err := b.deactivateAccessKey(ctx, instance, binding); err != nil {
+			logf(ctx, "Warning: could not deactivate access key of binding %s (%s), will retry: %v", binding.ID, reason, err)
+			continue
+		}
+
+		binding.KeyDeactivated = true
+		if err := b.store.SaveBinding(binding); err != nil {
+			logf(ctx, "Warning: could not record key deactivation of binding %s: %v", binding.ID, err)
+			continue
+		}
+		logf(ctx, "Binding %s: deactivated access key %s (%s)", binding.ID, binding.AccessKey, reason)
+		// Apps reading CredHub must not pick up the dead key
+		b.deleteStoredCredentials(ctx, instance, binding)
+	}
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// newStoreBroker returns a broker with only a file store, for code that
+// needs no BOSH director or SeaweedFS cluster
+func newStoreBroker(t *testing.T) *Broker {
+	t.Helper()
+	fileStore, err := store.NewFileStore(filepath.Join(t.TempDir(), "state.json"), 1)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	return &Broker{config: &config.Config{}, store: fileStore}
+}
+
+func TestBindingExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hours := func(n int) *int { return &n }
+	tests := []struct {
+		name     string
+		ttlHours *int
+		maxTTL   int
+		want     time.Duration
+		wantErr  bool
+	}{
+		{name: "no expiry"},
+		{name: "requested", ttlHours: hours(72), want: 72 * time.Hour},
+		{name: "plan maximum applies by default", maxTTL: 24, want: 24 * time.Hour},
+		{name: "within the maximum", ttlHours: hours(12), maxTTL: 24, want: 12 * time.Hour},
+		{name: "over the maximum", ttlHours: hours(48), maxTTL: 24, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := bindingExpiry(&bindingParameters{TTLHours: test.ttlHours}, test.maxTTL, now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		switch {
+		case test.wantErr:
+		case test.want == 0 && got != nil:
+			t.Errorf("%s: expected no expiry, got %v", test.name, got)
+		case test.want != 0 && (got == nil || !got.Equal(now.Add(test.want))):
+			t.Errorf("%s: expected expiry after %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestExpiringBindingRejectsAdminCredentials(t *testing.T) {
+	b := newStoreBroker(t)
+	instance := &store.ServiceInstance{ID: "i1", DeploymentName: "seaweedfs-i1", AdminAccessKey: "admin", AdminSecretKey: "secret"}
+	expiresAt := time.Now().Add(time.Hour)
+
+	binding := &store.ServiceBinding{ID: "b1", InstanceID: "i1", ExpiresAt: &expiresAt}
+	if err := b.createS3Credentials(context.Background(), instance, binding); err == nil {
+		t.Errorf("expected an expiring binding without an IAM endpoint to fail")
+	}
+	if binding.AccessKey != "" {
+		t.Errorf("expiring binding was given the admin key")
+	}
+
+	binding = &store.ServiceBinding{ID: "b2", InstanceID: "i1"}
+	if err := b.createS3Credentials(context.Background(), instance, binding); err != nil {
+		t.Fatalf("createS3Credentials: %v", err)
+	}
+	if binding.AccessKey != "admin" || binding.Permissions != permissionAdmin {
+		t.Errorf("expected the admin credentials, got %q with %q permissions", binding.AccessKey, binding.Permissions)
+	}
+}
+
+func TestSweeperKeepsAdminBindingsActive(t *testing.T) {
+	b := newStoreBroker(t)
+	if err := b.store.SaveInstance(&store.ServiceInstance{ID: "i1", DeploymentName: "seaweedfs-i1"}); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	// Recorded by an earlier broker version, which allowed this
+	expired := time.Now().Add(-time.Hour)
+	if err := b.store.SaveBinding(&store.ServiceBinding{ID: "b1", InstanceID: "i1", AccessKey: "admin", ExpiresAt: &expired}); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+
+	b.deactivateExpiredKeys()
+	binding, _ := b.store.GetBinding("b1")
+	if binding.KeyDeactivated {
+		t.Errorf("admin key recorded as deactivated")
+	}
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// provisionConflicts lists the attributes of a provision request that differ
+// from the existing instance with the same ID
+func provisionConflicts(existing *store.ServiceInstance, req *ProvisionRequest) []string {
+	conflicts := make([]string, 0)
+	if req.ServiceID != existing.ServiceID {
+		conflicts = append(conflicts, "service_id")
+	}
+	if req.PlanID != existing.PlanID {
+		conflicts = append(conflicts, "plan_id")
+	}
+	if req.OrganizationGUID != existing.OrganizationGUID {
+		conflicts = append(conflicts, "organization_guid")
+	}
+	if req.SpaceGUID != existing.SpaceGUID {
+		conflicts = append(conflicts, "space_guid")
+	}
+	if !sameParameters(req.Parameters, existing.Parameters) {
+		conflicts = append(conflicts, "parameters")
+	}
+	return conflicts
+}
+
+// bindingConflicts lists the attributes of a bind request that differ from
+// the existing binding with the same ID
+func bindingConflicts(instance *store.ServiceInstance, existing *store.ServiceBinding, req *BindRequest) []string {
+	conflicts := make([]string, 0)
+	if existing.InstanceID != instance.ID {
+		conflicts = append(conflicts, "instance_id")
+	}
+	if req.ServiceID != instance.ServiceID {
+		conflicts = append(conflicts, "service_id")
+	}
+	if req.PlanID != instance.PlanID {
+		conflicts = append(conflicts, "plan_id")
+	}
+	if bindAppGUID(req) != existing.AppGUID {
+		conflicts = append(conflicts, "app_guid")
+	}
+	if req.PredecessorBindingID != existing.PredecessorBindingID {
+		conflicts = append(conflicts, "predecessor_binding_id")
+	}
+	// A rotation without parameters inherited those of its predecessor
+	inherited := req.PredecessorBindingID != "" && len(req.Parameters) == 0
+	if !inherited && !sameParameters(req.Parameters, existing.Parameters) {
+		conflicts = append(conflicts, "parameters")
+	}
+	return conflicts
+}
+
+// bindAppGUID returns the app of a bind request, preferring bind_resource
+// over the deprecated top-level app_guid
+func bindAppGUID(req *BindRequest) string {
+	if guid, ok := req.BindResource["app_guid"].(string); ok && guid != "" {
+		return guid
+	}
+	return req.AppGUID
+}
+
+// sameParameters compares request parameters as decoded from JSON. A missing
+// parameters object equals an empty one.
+func sameParameters(a, b map[string]any) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// writeConflict responds with 409 for a request that reuses an ID with
+// different attributes
+func (b *Broker) writeConflict(w http.ResponseWriter, kind string, conflicts []string) {
+	b.writeError(w, http.StatusConflict, "Conflict",
+		fmt.Sprintf("A %s with this ID already exists with a different %s", kind, strings.Join(conflicts, ", ")))
+}
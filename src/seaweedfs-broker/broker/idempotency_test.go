@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// seedInstance stores a dedicated instance of the test plan in state
+func seedInstance(t *testing.T, b *Broker, id, state string) *store.ServiceInstance {
+	t.Helper()
+	instance := &store.ServiceInstance{
+		ID:                 id,
+		ServiceID:          testServiceID,
+		PlanID:             testPlanID,
+		OrganizationGUID:   "org",
+		SpaceGUID:          "space",
+		DeploymentName:     "seaweedfs-" + id[:8],
+		AdminAccessKey:     "admin",
+		AdminSecretKey:     "secret",
+		MaintenanceVersion: "1.0.0",
+		State:              state,
+	}
+	if err := b.store.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	return instance
+}
+
+func operationCount(t *testing.T, b *Broker, instanceID string) int {
+	t.Helper()
+	ops, err := b.store.ListOperationsForInstance(instanceID)
+	if err != nil {
+		t.Fatalf("ListOperationsForInstance: %v", err)
+	}
+	return len(ops)
+}
+
+func TestProvisionRetries(t *testing.T) {
+	b, _, server := newTestBroker(t)
+	seedInstance(t, b, "aaaaaaaa-done", "succeeded")
+	seedInstance(t, b, "bbbbbbbb-running", "provisioning")
+	seedInstance(t, b, "cccccccc-failed", "failed")
+
+	request := ProvisionRequest{ServiceID: testServiceID, PlanID: testPlanID, OrganizationGUID: "org", SpaceGUID: "space"}
+	otherSpace := request
+	otherSpace.SpaceGUID = "other"
+	withParameters := request
+	withParameters.Parameters = map[string]any{"versioning": true}
+
+	tests := []struct {
+		name       string
+		instanceID string
+		query      string
+		request    ProvisionRequest
+		want       int
+	}{
+		{"completed", "aaaaaaaa-done", "", request, http.StatusOK},
+		{"in progress", "bbbbbbbb-running", "?accepts_incomplete=true", request, http.StatusAccepted},
+		{"in progress without async", "bbbbbbbb-running", "", request, http.StatusUnprocessableEntity},
+		{"failed", "cccccccc-failed", "?accepts_incomplete=true", request, http.StatusConflict},
+		{"different space", "aaaaaaaa-done", "", otherSpace, http.StatusConflict},
+		{"different parameters", "aaaaaaaa-done", "", withParameters, http.StatusConflict},
+	}
+	for _, test := range tests {
+		code := osbRequest(t, server, http.MethodPut, "/v2/service_instances/"+test.instanceID+test.query, test.request)
+		if code != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, code)
+		}
+		if n := operationCount(t, b, test.instanceID); n != 0 {
+			t.Errorf("%s: retry recorded %d operations", test.name, n)
+		}
+	}
+}
+
+func TestBindRetries(t *testing.T) {
+	b, _, server := newTestBroker(t)
+	seedInstance(t, b, "aaaaaaaa-instance", "succeeded")
+	for id, state := range map[string]string{"ready": "succeeded", "pending": "binding"} {
+		binding := &store.ServiceBinding{ID: id, InstanceID: "aaaaaaaa-instance", AppGUID: "app", AccessKey: "key", SecretKey: "secret", State: state}
+		if err := b.store.SaveBinding(binding); err != nil {
+			t.Fatalf("SaveBinding: %v", err)
+		}
+	}
+
+	request := BindRequest{ServiceID: testServiceID, PlanID: testPlanID, AppGUID: "app"}
+	otherApp := request
+	otherApp.AppGUID = "other"
+
+	tests := []struct {
+		name      string
+		bindingID string
+		request   BindRequest
+		want      int
+	}{
+		{"completed", "ready", request, http.StatusOK},
+		{"in progress", "pending", request, http.StatusAccepted},
+		{"different app", "ready", otherApp, http.StatusConflict},
+	}
+	for _, test := range tests {
+		code := osbRequest(t, server, http.MethodPut,
+			"/v2/service_instances/aaaaaaaa-instance/service_bindings/"+test.bindingID+"?accepts_incomplete=true", test.request)
+		if code != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, code)
+		}
+	}
+}
+
+func TestDeprovisionRetryJoinsRunningDeprovision(t *testing.T) {
+	b, director, server := newTestBroker(t)
+	seedInstance(t, b, "aaaaaaaa-instance", "deprovisioning")
+
+	code := osbRequest(t, server, http.MethodDelete,
+		"/v2/service_instances/aaaaaaaa-instance?accepts_incomplete=true&service_id="+testServiceID+"&plan_id="+testPlanID, nil)
+	if code != http.StatusAccepted {
+		t.Errorf("expected 202, got %d", code)
+	}
+	if n := operationCount(t, b, "aaaaaaaa-instance"); n != 0 {
+		t.Errorf("retry started %d operations", n)
+	}
+	if instanceState(b, "aaaaaaaa-instance") != "deprovisioning" {
+		t.Errorf("retry changed the instance state to %q", instanceState(b, "aaaaaaaa-instance"))
+	}
+	director.mu.Lock()
+	defer director.mu.Unlock()
+	if director.nextTask != 0 {
+		t.Errorf("retry started %d BOSH tasks", director.nextTask)
+	}
+}
+
+func TestUpdateRetryJoinsRunningUpdate(t *testing.T) {
+	b, director, server := newTestBroker(t)
+	instance := seedInstance(t, b, "aaaaaaaa-instance", "updating")
+	instance.UpdatePlanID = testPlanID
+	if err := b.store.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+
+	path := "/v2/service_instances/aaaaaaaa-instance?accepts_incomplete=true"
+	upgrade := UpdateRequest{ServiceID: testServiceID, MaintenanceInfo: &MaintenanceInfo{Version: "2.0.0"}}
+	tests := []struct {
+		name    string
+		request UpdateRequest
+		want    int
+	}{
+		{"same upgrade", upgrade, http.StatusAccepted},
+		{"no upgrade", UpdateRequest{ServiceID: testServiceID}, http.StatusUnprocessableEntity},
+		{"upgrade with new parameters", UpdateRequest{ServiceID: testServiceID, MaintenanceInfo: upgrade.MaintenanceInfo,
+			Parameters: map[string]any{"versioning": true}}, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		if code := osbRequest(t, server, http.MethodPatch, path, test.request); code != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, code)
+		}
+	}
+	if n := operationCount(t, b, "aaaaaaaa-instance"); n != 0 {
+		t.Errorf("retries started %d operations", n)
+	}
+	if n := director.deployCount("seaweedfs-aaaaaaaa"); n != 0 {
+		t.Errorf("retries deployed %d times", n)
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+type identityKey int
+
+const (
+	requestIdentityKey identityKey = iota
+	originatingIdentityKey
+)
+
+// identityMiddleware attaches the X-Broker-API-Request-Identity and
+// X-Broker-API-Originating-Identity headers of a request to its context and
+// logs the request. Requests without a request identity get a generated one,
+// so their log lines and records can still be correlated. The request
+// identity is echoed in the response.
+func (b *Broker) identityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := strings.TrimSpace(r.Header.Get("X-Broker-API-Request-Identity"))
+		if requestID == "" {
+			requestID = generateOperationID()
+		}
+
+		ctx := withIdentity(r.Context(), requestID, originatingIdentity(r))
+		r = r.WithContext(ctx)
+		w.Header().Set("X-Broker-API-Request-Identity", requestID)
+
+		logf(ctx, "%s %s", r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originatingIdentity parses the X-Broker-API-Originating-Identity header,
+// which has the form "<platform> <base64-encoded JSON>". It returns nil if
+// the header is missing or malformed.
+func originatingIdentity(r *http.Request) *store.Identity {
+	header := strings.TrimSpace(r.Header.Get("X-Broker-API-Originating-Identity"))
+	if header == "" {
+		return nil
+	}
+
+	platform, encoded, _ := strings.Cut(header, " ")
+	identity := &store.Identity{Platform: platform}
+	if encoded == "" {
+		return identity
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		log.Printf("Warning: ignoring malformed originating identity for platform %s: %v", platform, err)
+		return identity
+	}
+	if err := json.Unmarshal(data, &identity.Value); err != nil {
+		log.Printf("Warning: ignoring malformed originating identity for platform %s: %v", platform, err)
+	}
+	return identity
+}
+
+// withIdentity returns a context carrying a request identity and the
+// identity of the user who made the request
+func withIdentity(ctx context.Context, requestID string, identity *store.Identity) context.Context {
+	ctx = context.WithValue(ctx, requestIdentityKey, requestID)
+	return context.WithValue(ctx, originatingIdentityKey, identity)
+}
+
+// operationContext returns a context carrying the identities recorded on an
+// operation, for work that outlives the request that started it
+func operationContext(op *store.Operation) context.Context {
+	return withIdentity(context.Background(), op.RequestIdentity, op.OriginatingIdentity)
+}
+
+// requestIdentity returns the request identity of a context, or an empty
+// string if it has none
+func requestIdentity(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIdentityKey).(string)
+	return requestID
+}
+
+// callerIdentity returns the originating identity of a context, or nil if
+// the platform did not send one
+func callerIdentity(ctx context.Context) *store.Identity {
+	identity, _ := ctx.Value(originatingIdentityKey).(*store.Identity)
+	return identity
+}
+
+// logf logs a message prefixed with the request and user identity of ctx
+func logf(ctx context.Context, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	requestID := requestIdentity(ctx)
+	if requestID == "" {
+		log.Print(message)
+		return
+	}
+
+	prefix := "request=" + requestID
+	if identity := callerIdentity(ctx); identity != nil {
+		if userID := identity.UserID(); userID != "" {
+			prefix += " user=" + userID
+		} else {
+			prefix += " platform=" + identity.Platform
+		}
+	}
+	log.Printf("[%s] %s", prefix, message)
+}
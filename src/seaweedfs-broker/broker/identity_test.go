@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects log output written from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return logs
+}
+
+func identityRequest(t *testing.T, method, url, password string) *http.Request {
+	t.Helper()
+	body := `{"service_id": "` + testServiceID + `", "plan_id": "` + testPlanID + `", "organization_guid": "org", "space_guid": "space"}`
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", password)
+	req.Header.Set("X-Broker-API-Version", OSBAPIVersion)
+	req.Header.Set("X-Broker-API-Request-Identity", "request-1")
+	req.Header.Set("X-Broker-API-Originating-Identity",
+		"cloudfoundry "+base64.StdEncoding.EncodeToString([]byte(`{"user_id": "user-1"}`)))
+	return req
+}
+
+func TestUnauthenticatedRequestsAreNotAttributed(t *testing.T) {
+	_, _, server := newTestBroker(t)
+	logs := captureLog(t)
+
+	req := identityRequest(t, http.MethodPut, server.URL+"/v2/service_instances/aaaaaaaa-instance?accepts_incomplete=true", "wrong")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Broker-API-Request-Identity"); got != "" {
+		t.Errorf("an unauthenticated request identity was echoed: %q", got)
+	}
+	if strings.Contains(logs.String(), "user-1") {
+		t.Errorf("an unauthenticated caller identity was logged:\n%s", logs)
+	}
+}
+
+func TestIdentityPropagatesToBackgroundOperations(t *testing.T) {
+	b, _, server := newTestBroker(t)
+	logs := captureLog(t)
+
+	req := identityRequest(t, http.MethodPut, server.URL+"/v2/service_instances/aaaaaaaa-instance?accepts_incomplete=true", "secret")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Broker-API-Request-Identity"); got != "request-1" {
+		t.Errorf("expected the request identity to be echoed, got %q", got)
+	}
+	waitForOperations(t, b)
+
+	ops, err := b.store.ListOperationsForInstance("aaaaaaaa-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].RequestIdentity != "request-1" || ops[0].OriginatingIdentity.UserID() != "user-1" {
+		t.Fatalf("expected one operation attributed to request-1 and user-1, got %+v", ops)
+	}
+	if !strings.Contains(logs.String(), "[request=request-1 user=user-1] Provisioned dedicated cluster") {
+		t.Errorf("background provisioning was not logged with the caller's identity:\n%s", logs)
+	}
+}
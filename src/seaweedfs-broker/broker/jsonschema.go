@@ -0,0 +1,293 @@
+package broker
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchemaDraft04 is the $schema of every schema published in the catalog
+const jsonSchemaDraft04 = "http://json-schema.org/draft-04/schema#"
+
+// validateSchema checks a JSON value against a JSON Schema (draft-04) and
+// returns one message per violation, each naming the failing field. It
+// supports the keywords used to describe broker parameters: type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+// minLength, maxLength, pattern, allOf, anyOf, oneOf and not. Other keywords
+// are ignored.
+func validateSchema(schema map[string]any, value any, path string) []string {
+	problems := make([]string, 0)
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	if t, ok := schema["type"]; ok {
+		types := schemaTypes(t)
+		if !matchesAnyType(value, types) {
+			fail("must be of type %s", strings.Join(types, " or "))
+			// Further keywords would only repeat the type mismatch
+			return problems
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", formatEnum(enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		problems = append(problems, validateObject(schema, v, path)...)
+	case []any:
+		problems = append(problems, validateArray(schema, v, path)...)
+	case string:
+		if n, ok := schemaNumber(schema["minLength"]); ok && float64(utf8.RuneCountInString(v)) < n {
+			fail("must be at least %v characters long", n)
+		}
+		if n, ok := schemaNumber(schema["maxLength"]); ok && float64(utf8.RuneCountInString(v)) > n {
+			fail("must be at most %v characters long", n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("schema pattern %q is invalid: %v", pattern, err)
+			} else if !re.MatchString(v) {
+				fail("must match pattern %s", pattern)
+			}
+		}
+	default:
+		if n, ok := schemaNumber(value); ok {
+			problems = append(problems, validateNumber(schema, n, path)...)
+		}
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			if subSchema, ok := sub.(map[string]any); ok {
+				problems = append(problems, validateSchema(subSchema, value, path)...)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok && countMatches(anyOf, value) == 0 {
+		fail("must match at least one of the allowed schemas")
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok && countMatches(oneOf, value) != 1 {
+		fail("must match exactly one of the allowed schemas")
+	}
+	if not, ok := schema["not"].(map[string]any); ok && len(validateSchema(not, value, path)) == 0 {
+		fail("must not match the excluded schema")
+	}
+
+	return problems
+}
+
+func validateObject(schema map[string]any, obj map[string]any, path string) []string {
+	problems := make([]string, 0)
+
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				problems = append(problems, fmt.Sprintf("%s: is required", joinPath(path, name)))
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fieldPath := joinPath(path, key)
+		if propSchema, ok := properties[key].(map[string]any); ok {
+			problems = append(problems, validateSchema(propSchema, obj[key], fieldPath)...)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				problems = append(problems, fmt.Sprintf("%s: is not a supported parameter%s", fieldPath, supportedList(properties)))
+			}
+		case map[string]any:
+			problems = append(problems, validateSchema(additional, obj[key], fieldPath)...)
+		}
+	}
+
+	return problems
+}
+
+func validateArray(schema map[string]any, items []any, path string) []string {
+	problems := make([]string, 0)
+
+	if n, ok := schemaNumber(schema["minItems"]); ok && float64(len(items)) < n {
+		problems = append(problems, fmt.Sprintf("%s: must have at least %v items", path, n))
+	}
+	if n, ok := schemaNumber(schema["maxItems"]); ok && float64(len(items)) > n {
+		problems = append(problems, fmt.Sprintf("%s: must have at most %v items", path, n))
+	}
+	if itemSchema, ok := schema["items"].(map[string]any); ok {
+		for i, item := range items {
+			problems = append(problems, validateSchema(itemSchema, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return problems
+}
+
+func validateNumber(schema map[string]any, n float64, path string) []string {
+	problems := make([]string, 0)
+
+	if min, ok := schemaNumber(schema["minimum"]); ok {
+		if exclusive, _ := schema["exclusiveMinimum"].(bool); exclusive && n <= min {
+			problems = append(problems, fmt.Sprintf("%s: must be greater than %v", path, min))
+		} else if n < min {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %v", path, min))
+		}
+	}
+	if max, ok := schemaNumber(schema["maximum"]); ok {
+		if exclusive, _ := schema["exclusiveMaximum"].(bool); exclusive && n >= max {
+			problems = append(problems, fmt.Sprintf("%s: must be less than %v", path, max))
+		} else if n > max {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %v", path, max))
+		}
+	}
+	if multiple, ok := schemaNumber(schema["multipleOf"]); ok && multiple > 0 {
+		if q := n / multiple; q != math.Trunc(q) {
+			problems = append(problems, fmt.Sprintf("%s: must be a multiple of %v", path, multiple))
+		}
+	}
+
+	return problems
+}
+
+// schemaTypes returns the type keyword as a list
+func schemaTypes(t any) []string {
+	switch v := t.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		types := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func matchesAnyType(value any, types []string) bool {
+	for _, t := range types {
+		if matchesType(value, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(value any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := schemaNumber(value)
+		return ok
+	case "integer":
+		n, ok := schemaNumber(value)
+		return ok && n == math.Trunc(n)
+	}
+	return false
+}
+
+// schemaNumber converts numbers decoded from JSON requests or YAML config
+// to float64
+func schemaNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// jsonEqual compares values decoded from JSON or YAML, treating numbers of
+// different Go types as equal when their values are
+func jsonEqual(a, b any) bool {
+	an, aIsNum := schemaNumber(a)
+	bn, bIsNum := schemaNumber(b)
+	if aIsNum || bIsNum {
+		return aIsNum && bIsNum && an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func countMatches(schemas []any, value any) int {
+	matches := 0
+	for _, sub := range schemas {
+		if subSchema, ok := sub.(map[string]any); ok && len(validateSchema(subSchema, value, "")) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func formatEnum(enum []any) string {
+	values := make([]string, 0, len(enum))
+	for _, v := range enum {
+		values = append(values, fmt.Sprintf("%v", v))
+	}
+	return strings.Join(values, ", ")
+}
+
+func supportedList(properties map[string]any) string {
+	if len(properties) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return " (supported: " + strings.Join(names, ", ") + ")"
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// decodeJSON decodes a test value the way request bodies are decoded
+func decodeJSON(t *testing.T, data string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func TestValidateSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		want   []string
+	}{
+		{"type matches", `{"type": "string"}`, `"a"`, nil},
+		{"type mismatch", `{"type": "string"}`, `1`, []string{"p: must be of type string"}},
+		{"type list", `{"type": ["string", "null"]}`, `null`, nil},
+		{"integer", `{"type": "integer"}`, `1.5`, []string{"p: must be of type integer"}},
+		{"integer as float", `{"type": "integer"}`, `2.0`, nil},
+		{"number", `{"type": "number"}`, `"1"`, []string{"p: must be of type number"}},
+		{"boolean", `{"type": "boolean"}`, `"true"`, []string{"p: must be of type boolean"}},
+		{"array", `{"type": "array"}`, `{}`, []string{"p: must be of type array"}},
+		{"object", `{"type": "object"}`, `[]`, []string{"p: must be of type object"}},
+		{"type mismatch stops", `{"type": "string", "enum": ["a"]}`, `1`, []string{"p: must be of type string"}},
+
+		{"enum", `{"enum": ["a", 1]}`, `1`, nil},
+		{"enum mismatch", `{"enum": ["a", 1]}`, `"b"`, []string{"p: must be one of a, 1"}},
+		{"enum object", `{"enum": [{"a": [1]}]}`, `{"a": [1]}`, nil},
+
+		{"minLength", `{"minLength": 2}`, `"é"`, []string{"p: must be at least 2 characters long"}},
+		{"maxLength", `{"maxLength": 2}`, `"éé"`, nil},
+		{"maxLength exceeded", `{"maxLength": 2}`, `"abc"`, []string{"p: must be at most 2 characters long"}},
+		{"pattern", `{"pattern": "^[a-z]+$"}`, `"abc"`, nil},
+		{"pattern mismatch", `{"pattern": "^[a-z]+$"}`, `"aBc"`, []string{"p: must match pattern ^[a-z]+$"}},
+		{"invalid pattern", `{"pattern": "("}`, `"a"`, []string{"p: schema pattern \"(\" is invalid: error parsing regexp: missing closing ): `(`"}},
+
+		{"minimum", `{"minimum": 1}`, `1`, nil},
+		{"below minimum", `{"minimum": 1}`, `0`, []string{"p: must be at least 1"}},
+		{"exclusiveMinimum", `{"minimum": 1, "exclusiveMinimum": true}`, `1`, []string{"p: must be greater than 1"}},
+		{"maximum", `{"maximum": 10}`, `11`, []string{"p: must be at most 10"}},
+		{"exclusiveMaximum", `{"maximum": 10, "exclusiveMaximum": true}`, `10`, []string{"p: must be less than 10"}},
+		{"multipleOf", `{"multipleOf": 0.5}`, `1.5`, nil},
+		{"not a multiple", `{"multipleOf": 3}`, `10`, []string{"p: must be a multiple of 3"}},
+
+		{"minItems", `{"minItems": 1}`, `[]`, []string{"p: must have at least 1 items"}},
+		{"maxItems", `{"maxItems": 1}`, `[1, 2]`, []string{"p: must have at most 1 items"}},
+		{"items", `{"items": {"type": "string"}}`, `["a", 1, "b", true]`,
+			[]string{"p[1]: must be of type string", "p[3]: must be of type string"}},
+
+		{"required", `{"required": ["a", "b"]}`, `{"a": 1}`, []string{"p.b: is required"}},
+		{"properties", `{"properties": {"a": {"type": "string"}}}`, `{"a": 1, "b": 2}`, []string{"p.a: must be of type string"}},
+		{"no additionalProperties", `{"properties": {"b": {}, "a": {}}, "additionalProperties": false}`, `{"c": 1}`,
+			[]string{"p.c: is not a supported parameter (supported: a, b)"}},
+		{"additionalProperties schema", `{"additionalProperties": {"type": "string"}}`, `{"a": "x", "b": 1}`,
+			[]string{"p.b: must be of type string"}},
+
+		{"allOf", `{"allOf": [{"minimum": 1}, {"maximum": 2}]}`, `3`, []string{"p: must be at most 2"}},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `1`, nil},
+		{"anyOf mismatch", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`,
+			[]string{"p: must match at least one of the allowed schemas"}},
+		{"oneOf", `{"oneOf": [{"type": "integer"}, {"minimum": 5}]}`, `1`, nil},
+		{"oneOf matches both", `{"oneOf": [{"type": "integer"}, {"minimum": 5}]}`, `6`,
+			[]string{"p: must match exactly one of the allowed schemas"}},
+		{"not", `{"not": {"enum": ["admin"]}}`, `"read"`, nil},
+		{"not matches", `{"not": {"enum": ["admin"]}}`, `"admin"`, []string{"p: must not match the excluded schema"}},
+		{"unknown keywords", `{"format": "email", "title": "x"}`, `"a"`, nil},
+	}
+	for _, test := range tests {
+		schema := decodeJSON(t, test.schema).(map[string]any)
+		got := validateSchema(schema, decodeJSON(t, test.value), "p")
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateSchemaNumbersFromConfig(t *testing.T) {
+	// Schemas from the broker config are decoded from YAML, with int numbers
+	schema := map[string]any{"type": "integer", "minimum": 1, "maximum": int64(5), "enum": []any{2, 3, 7}}
+	if got := validateSchema(schema, 3.0, "p"); len(got) != 0 {
+		t.Errorf("unexpected problems %q", got)
+	}
+	want := []string{"p: must be one of 2, 3, 7", "p: must be at most 5"}
+	if got := validateSchema(schema, 8.0, "p"); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestValidateParametersPaths(t *testing.T) {
+	schema := decodeJSON(t, `{
+		"type": "object",
+		"properties": {
+			"buckets": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}},
+			"cors": {
+				"type": "object",
+				"properties": {
+					"rules": {
+						"type": "array",
+						"items": {
+							"type": "object",
+							"properties": {"allowed_origins": {"type": "array", "items": {"type": "string"}}},
+							"required": ["allowed_origins"]
+						}
+					}
+				}
+			}
+		},
+		"additionalProperties": false
+	}`).(map[string]any)
+
+	tests := []struct {
+		params string
+		want   []string
+	}{
+		{`{"buckets": ["logs", "tmp", "Uploads"]}`, []string{"parameters.buckets[2]: must match pattern ^[a-z]+$"}},
+		{`{"cors": {"rules": [{"allowed_origins": "*"}]}}`, []string{"parameters.cors.rules[0].allowed_origins: must be of type array"}},
+		{`{"cors": {"rules": [{"allowed_origins": []}, {}]}}`, []string{"parameters.cors.rules[1].allowed_origins: is required"}},
+		{`{"cors": {"rules": [{"allowed_origins": ["a", 1]}]}}`, []string{"parameters.cors.rules[0].allowed_origins[1]: must be of type string"}},
+		{`{"bucket": "a", "buckets": [1]}`, []string{
+			"parameters.bucket: is not a supported parameter (supported: buckets, cors)",
+			"parameters.buckets[0]: must be of type string",
+		}},
+	}
+	for _, test := range tests {
+		err := validateParameters(schema, decodeJSON(t, test.params).(map[string]any))
+		want := "invalid parameters: " + strings.Join(test.want, "; ")
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", test.params, err, want)
+		}
+	}
+
+	if err := validateParameters(schema, nil); err != nil {
+		t.Errorf("no parameters: %v", err)
+	}
+	if err := validateParameters(nil, map[string]any{"anything": 1}); err != nil {
+		t.Errorf("nil schema: %v", err)
+	}
+}
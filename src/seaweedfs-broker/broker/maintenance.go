@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+)
+
+// MaintenanceInfo is the OSB maintenance_info object
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// resolveMaintenanceInfo derives the maintenance_info of dedicated plans
+// from the release and stemcell versions that new deployments use. Versions
+// given as "latest" are resolved against the director. It returns nil if
+// either version cannot be determined.
+//
+// The version is the release version as semver, with the stemcell version as
+// pre-release identifiers, for example 1.4.0-stemcell.1.351. A new release or
+// stemcell therefore always yields a higher version. Pre-release identifiers
+// of the release come first, as in 1.4.0-rc.1.stemcell.1.351, so release
+// candidates sort before the final release as long as their identifiers,
+// such as alpha, beta or rc, sort before "stemcell".
+func (b *Broker) resolveMaintenanceInfo() *MaintenanceInfo {
+	cfg := b.config.BOSH
+
+	releaseVersion, err := b.resolveVersion(cfg.ReleaseVersion, func() (string, error) {
+		return b.boshClient.LatestReleaseVersion(cfg.ReleaseName)
+	})
+	if err != nil {
+		log.Printf("Warning: not advertising maintenance_info, release version unknown: %v", err)
+		return nil
+	}
+	stemcellVersion, err := b.resolveVersion(cfg.StemcellVersion, func() (string, error) {
+		return b.boshClient.LatestStemcellVersion(cfg.StemcellOS)
+	})
+	if err != nil {
+		log.Printf("Warning: not advertising maintenance_info, stemcell version unknown: %v", err)
+		return nil
+	}
+
+	version, err := maintenanceVersion(releaseVersion, stemcellVersion)
+	if err != nil {
+		log.Printf("Warning: not advertising maintenance_info: %v", err)
+		return nil
+	}
+
+	info := &MaintenanceInfo{
+		Version:     version,
+		Description: fmt.Sprintf("SeaweedFS release %s on %s stemcell %s", releaseVersion, cfg.StemcellOS, stemcellVersion),
+	}
+	log.Printf("Dedicated plans advertise maintenance_info version %s (%s)", info.Version, info.Description)
+	return info
+}
+
+// resolveVersion returns a configured version, looking up "latest" with
+// latest
+func (b *Broker) resolveVersion(configured string, latest func() (string, error)) (string, error) {
+	if configured != "" && configured != "latest" {
+		return configured, nil
+	}
+	if b.boshClient == nil {
+		return "", fmt.Errorf("version is %q and no BOSH director is configured", configured)
+	}
+	return latest()
+}
+
+// maintenanceVersion builds a semver version from a BOSH release version and
+// a stemcell version
+func maintenanceVersion(releaseVersion, stemcellVersion string) (string, error) {
+	// Drop dev build suffixes such as 1.4.0+dev.3
+	core, _, _ := strings.Cut(releaseVersion, "+")
+	core, preRelease, hasPreRelease := strings.Cut(core, "-")
+
+	releaseParts, err := numericParts(core)
+	if err != nil || len(releaseParts) > 3 {
+		return "", fmt.Errorf("release version %q is not of the form major[.minor[.patch]][-pre-release]", releaseVersion)
+	}
+	for len(releaseParts) < 3 {
+		releaseParts = append(releaseParts, "0")
+	}
+
+	var preReleaseParts []string
+	if hasPreRelease {
+		if preReleaseParts, err = preReleaseIdentifiers(preRelease); err != nil {
+			return "", fmt.Errorf("release version %q has an invalid pre-release: %w", releaseVersion, err)
+		}
+	}
+
+	stemcellParts, err := numericParts(stemcellVersion)
+	if err != nil {
+		return "", fmt.Errorf("stemcell version %q is not numeric", stemcellVersion)
+	}
+
+	identifiers := append(preReleaseParts, "stemcell")
+	identifiers = append(identifiers, stemcellParts...)
+	return fmt.Sprintf("%s-%s", strings.Join(releaseParts, "."), strings.Join(identifiers, ".")), nil
+}
+
+// preReleaseIdentifiers splits a semver pre-release into its identifiers,
+// with numeric identifiers in canonical decimal form
+func preReleaseIdentifiers(preRelease string) ([]string, error) {
+	parts := strings.Split(preRelease, ".")
+	for i, part := range parts {
+		if part == "" || strings.Trim(part, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-") != "" {
+			return nil, fmt.Errorf("identifier %q is not alphanumeric", part)
+		}
+		if n, err := strconv.ParseUint(part, 10, 64); err == nil {
+			parts[i] = strconv.FormatUint(n, 10)
+		}
+	}
+	return parts, nil
+}
+
+// numericParts splits a dotted version into canonical decimal components
+func numericParts(version string) ([]string, error) {
+	parts := strings.Split(version, ".")
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = strconv.FormatUint(n, 10)
+	}
+	return parts, nil
+}
+
+// planMaintenanceInfo returns the maintenance_info of a plan, or nil if it
+// has none. Shared plans have nothing to upgrade per instance.
+func (b *Broker) planMaintenanceInfo(plan *config.PlanConfig) *MaintenanceInfo {
+	if plan == nil || plan.PlanType != PlanTypeDedicated {
+		return nil
+	}
+	return b.maintenanceInfo
+}
+
+// checkMaintenanceInfo verifies that the maintenance_info of a request
+// matches the catalog
+func (b *Broker) checkMaintenanceInfo(plan *config.PlanConfig, requested *MaintenanceInfo) error {
+	if requested == nil {
+		return nil
+	}
+	current := b.planMaintenanceInfo(plan)
+	if current == nil {
+		return fmt.Errorf("the plan does not support maintenance_info")
+	}
+	if requested.Version != current.Version {
+		return fmt.Errorf("maintenance_info.version %s does not match version %s in the catalog", requested.Version, current.Version)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package broker
+
+import "testing"
+
+func TestMaintenanceVersion(t *testing.T) {
+	tests := []struct {
+		release, stemcell, want string
+	}{
+		{"1.4.0", "1.351", "1.4.0-stemcell.1.351"},
+		{"1.4", "1.351", "1.4.0-stemcell.1.351"},
+		{"1.4.0+dev.3", "1.351", "1.4.0-stemcell.1.351"},
+		{"1.2.0-rc.1", "1.351", "1.2.0-rc.1.stemcell.1.351"},
+		{"1.2.0-rc.01+dev.2", "1.351", "1.2.0-rc.1.stemcell.1.351"},
+		{"1.2.0-beta-2", "1.351", "1.2.0-beta-2.stemcell.1.351"},
+	}
+	for _, test := range tests {
+		got, err := maintenanceVersion(test.release, test.stemcell)
+		if err != nil || got != test.want {
+			t.Errorf("maintenanceVersion(%q, %q) = %q, %v; want %q", test.release, test.stemcell, got, err, test.want)
+		}
+	}
+
+	for _, release := range []string{"1.2.3.4", "v1.2.0", "1.2.0-", "1.2.0-rc..1", "1.2.0-rc_1"} {
+		if got, err := maintenanceVersion(release, "1.351"); err == nil {
+			t.Errorf("maintenanceVersion(%q) = %q, expected an error", release, got)
+		}
+	}
+}
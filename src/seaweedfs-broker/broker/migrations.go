@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// stateMigrations returns the ordered list of state store migrations. They
+// run once at startup, after a backup of the state has been taken, and the
+// store records the highest version applied.
+//
+// To add a migration, append an entry with the next version number and an
+// Instance and/or Binding function that fills in the new fields. Functions
+// must be idempotent and return true only when they changed the record.
+// Never renumber or remove a migration that has shipped.
+func (b *Broker) stateMigrations() []store.Migration {
+	return []store.Migration{
+		{
+			Version:     1,
+			Description: "backfill S3 and IAM endpoints for dedicated instances",
+			Instance:    b.backfillDedicatedEndpoints,
+		},
+	}
+}
+
+// backfillDedicatedEndpoints looks up the seaweedfs-s3 VM of dedicated
+// instances provisioned before IAMEndpoint was recorded. Instances whose
+// deployment cannot be queried are left unchanged.
+func (b *Broker) backfillDedicatedEndpoints(instance *store.ServiceInstance) (bool, error) {
+	if instance.DeploymentName == "" || instance.IAMEndpoint != "" || b.boshClient == nil {
+		return false, nil
+	}
+
+	vms, err := b.boshClient.GetDeploymentVMs(instance.DeploymentName)
+	if err != nil {
+		log.Printf("Migration: skipping instance %s, could not get VMs for %s: %v", instance.ID, instance.DeploymentName, err)
+		return false, nil
+	}
+
+	for _, vm := range vms {
+		if vmJobName(vm) != "seaweedfs-s3" {
+			continue
+		}
+		ips, ok := vm["ips"].([]any)
+		if !ok || len(ips) == 0 {
+			continue
+		}
+		instance.IAMEndpoint = fmt.Sprintf("%v:8333", ips[0])
+		if instance.S3Endpoint == "" {
+			instance.S3Endpoint = instance.IAMEndpoint
+		}
+		log.Printf("Migration: set IAMEndpoint for instance %s to %s", instance.ID, instance.IAMEndpoint)
+		return true, nil
+	}
+
+	return false, nil
+}
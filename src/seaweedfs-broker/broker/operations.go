@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/gorilla/mux"
+)
+
+// startOperation adds an in-progress entry to the operation history.
+// bindingID is empty for instance operations.
+func (b *Broker) startOperation(r *http.Request, opType, instanceID, bindingID string) *store.Operation {
+	op := &store.Operation{
+		ID:         generateOperationID(),
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		Type:       opType,
+		State:      store.OperationInProgress,
+		StartedAt:  time.Now(),
+	}
+	if r != nil {
+		op.OriginatingIdentity = callerIdentity(r.Context())
+		op.RequestIdentity = requestIdentity(r.Context())
+	}
+	b.saveOperation(op)
+	return op
+}
+
+// recordTask adds a BOSH task to an operation
+func (b *Broker) recordTask(op *store.Operation, taskID int) {
+	op.BOSHTaskIDs = append(op.BOSHTaskIDs, taskID)
+	b.saveOperation(op)
+}
+
+// finishOperation records the outcome of an operation; a nil err means it
+// succeeded
+func (b *Broker) finishOperation(op *store.Operation, err error) {
+	now := time.Now()
+	op.FinishedAt = &now
+	if err != nil {
+		op.State = store.OperationFailed
+		op.Error = err.Error()
+	} else {
+		op.State = store.OperationSucceeded
+	}
+	b.saveOperation(op)
+}
+
+// saveOperation writes an operation history entry. The history is
+// informational, so a failed write is logged rather than failing the
+// operation itself.
+func (b *Broker) saveOperation(op *store.Operation) {
+	if err := b.store.SaveOperation(op); err != nil {
+		logf(operationContext(op), "Warning: failed to record %s operation %s for instance %s: %v", op.Type, op.ID, op.InstanceID, err)
+	}
+}
+
+// lastOperationFailed reports whether the latest operation on the instance
+// itself, rather than on one of its bindings, failed
+func (b *Broker) lastOperationFailed(instanceID string) (bool, error) {
+	ops, err := b.store.ListOperationsForInstance(instanceID)
+	if err != nil {
+		return false, err
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].BindingID == "" {
+			return ops[i].State == store.OperationFailed, nil
+		}
+	}
+	return false, nil
+}
+
+func generateOperationID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// listOperationsHandler returns the operation history of a service
+// instance, including operations on its bindings. The history is kept after
+// the instance is deprovisioned.
+func (b *Broker) listOperationsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+
+	ops, err := b.store.ListOperationsForInstance(instanceID)
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+	if len(ops) == 0 {
+		instance, err := b.store.GetInstance(instanceID)
+		if err != nil {
+			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			return
+		}
+		if instance == nil {
+			b.writeError(w, http.StatusNotFound, "InstanceNotFound", "Service instance not found")
+			return
+		}
+	}
+
+	b.writeJSON(w, http.StatusOK, map[string]any{
+		"instance_id": instanceID,
+		"operations":  ops,
+	})
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// failProvision records a failed dedicated provision. With orphan mitigation
+// enabled, the partial deployment and any binding artifacts are removed
+// first and the outcome is appended to the state message. If a deprovision
+// took over the instance in the meantime, cleanup is left to it.
+func (b *Broker) failProvision(instance *store.ServiceInstance, op *store.Operation, message string) {
+	ctx := operationContext(op)
+	if !b.config.BOSH.OrphanMitigation.Enabled || instance.DeploymentName == "" {
+		b.failOperation(instance, op, "provisioning", message)
+		return
+	}
+
+	instance.StateMessage = message + "; removing partial deployment"
+	if err := b.saveOperationState(ctx, instance, "provisioning"); err != nil {
+		logf(ctx, "Instance %s: skipping orphan mitigation: %v", instance.ID, err)
+		b.finishOperation(op, errors.New(message))
+		return
+	}
+
+	logf(ctx, "Instance %s: %s; starting orphan mitigation", instance.ID, message)
+	b.removeBindingArtifacts(ctx, instance)
+
+	attempts, err := b.deleteDeploymentWithRetry(instance, op)
+	if err != nil {
+		message = fmt.Sprintf("%s; orphan mitigation could not delete deployment %s after %d attempt(s): %v",
+			message, instance.DeploymentName, attempts, err)
+	} else {
+		message = fmt.Sprintf("%s; orphan mitigation deleted deployment %s (attempt %d)",
+			message, instance.DeploymentName, attempts)
+	}
+	b.failOperation(instance, op, "provisioning", message)
+}
+
+// removeBindingArtifacts revokes the IAM users and CredHub entries of any
+// bindings recorded for an instance and deletes the binding records
+func (b *Broker) removeBindingArtifacts(ctx context.Context, instance *store.ServiceInstance) {
+	bindings, err := b.store.ListBindingsForInstance(instance.ID)
+	if err != nil {
+		logf(ctx, "Warning: could not list bindings of instance %s for cleanup: %v", instance.ID, err)
+		return
+	}
+	for _, binding := range bindings {
+		b.removeBindingCredentials(ctx, instance, binding)
+		if err := b.store.DeleteBinding(binding.ID); err != nil {
+			logf(ctx, "Warning: could not delete binding %s: %v", binding.ID, err)
+		}
+	}
+}
+
+// deleteDeploymentWithRetry deletes the deployment of a dedicated instance,
+// retrying with exponential backoff. It returns the number of attempts made.
+func (b *Broker) deleteDeploymentWithRetry(instance *store.ServiceInstance, op *store.Operation) (int, error) {
+	ctx := operationContext(op)
+	cfg := b.config.BOSH.OrphanMitigation
+	backoff := time.Duration(cfg.BackoffSeconds) * time.Second
+
+	// Load rejects fewer attempts; at least one keeps a broken config from
+	// reporting success without deleting anything
+	attempts := max(cfg.MaxAttempts, 1)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			logf(ctx, "Retrying deletion of deployment %s in %s", instance.DeploymentName, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = b.deleteDeployment(instance, op); err == nil {
+			return attempt, nil
+		}
+		logf(ctx, "Attempt %d of %d to delete deployment %s failed: %v", attempt, attempts, instance.DeploymentName, err)
+	}
+	return attempts, err
+}
+
+// deleteDeployment deletes the deployment of a dedicated instance once no
+// task of the instance holds its lock. A missing deployment counts as
+// deleted.
+func (b *Broker) deleteDeployment(instance *store.ServiceInstance, op *store.Operation) error {
+	ctx := operationContext(op)
+	b.waitForRunningTasks(ctx, instance.ID)
+
+	deployment, err := b.boshClient.GetDeployment(instance.DeploymentName)
+	if err != nil {
+		return err
+	}
+	if deployment == nil {
+		logf(ctx, "Deployment %s does not exist, nothing to delete", instance.DeploymentName)
+		return nil
+	}
+
+	task, err := b.boshClient.DeleteDeployment(instance.DeploymentName, op.RequestIdentity)
+	if err != nil {
+		return err
+	}
+	b.recordTask(op, task.ID)
+
+	_, err = b.boshClient.WaitForTask(task.ID, 15*time.Minute)
+	return err
+}
+
+// waitForRunningTasks waits for the latest BOSH task of every in-progress
+// operation on an instance. A deploy can outlive the provision request that
+// started it, for example when the platform stops polling and deprovisions,
+// and BOSH rejects a delete while it holds the deployment lock.
+func (b *Broker) waitForRunningTasks(ctx context.Context, instanceID string) {
+	ops, err := b.store.ListOperationsForInstance(instanceID)
+	if err != nil {
+		logf(ctx, "Warning: could not read operation history of instance %s: %v", instanceID, err)
+		return
+	}
+	for _, op := range ops {
+		if op.State != store.OperationInProgress || len(op.BOSHTaskIDs) == 0 {
+			continue
+		}
+		taskID := op.BOSHTaskIDs[len(op.BOSHTaskIDs)-1]
+		if _, err := b.boshClient.WaitForTask(taskID, 30*time.Minute); err != nil {
+			logf(ctx, "Task %d of %s operation %s ended: %v", taskID, op.Type, op.ID, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/iam"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// Values of the permissions bind parameter
+const (
+	permissionRead      = "read"
+	permissionWrite     = "write"
+	permissionReadWrite = "readwrite"
+	permissionAdmin     = "admin"
+)
+
+// permissionActions are the IAM policy actions granted by each permission
+var permissionActions = map[string]iam.Actions{
+	permissionRead:      iam.ReadOnlyActions,
+	permissionWrite:     iam.WriteOnlyActions,
+	permissionReadWrite: iam.ReadWriteActions,
+	permissionAdmin:     iam.AdminActions,
+}
+
+// maxPrefixLength bounds the prefix bind parameter, leaving room for the
+// rest of the key within the 1024 bytes S3 allows
+const maxPrefixLength = 512
+
+// permissionsSchema describes the permissions bind parameter
+func permissionsSchema() map[string]any {
+	return map[string]any{
+		"type":        "string",
+		"enum":        []any{permissionRead, permissionWrite, permissionReadWrite, permissionAdmin},
+		"description": "Permissions of the binding's key: read, write (without read), readwrite (objects only) or admin (objects and bucket configuration); default readwrite",
+	}
+}
+
+// prefixSchema describes the prefix bind parameter
+func prefixSchema() map[string]any {
+	return map[string]any{
+		"type":        "string",
+		"minLength":   1,
+		"maxLength":   maxPrefixLength,
+		"pattern":     `^[^/*?][^*?]*$`,
+		"description": "Restrict the binding to object keys starting with this prefix, for example tenant-a/",
+	}
+}
+
+// parsePermissions validates a permissions parameter value
+func parsePermissions(value any) (string, error) {
+	permissions, _ := value.(string)
+	if _, ok := permissionActions[permissions]; !ok {
+		return "", fmt.Errorf("permissions must be %s, %s, %s or %s", permissionRead, permissionWrite, permissionReadWrite, permissionAdmin)
+	}
+	return permissions, nil
+}
+
+// parsePrefix validates a prefix parameter value
+func parsePrefix(value any) (string, error) {
+	prefix, ok := value.(string)
+	switch {
+	case !ok || prefix == "" || len(prefix) > maxPrefixLength:
+		return "", fmt.Errorf("prefix must be a string of 1 to %d characters", maxPrefixLength)
+	case strings.HasPrefix(prefix, "/"):
+		return "", fmt.Errorf("prefix must not start with /")
+	case strings.ContainsAny(prefix, "*?"):
+		return "", fmt.Errorf("prefix must not contain * or ?")
+	}
+	return prefix, nil
+}
+
+// bindingPermissions returns the effective permissions of a new binding
+// with the given access level. Read-only bindings default to, and are
+// limited to, read permissions.
+func bindingPermissions(access string, requested *string) (string, error) {
+	if access == accessReadOnly {
+		if requested != nil && *requested != permissionRead {
+			return "", fmt.Errorf("invalid parameters: bindings from spaces the instance is shared with are limited to %s permissions", permissionRead)
+		}
+		return permissionRead, nil
+	}
+	if requested == nil {
+		return permissionReadWrite, nil
+	}
+	return *requested, nil
+}
+
+// effectivePermissions returns the permissions of a binding. Bindings
+// created before permissions were recorded have admin access, or read
+// access if they are read-only.
+func effectivePermissions(binding *store.ServiceBinding) string {
+	switch {
+	case binding.Permissions != "":
+		return binding.Permissions
+	case binding.Access == accessReadOnly:
+		return permissionRead
+	default:
+		return permissionAdmin
+	}
+}
+
+// policyActions returns the IAM policy actions of a binding's permissions.
+// All bindings of an instance over its storage quota lose write access,
+// which leaves write-only bindings without any.
+func policyActions(instance *store.ServiceInstance, binding *store.ServiceBinding) iam.Actions {
+	permissions := effectivePermissions(binding)
+	if instance.QuotaExceeded {
+		if permissions == permissionWrite {
+			return iam.Actions{}
+		}
+		return iam.ReadOnlyActions
+	}
+	return permissionActions[permissions]
+}
+
+// putBindingPolicy attaches the IAM policy of a binding to its user and
+// reads it back to verify that SeaweedFS granted what was asked, or removes
+// the policy if the binding currently has no access
+func (b *Broker) putBindingPolicy(iamClient *iam.Client, instance *store.ServiceInstance, binding *store.ServiceBinding) error {
+	policyName := bindingPolicyName(binding.ID)
+	actions := policyActions(instance, binding)
+	if actions.Empty() {
+		// A user without the policy already has no access
+		if err := iamClient.DeleteUserPolicy(binding.IAMUserName, policyName); err != nil && !iam.IsNoSuchEntity(err) {
+			return err
+		}
+		return nil
+	}
+	policy := iam.BucketPolicy(bindingBucketNames(instance, binding), binding.Prefix, actions)
+	if err := iamClient.PutUserPolicy(binding.IAMUserName, policyName, policy); err != nil {
+		return err
+	}
+
+	attached, err := iamClient.GetUserPolicy(binding.IAMUserName, policyName)
+	if err != nil {
+		return fmt.Errorf("could not verify policy %s: %w", policyName, err)
+	}
+	if !attached.Equivalent(policy) {
+		return fmt.Errorf("policy %s of user %s grants %s instead of %s", policyName, binding.IAMUserName,
+			strings.Join(attached.Grants(), ", "), strings.Join(policy.Grants(), ", "))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/seaweedfs-broker/iam"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+func TestPolicyActions(t *testing.T) {
+	tests := []struct {
+		name          string
+		binding       store.ServiceBinding
+		quotaExceeded bool
+		want          iam.Actions
+	}{
+		{name: "read", binding: store.ServiceBinding{Permissions: permissionRead}, want: iam.ReadOnlyActions},
+		{name: "write", binding: store.ServiceBinding{Permissions: permissionWrite}, want: iam.WriteOnlyActions},
+		{name: "readwrite", binding: store.ServiceBinding{Permissions: permissionReadWrite}, want: iam.ReadWriteActions},
+		{name: "admin", binding: store.ServiceBinding{Permissions: permissionAdmin}, want: iam.AdminActions},
+		{name: "recorded before permissions", binding: store.ServiceBinding{}, want: iam.AdminActions},
+		{name: "read-only before permissions", binding: store.ServiceBinding{Access: accessReadOnly}, want: iam.ReadOnlyActions},
+		{name: "read over quota", binding: store.ServiceBinding{Permissions: permissionRead}, quotaExceeded: true, want: iam.ReadOnlyActions},
+		{name: "write over quota", binding: store.ServiceBinding{Permissions: permissionWrite}, quotaExceeded: true, want: iam.Actions{}},
+		{name: "readwrite over quota", binding: store.ServiceBinding{Permissions: permissionReadWrite}, quotaExceeded: true, want: iam.ReadOnlyActions},
+		{name: "admin over quota", binding: store.ServiceBinding{Permissions: permissionAdmin}, quotaExceeded: true, want: iam.ReadOnlyActions},
+	}
+	for _, test := range tests {
+		instance := &store.ServiceInstance{QuotaExceeded: test.quotaExceeded}
+		got := policyActions(instance, &test.binding)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestBindingPermissions(t *testing.T) {
+	permission := func(p string) *string { return &p }
+	tests := []struct {
+		name      string
+		access    string
+		requested *string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", want: permissionReadWrite},
+		{name: "requested", requested: permission(permissionWrite), want: permissionWrite},
+		{name: "read-only default", access: accessReadOnly, want: permissionRead},
+		{name: "read-only requesting read", access: accessReadOnly, requested: permission(permissionRead), want: permissionRead},
+		{name: "read-only requesting write", access: accessReadOnly, requested: permission(permissionReadWrite), wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := bindingPermissions(test.access, test.requested)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParsePermissionsAndPrefix(t *testing.T) {
+	for _, value := range []any{permissionRead, permissionWrite, permissionReadWrite, permissionAdmin} {
+		if _, err := parsePermissions(value); err != nil {
+			t.Errorf("permissions %v: unexpected error %v", value, err)
+		}
+	}
+	for _, value := range []any{"", "owner", 1, nil} {
+		if _, err := parsePermissions(value); err == nil {
+			t.Errorf("permissions %v: expected an error", value)
+		}
+	}
+
+	for _, value := range []any{"tenant-a/", "a", "logs/2024 01/"} {
+		if _, err := parsePrefix(value); err != nil {
+			t.Errorf("prefix %v: unexpected error %v", value, err)
+		}
+	}
+	for _, value := range []any{"", "/tenant-a/", "tenant-*/", "tenant?", strings.Repeat("a", maxPrefixLength+1), 1} {
+		if _, err := parsePrefix(value); err == nil {
+			t.Errorf("prefix %v: expected an error", value)
+		}
+	}
+}
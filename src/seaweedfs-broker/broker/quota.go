@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/minio/minio-go/v7"
+)
+
+// usageScanInterval is how often the usage of shared buckets is measured
+// against their plan's storage quota
+const usageScanInterval = 15 * time.Minute
+
+// storageQuotaBytes returns the storage quota of a shared instance in bytes,
+// or 0 if its plan has none
+func (b *Broker) storageQuotaBytes(instance *store.ServiceInstance) int64 {
+	if instance.DeploymentName != "" {
+		return 0
+	}
+	plan := b.findPlan(instance.ServiceID, instance.PlanID)
+	if plan == nil || plan.PlanType != PlanTypeShared || plan.StorageQuotaGB <= 0 {
+		return 0
+	}
+	return int64(plan.StorageQuotaGB) << 30
+}
+
+// bucketUsage returns the bytes stored in the buckets of a shared instance.
+// Noncurrent object versions count towards the usage of versioned buckets.
+func (b *Broker) bucketUsage(ctx context.Context, instance *store.ServiceInstance) (int64, error) {
+	opts := minio.ListObjectsOptions{Recursive: true}
+	if versioned, _ := instance.Parameters["versioning"].(bool); versioned {
+		opts.WithVersions = true
+	}
+
+	var usage int64
+	for _, bucketName := range instance.AllBuckets() {
+		for object := range b.s3Client.ListObjects(ctx, bucketName, opts) {
+			if object.Err != nil {
+				return 0, object.Err
+			}
+			usage += object.Size
+		}
+	}
+	return usage, nil
+}
+
+// runUsageScanner enforces the storage quotas of shared buckets every
+// usageScanInterval
+func (b *Broker) runUsageScanner() {
+	ticker := time.NewTicker(usageScanInterval)
+	defer ticker.Stop()
+
+	for {
+		b.scanBucketUsage()
+		<-ticker.C
+	}
+}
+
+// scanBucketUsage measures the usage of every shared bucket with a quota.
+// Following the semantics of SeaweedFS's s3.bucket.quota.enforce, buckets at
+// or over their quota become read-only and regain write access once their
+// usage drops below it. SeaweedFS only exposes bucket quotas to weed shell,
+// so the broker enforces them through the IAM policies of the bindings.
+func (b *Broker) scanBucketUsage() {
+	if b.s3Client == nil {
+		return
+	}
+	ctx := context.Background()
+	instances, err := b.store.ListInstances()
+	if err != nil {
+		logf(ctx, "Warning: usage scanner could not list instances: %v", err)
+		return
+	}
+
+	for _, instance := range instances {
+		if instance.Tombstoned() || instance.DeploymentName != "" || instance.BucketName == "" || instance.State != "succeeded" {
+			continue
+		}
+		quota := b.storageQuotaBytes(instance)
+		// Buckets still marked over quota are scanned so that removing the
+		// quota from the plan restores their write access
+		if quota == 0 && !instance.QuotaExceeded {
+			continue
+		}
+
+		usage, err := b.bucketUsage(ctx, instance)
+		if err != nil {
+			logf(ctx, "Warning: could not measure usage of instance %s: %v", instance.ID, err)
+			continue
+		}
+
+		exceeded := quota > 0 && usage >= quota
+		if exceeded != instance.QuotaExceeded {
+			if err := b.applyQuotaPolicies(ctx, instance, exceeded); err != nil {
+				// Keep the previous state so the next scan retries
+				logf(ctx, "Warning: could not update bucket access of instance %s, will retry: %v", instance.ID, err)
+				exceeded = instance.QuotaExceeded
+			} else if exceeded {
+				logf(ctx, "Instance %s: buckets use %d of %d bytes, bindings are now read-only", instance.ID, usage, quota)
+			} else {
+				logf(ctx, "Instance %s: buckets use %d bytes, below the quota, write access restored", instance.ID, usage)
+			}
+		}
+
+		if err := b.recordUsage(instance.ID, usage, exceeded); err != nil {
+			logf(ctx, "Warning: could not record usage of instance %s: %v", instance.ID, err)
+		}
+	}
+}
+
+// applyQuotaPolicies rewrites the IAM policies of an instance's bindings for
+// the given quota state
+func (b *Broker) applyQuotaPolicies(ctx context.Context, instance *store.ServiceInstance, exceeded bool) error {
+	target := instance.Clone()
+	target.QuotaExceeded = exceeded
+	return b.refreshBindingPolicies(ctx, target)
+}
+
+// recordUsage saves the measured usage and quota state of an instance
+func (b *Broker) recordUsage(instanceID string, usage int64, exceeded bool) error {
+	for attempt := 1; ; attempt++ {
+		instance, err := b.store.GetInstance(instanceID)
+		if err != nil || instance == nil {
+			// Deprovisioned since it was scanned
+			return err
+		}
+
+		now := time.Now()
+		instance.UsageBytes = usage
+		instance.UsageCheckedAt = &now
+		instance.QuotaExceeded = exceeded
+		err = b.store.SaveInstance(instance)
+		if err == nil || !store.IsConflict(err) || attempt >= maxConflictRetries {
+			return err
+		}
+	}
+}
+
+// usageAttributes returns the storage quota and last measured usage of a
+// shared instance, or nil if its plan has no quota
+func (b *Broker) usageAttributes(instance *store.ServiceInstance) map[string]any {
+	quota := b.storageQuotaBytes(instance)
+	if quota == 0 {
+		return nil
+	}
+
+	attributes := map[string]any{
+		"storage_quota_bytes": quota,
+		"storage_used_bytes":  instance.UsageBytes,
+		"quota_exceeded":      instance.QuotaExceeded,
+	}
+	if instance.UsageCheckedAt != nil {
+		attributes["usage_checked_at"] = instance.UsageCheckedAt.UTC().Format(time.RFC3339)
+	}
+	return attributes
+}
+
+// listUsageHandler lists the storage usage and quota of every shared
+// instance
+func (b *Broker) listUsageHandler(w http.ResponseWriter, r *http.Request) {
+	instances, err := b.store.ListInstances()
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+
+	type usageInfo struct {
+		InstanceID        string     `json:"instance_id"`
+		OrganizationGUID  string     `json:"organization_guid"`
+		SpaceGUID         string     `json:"space_guid"`
+		BucketName        string     `json:"bucket_name"`
+		Buckets           []string   `json:"buckets"`
+		StorageQuotaBytes int64      `json:"storage_quota_bytes"`
+		StorageUsedBytes  int64      `json:"storage_used_bytes"`
+		QuotaExceeded     bool       `json:"quota_exceeded"`
+		UsageCheckedAt    *time.Time `json:"usage_checked_at,omitempty"`
+	}
+
+	usage := make([]usageInfo, 0)
+	for _, inst := range instances {
+		if inst.Tombstoned() || inst.DeploymentName != "" || inst.BucketName == "" {
+			continue
+		}
+		usage = append(usage, usageInfo{
+			InstanceID:        inst.ID,
+			OrganizationGUID:  inst.OrganizationGUID,
+			SpaceGUID:         inst.SpaceGUID,
+			BucketName:        inst.BucketName,
+			Buckets:           inst.AllBuckets(),
+			StorageQuotaBytes: b.storageQuotaBytes(inst),
+			StorageUsedBytes:  inst.UsageBytes,
+			QuotaExceeded:     inst.QuotaExceeded,
+			UsageCheckedAt:    inst.UsageCheckedAt,
+		})
+	}
+
+	b.writeJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/iam"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// fakeUserPolicies answers the IAM user policy actions, keeping the policy
+// documents by user and policy name
+type fakeUserPolicies struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	policies map[string]string
+}
+
+func newFakeUserPolicies(t *testing.T) *fakeUserPolicies {
+	f := &fakeUserPolicies{policies: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeUserPolicies) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := r.PostForm.Get("UserName") + "/" + r.PostForm.Get("PolicyName")
+	switch r.PostForm.Get("Action") {
+	case "PutUserPolicy":
+		f.policies[key] = r.PostForm.Get("PolicyDocument")
+		fmt.Fprint(w, `<PutUserPolicyResponse></PutUserPolicyResponse>`)
+	case "GetUserPolicy":
+		fmt.Fprintf(w, `<GetUserPolicyResponse><GetUserPolicyResult><PolicyDocument>%s</PolicyDocument></GetUserPolicyResult></GetUserPolicyResponse>`,
+			html.EscapeString(f.policies[key]))
+	case "DeleteUserPolicy":
+		delete(f.policies, key)
+		fmt.Fprint(w, `<DeleteUserPolicyResponse></DeleteUserPolicyResponse>`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// grants returns the grants of a user's policy, or nil if it has none
+func (f *fakeUserPolicies) grants(t *testing.T, userName, policyName string) []string {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	document, ok := f.policies[userName+"/"+policyName]
+	if !ok {
+		return nil
+	}
+	var policy iam.PolicyDocument
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		t.Fatalf("policy of %s: %v", userName, err)
+	}
+	return policy.Grants()
+}
+
+func TestScanBucketUsage(t *testing.T) {
+	b := newStoreBroker(t)
+	b.config.Catalog = config.CatalogConfig{Services: []config.ServiceConfig{{
+		ID:    testServiceID,
+		Plans: []config.PlanConfig{{ID: "shared", PlanType: PlanTypeShared, StorageQuotaGB: 1}},
+	}}}
+	s3 := newFakeS3(t)
+	b.s3Client = s3.client(t)
+	policies := newFakeUserPolicies(t)
+	b.iamClient = iam.NewClient(strings.TrimPrefix(policies.URL, "http://"), "admin", "secret", "us-east-1", false)
+
+	instance := &store.ServiceInstance{ID: "instance-1", ServiceID: testServiceID, PlanID: "shared", BucketName: "bucket", State: "succeeded"}
+	if err := b.store.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	binding := &store.ServiceBinding{ID: "binding-1", InstanceID: "instance-1", IAMUserName: "user-1", Permissions: permissionReadWrite}
+	if err := b.store.SaveBinding(binding); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+	policyName := bindingPolicyName(binding.ID)
+	readOnly := iam.BucketPolicy([]string{"bucket"}, "", iam.ReadOnlyActions).Grants()
+	readWrite := iam.BucketPolicy([]string{"bucket"}, "", iam.ReadWriteActions).Grants()
+
+	s3.put("bucket", "large", 1<<30)
+	b.scanBucketUsage()
+	instance, err := b.store.GetInstance("instance-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !instance.QuotaExceeded || instance.UsageBytes != 1<<30 || instance.UsageCheckedAt == nil {
+		t.Errorf("expected the instance to be over its quota with 1 GiB used, got exceeded=%v usage=%d", instance.QuotaExceeded, instance.UsageBytes)
+	}
+	if got := policies.grants(t, "user-1", policyName); !slices.Equal(got, readOnly) {
+		t.Errorf("expected a read-only policy over the quota, got %v", got)
+	}
+
+	s3.put("bucket", "large", 1<<20)
+	b.scanBucketUsage()
+	instance, err = b.store.GetInstance("instance-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.QuotaExceeded || instance.UsageBytes != 1<<20 {
+		t.Errorf("expected the instance to be below its quota with 1 MiB used, got exceeded=%v usage=%d", instance.QuotaExceeded, instance.UsageBytes)
+	}
+	if got := policies.grants(t, "user-1", policyName); !slices.Equal(got, readWrite) {
+		t.Errorf("expected write access to be restored below the quota, got %v", got)
+	}
+}
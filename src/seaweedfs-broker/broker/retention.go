@@ -0,0 +1,342 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// reapInterval is how often tombstoned instances are checked for purging
+const reapInterval = time.Hour
+
+// tombstoneSharedInstance deprovisions a shared instance in retention mode.
+// Its bindings, and with them every IAM user with access to the bucket, are
+// already gone; the buckets are additionally locked with a deny-all policy
+// and kept until PurgeAt. If a bucket cannot be locked, the buckets locked
+// so far are unlocked again and the instance is left as it was, so the
+// deprovision can be retried.
+func (b *Broker) tombstoneSharedInstance(ctx context.Context, instance *store.ServiceInstance) error {
+	var locked []string
+	unlock := func() {
+		for _, name := range locked {
+			if err := b.unlockBucket(name); err != nil {
+				logf(ctx, "Warning: could not unlock bucket %s of instance %s: %v", name, instance.ID, err)
+			}
+		}
+	}
+	for _, bucketName := range instance.AllBuckets() {
+		if err := b.lockBucket(bucketName); err != nil {
+			unlock()
+			return fmt.Errorf("locking bucket %s: %w", bucketName, err)
+		}
+		locked = append(locked, bucketName)
+	}
+
+	now := time.Now()
+	purgeAt := now.AddDate(0, 0, b.config.SharedCluster.RetentionDays)
+	instance.TombstonedAt = &now
+	instance.PurgeAt = &purgeAt
+	instance.State = "tombstoned"
+	instance.StateMessage = fmt.Sprintf("Deprovisioned, data retained until %s", purgeAt.UTC().Format(time.RFC3339))
+	if err := b.store.SaveInstance(instance); err != nil {
+		unlock()
+		return err
+	}
+
+	logf(ctx, "Tombstoned instance %s, bucket %s will be purged after %s", instance.ID, instance.BucketName, purgeAt.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// lockBucket denies all S3 access to a tombstoned bucket
+func (b *Broker) lockBucket(bucketName string) error {
+	if b.s3Client == nil || bucketName == "" {
+		return nil
+	}
+
+	policy, err := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Sid":       "SeaweedFSBrokerTombstone",
+			"Effect":    "Deny",
+			"Principal": "*",
+			"Action":    "s3:*",
+			"Resource": []string{
+				fmt.Sprintf("arn:aws:s3:::%s", bucketName),
+				fmt.Sprintf("arn:aws:s3:::%s/*", bucketName),
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return b.s3Client.SetBucketPolicy(context.Background(), bucketName, string(policy))
+}
+
+// unlockBucket removes the policy set by lockBucket
+func (b *Broker) unlockBucket(bucketName string) error {
+	if b.s3Client == nil || bucketName == "" {
+		return nil
+	}
+	return b.s3Client.SetBucketPolicy(context.Background(), bucketName, "")
+}
+
+// runReaper purges tombstoned instances every reapInterval
+func (b *Broker) runReaper() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		b.reapTombstones()
+		<-ticker.C
+	}
+}
+
+// reapTombstones deletes the bucket and record of every tombstoned instance
+// whose retention period has ended
+func (b *Broker) reapTombstones() {
+	ctx := context.Background()
+	instances, err := b.store.ListInstances()
+	if err != nil {
+		logf(ctx, "Warning: reaper could not list instances: %v", err)
+		return
+	}
+
+	// A bucket that was restored into a live instance must never be purged,
+	// even if deleting its tombstone record failed
+	liveBuckets := make(map[string]bool)
+	for _, instance := range instances {
+		if !instance.Tombstoned() && instance.DeploymentName == "" {
+			for _, bucketName := range instance.AllBuckets() {
+				liveBuckets[bucketName] = true
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, instance := range instances {
+		if !instance.Tombstoned() || instance.PurgeAt == nil || instance.PurgeAt.After(now) {
+			continue
+		}
+		restored := restoredBuckets(instance, liveBuckets)
+		if len(restored) > 0 && len(restored) < len(instance.AllBuckets()) {
+			// Purging would delete live data and dropping the tombstone
+			// would lose track of the other buckets
+			logf(ctx, "Warning: only buckets %v of tombstoned instance %s belong to a live instance, not purging it", restored, instance.ID)
+			continue
+		}
+		if len(restored) > 0 {
+			logf(ctx, "Buckets %v of tombstoned instance %s were restored, removing tombstone only", restored, instance.ID)
+			if err := b.store.DeleteInstance(instance.ID); err != nil {
+				logf(ctx, "Warning: failed to delete tombstone %s: %v", instance.ID, err)
+			}
+			continue
+		}
+
+		logf(ctx, "Purging tombstoned instance %s (buckets %v)", instance.ID, instance.AllBuckets())
+		op := b.startOperation(nil, store.OperationPurge, instance.ID, "")
+		for _, bucketName := range instance.AllBuckets() {
+			if err := b.unlockBucket(bucketName); err != nil {
+				logf(ctx, "Warning: could not unlock bucket %s: %v", bucketName, err)
+			}
+		}
+		if err := b.deleteSharedBuckets(ctx, instance); err != nil {
+			logf(ctx, "Warning: failed to purge bucket of instance %s, will retry: %v", instance.ID, err)
+			b.finishOperation(op, err)
+			continue
+		}
+		if err := b.store.DeleteInstance(instance.ID); err != nil {
+			logf(ctx, "Warning: failed to delete purged instance %s: %v", instance.ID, err)
+			b.finishOperation(op, err)
+			continue
+		}
+		b.finishOperation(op, nil)
+	}
+}
+
+// restoredBuckets returns the buckets of a tombstoned instance that belong
+// to a live instance
+func restoredBuckets(instance *store.ServiceInstance, liveBuckets map[string]bool) []string {
+	var restored []string
+	for _, bucketName := range instance.AllBuckets() {
+		if liveBuckets[bucketName] {
+			restored = append(restored, bucketName)
+		}
+	}
+	return restored
+}
+
+// listTombstonesHandler lists the deprovisioned instances awaiting purge
+func (b *Broker) listTombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	instances, err := b.store.ListInstances()
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+
+	type tombstoneInfo struct {
+		InstanceID       string    `json:"instance_id"`
+		OrganizationGUID string    `json:"organization_guid"`
+		SpaceGUID        string    `json:"space_guid"`
+		BucketName       string    `json:"bucket_name"`
+		Buckets          []string  `json:"buckets"`
+		TombstonedAt     time.Time `json:"tombstoned_at"`
+		PurgeAt          time.Time `json:"purge_at"`
+	}
+
+	tombstones := make([]tombstoneInfo, 0)
+	for _, inst := range instances {
+		if !inst.Tombstoned() {
+			continue
+		}
+		info := tombstoneInfo{
+			InstanceID:       inst.ID,
+			OrganizationGUID: inst.OrganizationGUID,
+			SpaceGUID:        inst.SpaceGUID,
+			BucketName:       inst.BucketName,
+			Buckets:          inst.AllBuckets(),
+			TombstonedAt:     *inst.TombstonedAt,
+		}
+		if inst.PurgeAt != nil {
+			info.PurgeAt = *inst.PurgeAt
+		}
+		tombstones = append(tombstones, info)
+	}
+
+	b.writeJSON(w, http.StatusOK, tombstones)
+}
+
+// restoreInstanceHandler moves the buckets of a tombstoned instance to the
+// service instance given as new_instance_id. The usual flow is to create a
+// new service instance on the platform and restore into it; its own, still
+// empty buckets are removed once its record points at the restored buckets,
+// and it takes over the tombstoned instance's parameters. If new_instance_id
+// does not exist yet, a record is created for it.
+func (b *Broker) restoreInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+
+	var req struct {
+		NewInstanceID string `json:"new_instance_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewInstanceID == "" {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "new_instance_id is required")
+		return
+	}
+	if req.NewInstanceID == instanceID {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "new_instance_id must differ from the tombstoned instance ID")
+		return
+	}
+
+	tombstone, err := b.store.GetInstance(instanceID)
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+	if tombstone == nil || !tombstone.Tombstoned() {
+		b.writeError(w, http.StatusNotFound, "TombstoneNotFound", "No deprovisioned instance with this ID is awaiting purge")
+		return
+	}
+
+	target, err := b.store.GetInstance(req.NewInstanceID)
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+
+	op := b.startOperation(r, store.OperationRestore, req.NewInstanceID, "")
+	var replacedBuckets []string
+	if target != nil {
+		if target.Tombstoned() || target.DeploymentName != "" || target.State != "succeeded" {
+			b.finishOperation(op, fmt.Errorf("target instance cannot be restored into"))
+			b.writeError(w, http.StatusUnprocessableEntity, "InvalidTarget",
+				"The new instance must be a provisioned shared instance")
+			return
+		}
+		bindings, err := b.store.ListBindingsForInstance(target.ID)
+		if err != nil {
+			b.finishOperation(op, err)
+			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			return
+		}
+		if len(bindings) > 0 {
+			b.finishOperation(op, fmt.Errorf("target instance has bindings"))
+			b.writeError(w, http.StatusUnprocessableEntity, "BindingsExist",
+				"Unbind the new instance before restoring into it")
+			return
+		}
+		// The new instance's own buckets are only removed once the record
+		// points at the restored ones, so they must not hold any data. A
+		// retry after the record was saved has no buckets of its own left.
+		if target.BucketName != tombstone.BucketName {
+			replacedBuckets = target.AllBuckets()
+		}
+		if b.s3Client != nil {
+			for _, bucketName := range replacedBuckets {
+				empty, err := bucketEmpty(r.Context(), b.s3Client, bucketName)
+				if err == nil && !empty {
+					err = fmt.Errorf("bucket is not empty")
+				}
+				if err != nil {
+					b.finishOperation(op, err)
+					b.writeError(w, http.StatusConflict, "TargetBucketNotEmpty",
+						fmt.Sprintf("Could not remove bucket %s of the new instance: %v", bucketName, err))
+					return
+				}
+			}
+		}
+	} else {
+		target = tombstone.Clone()
+		target.ID = req.NewInstanceID
+		target.CreatedAt = time.Now()
+		target.Revision = 0
+	}
+
+	target.BucketName = tombstone.BucketName
+	target.Buckets = tombstone.Buckets
+	target.Parameters = tombstone.Parameters
+	target.TombstonedAt = nil
+	target.PurgeAt = nil
+	target.State = "succeeded"
+	target.StateMessage = fmt.Sprintf("Restored from instance %s", instanceID)
+	if err := b.store.SaveInstance(target); err != nil {
+		b.finishOperation(op, err)
+		b.writeStoreError(w, err)
+		return
+	}
+
+	warnings := make([]string, 0)
+	if b.s3Client != nil {
+		for _, bucketName := range replacedBuckets {
+			err := b.s3Client.RemoveBucket(r.Context(), bucketName)
+			if err != nil && minio.ToErrorResponse(err).Code != "NoSuchBucket" {
+				logf(r.Context(), "Warning: could not remove replaced bucket %s of instance %s: %v", bucketName, target.ID, err)
+				warnings = append(warnings, fmt.Sprintf("could not remove the new instance's own bucket %s: %v", bucketName, err))
+			}
+		}
+	}
+	for _, bucketName := range tombstone.AllBuckets() {
+		if err := b.unlockBucket(bucketName); err != nil {
+			logf(r.Context(), "Warning: could not unlock restored bucket %s: %v", bucketName, err)
+			warnings = append(warnings, fmt.Sprintf("could not remove the tombstone policy from bucket %s: %v", bucketName, err))
+		}
+	}
+	if err := b.store.DeleteInstance(instanceID); err != nil {
+		logf(r.Context(), "Warning: could not delete restored tombstone %s: %v", instanceID, err)
+		warnings = append(warnings, fmt.Sprintf("could not delete tombstone record: %v", err))
+	}
+	b.finishOperation(op, nil)
+
+	logf(r.Context(), "Restored bucket %s of instance %s into instance %s", tombstone.BucketName, instanceID, target.ID)
+	b.writeJSON(w, http.StatusOK, map[string]any{
+		"instance_id": target.ID,
+		"bucket_name": target.BucketName,
+		"buckets":     target.AllBuckets(),
+		"warnings":    warnings,
+	})
+}
@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// newRetentionBroker returns a broker with a file store and a fake shared
+// cluster, holding a tombstoned instance "old" with a bucket of data and a
+// new instance "new" with an empty bucket
+func newRetentionBroker(t *testing.T) (*Broker, *fakeS3) {
+	t.Helper()
+	b := newStoreBroker(t)
+	s3 := newFakeS3(t)
+	b.s3Client = s3.client(t)
+
+	saveTombstone(t, b)
+	if err := b.store.SaveInstance(&store.ServiceInstance{ID: "new", BucketName: "new-bucket", State: "succeeded"}); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	s3.put("old-bucket", "data", 3)
+	s3.put("new-bucket", "", 0)
+	return b, s3
+}
+
+func saveTombstone(t *testing.T, b *Broker) {
+	t.Helper()
+	tombstonedAt := time.Now().Add(-time.Hour)
+	purgeAt := time.Now().Add(time.Hour)
+	tombstone := &store.ServiceInstance{
+		ID:           "old",
+		BucketName:   "old-bucket",
+		Parameters:   map[string]any{"bucket_name": "old-bucket", "versioning": true},
+		State:        "succeeded",
+		TombstonedAt: &tombstonedAt,
+		PurgeAt:      &purgeAt,
+	}
+	if err := b.store.SaveInstance(tombstone); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+}
+
+func restore(b *Broker, instanceID, newInstanceID string) int {
+	r := httptest.NewRequest(http.MethodPost, "/admin/instances/"+instanceID+"/restore",
+		strings.NewReader(`{"new_instance_id": "`+newInstanceID+`"}`))
+	r = mux.SetURLVars(r, map[string]string{"instance_id": instanceID})
+	w := httptest.NewRecorder()
+	b.restoreInstanceHandler(w, r)
+	return w.Code
+}
+
+func TestRestoreIntoNewInstance(t *testing.T) {
+	b, s3 := newRetentionBroker(t)
+
+	if code := restore(b, "old", "new"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	target, err := b.store.GetInstance("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.BucketName != "old-bucket" {
+		t.Errorf("expected the new instance to use old-bucket, got %q", target.BucketName)
+	}
+	if want := map[string]any{"bucket_name": "old-bucket", "versioning": true}; !reflect.DeepEqual(target.Parameters, want) {
+		t.Errorf("expected the tombstone's parameters, got %v", target.Parameters)
+	}
+	if s3.exists("new-bucket") {
+		t.Error("the new instance's own bucket was not removed")
+	}
+	if tombstone, _ := b.store.GetInstance("old"); tombstone != nil {
+		t.Error("the tombstone was not deleted")
+	}
+
+	// A retry after the tombstone could not be deleted finds the new
+	// instance already holding the restored bucket, and must keep it
+	saveTombstone(t, b)
+	if code := restore(b, "old", "new"); code != http.StatusOK {
+		t.Fatalf("retry: expected 200, got %d", code)
+	}
+	if !s3.exists("old-bucket") {
+		t.Error("the retry removed the restored bucket")
+	}
+}
+
+func TestRestoreKeepsTargetBucketWithData(t *testing.T) {
+	b, s3 := newRetentionBroker(t)
+	s3.put("new-bucket", "data", 5)
+
+	if code := restore(b, "old", "new"); code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", code)
+	}
+	target, err := b.store.GetInstance("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.BucketName != "new-bucket" {
+		t.Errorf("the failed restore retargeted the new instance to %q", target.BucketName)
+	}
+	if !s3.exists("new-bucket") {
+		t.Error("the failed restore removed the new instance's bucket")
+	}
+	if tombstone, _ := b.store.GetInstance("old"); tombstone == nil || !tombstone.Tombstoned() {
+		t.Error("the failed restore did not keep the tombstone")
+	}
+}
+
+func TestReapTombstones(t *testing.T) {
+	b := newStoreBroker(t)
+	s3 := newFakeS3(t)
+	b.s3Client = s3.client(t)
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	for _, instance := range []*store.ServiceInstance{
+		{ID: "expired", BucketName: "expired-bucket", TombstonedAt: &past, PurgeAt: &past},
+		{ID: "retained", BucketName: "retained-bucket", TombstonedAt: &past, PurgeAt: &future},
+		{ID: "restored", BucketName: "restored-bucket", TombstonedAt: &past, PurgeAt: &past},
+		{ID: "live", BucketName: "restored-bucket", State: "succeeded"},
+	} {
+		if err := b.store.SaveInstance(instance); err != nil {
+			t.Fatalf("SaveInstance: %v", err)
+		}
+	}
+	s3.put("expired-bucket", "data", 3)
+	s3.put("retained-bucket", "data", 3)
+	s3.put("restored-bucket", "data", 3)
+
+	b.reapTombstones()
+
+	if s3.exists("expired-bucket") {
+		t.Error("the bucket of the expired tombstone was not purged")
+	}
+	if instance, _ := b.store.GetInstance("expired"); instance != nil {
+		t.Error("the expired tombstone was not deleted")
+	}
+	ops, err := b.store.ListOperationsForInstance("expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Type != store.OperationPurge || ops[0].State != "succeeded" {
+		t.Errorf("expected a succeeded purge operation, got %+v", ops)
+	}
+
+	if instance, _ := b.store.GetInstance("retained"); instance == nil || !s3.exists("retained-bucket") {
+		t.Error("a tombstone within its retention period was purged")
+	}
+
+	if instance, _ := b.store.GetInstance("restored"); instance != nil {
+		t.Error("the tombstone of a restored bucket was not deleted")
+	}
+	if !s3.exists("restored-bucket") {
+		t.Error("the reaper purged a bucket that belongs to a live instance")
+	}
+}
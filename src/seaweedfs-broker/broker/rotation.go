@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// inheritScope fills in the permissions, prefix and buckets a rotation does
+// not set from the binding it replaces, so the new credentials reach exactly
+// what the old ones did
+func inheritScope(params *bindingParameters, predecessor *store.ServiceBinding) {
+	if params.Permissions == nil {
+		permissions := effectivePermissions(predecessor)
+		params.Permissions = &permissions
+	}
+	if params.Prefix == nil && predecessor.Prefix != "" {
+		prefix := predecessor.Prefix
+		params.Prefix = &prefix
+	}
+	if params.Buckets == nil && len(predecessor.Buckets) > 0 {
+		params.Buckets = append([]string(nil), predecessor.Buckets...)
+	}
+}
+
+// retirePredecessor records that the credentials of a binding's predecessor
+// were rotated, and schedules the deactivation of the predecessor's access
+// key once the rotation overlap has passed. Until then both keys are valid,
+// so apps can be restaged onto the new binding without downtime.
+func (b *Broker) retirePredecessor(ctx context.Context, successor *store.ServiceBinding) {
+	if successor.PredecessorBindingID == "" {
+		return
+	}
+	deactivateAt := time.Now().Add(time.Duration(b.config.Bindings.RotationOverlapHours) * time.Hour)
+
+	for attempt := 1; ; attempt++ {
+		predecessor, err := b.store.GetBinding(successor.PredecessorBindingID)
+		if err != nil {
+			logf(ctx, "Warning: could not schedule key deactivation of binding %s: %v", successor.PredecessorBindingID, err)
+			return
+		}
+		if predecessor == nil {
+			// Already unbound, and its credentials revoked
+			return
+		}
+
+		predecessor.SuccessorBindingID = successor.ID
+		// Bindings to the admin credentials of a dedicated cluster have no
+		// key of their own to deactivate
+		if predecessor.IAMUserName != "" && (predecessor.KeyDeactivateAt == nil || deactivateAt.Before(*predecessor.KeyDeactivateAt)) {
+			predecessor.KeyDeactivateAt = &deactivateAt
+		}
+		err = b.store.SaveBinding(predecessor)
+		if err == nil {
+			logf(ctx, "Binding %s: credentials rotated to binding %s", predecessor.ID, successor.ID)
+			if predecessor.KeyDeactivateAt != nil {
+				logf(ctx, "Binding %s: access key %s valid until %s", predecessor.ID, predecessor.AccessKey,
+					predecessor.KeyDeactivateAt.UTC().Format(time.RFC3339))
+			}
+			return
+		}
+		if !store.IsConflict(err) || attempt >= maxConflictRetries {
+			logf(ctx, "Warning: could not schedule key deactivation of binding %s: %v", predecessor.ID, err)
+			return
+		}
+	}
+}
+
+// deactivateAccessKey disables the access key of a binding. Where IAM does
+// not support deactivating keys, the key is deleted instead.
+func (b *Broker) deactivateAccessKey(ctx context.Context, instance *store.ServiceInstance, binding *store.ServiceBinding) error {
+	if binding.IAMUserName == "" || binding.AccessKey == "" {
+		return nil
+	}
+
+	iamClient := b.instanceIAMClient(instance)
+	if iamClient == nil {
+		return fmt.Errorf("no IAM client available for instance %s", instance.ID)
+	}
+	iamClient = iamClient.WithRequestID(requestIdentity(ctx))
+
+	err := iamClient.UpdateAccessKey(binding.IAMUserName, binding.AccessKey, "Inactive")
+	if err == nil {
+		return nil
+	}
+	logf(ctx, "Binding %s: could not deactivate access key, deleting it instead: %v", binding.ID, err)
+	return iamClient.DeleteAccessKey(binding.IAMUserName, binding.AccessKey)
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+func TestInheritScope(t *testing.T) {
+	read, write, admin := permissionRead, permissionWrite, permissionAdmin
+	prefix := "reports/"
+	predecessor := &store.ServiceBinding{
+		Permissions: permissionRead,
+		Prefix:      "logs/",
+		Buckets:     []string{"logs"},
+	}
+	tests := []struct {
+		name        string
+		predecessor *store.ServiceBinding
+		params      bindingParameters
+		want        bindingParameters
+	}{
+		{
+			name:        "inherits the whole scope",
+			predecessor: predecessor,
+			want:        bindingParameters{Permissions: &read, Prefix: &predecessor.Prefix, Buckets: []string{"logs"}},
+		},
+		{
+			name:        "explicit parameters win",
+			predecessor: predecessor,
+			params:      bindingParameters{Permissions: &write, Prefix: &prefix, Buckets: []string{"default"}},
+			want:        bindingParameters{Permissions: &write, Prefix: &prefix, Buckets: []string{"default"}},
+		},
+		{
+			name:        "other parameters keep the scope",
+			predecessor: predecessor,
+			params:      bindingParameters{TTLHours: new(int)},
+			want:        bindingParameters{TTLHours: new(int), Permissions: &read, Prefix: &predecessor.Prefix, Buckets: []string{"logs"}},
+		},
+		{
+			name:        "unscoped binding from before permissions were recorded",
+			predecessor: &store.ServiceBinding{},
+			want:        bindingParameters{Permissions: &admin},
+		},
+	}
+	for _, test := range tests {
+		params := test.params
+		inheritScope(&params, test.predecessor)
+		if !reflect.DeepEqual(params, test.want) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.want, params)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeS3 answers the S3 API calls the broker makes on the shared cluster.
+// Buckets hold object sizes by key, without versions.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]int64
+	policies map[string]string
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{
+		buckets:  make(map[string]map[string]int64),
+		policies: make(map[string]string),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// client returns a minio client for the fake
+func (f *fakeS3) client(t *testing.T) *minio.Client {
+	t.Helper()
+	client, err := minio.New(strings.TrimPrefix(f.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("admin", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("minio.New: %v", err)
+	}
+	return client
+}
+
+// put stores an object, creating its bucket
+func (f *fakeS3) put(bucket, key string, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = make(map[string]int64)
+	}
+	if key != "" {
+		f.buckets[bucket][key] = size
+	}
+}
+
+func (f *fakeS3) exists(bucket string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buckets[bucket] != nil
+}
+
+func (f *fakeS3) policy(bucket string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.policies[bucket]
+}
+
+func s3Error(w http.ResponseWriter, status int, code, bucket string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message><BucketName>%s</BucketName></Error>`, code, code, bucket)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	objects := f.buckets[bucket]
+	if objects == nil && !(r.Method == http.MethodPut && key == "" && len(query) == 0) {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && key == "" && query.Has("policy"):
+		body, _ := io.ReadAll(r.Body)
+		f.policies[bucket] = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && key == "" && query.Has("policy"):
+		delete(f.policies, bucket)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && key == "":
+		if objects != nil {
+			s3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", bucket)
+			return
+		}
+		f.buckets[bucket] = make(map[string]int64)
+	case r.Method == http.MethodDelete && key == "":
+		if len(objects) > 0 {
+			s3Error(w, http.StatusConflict, "BucketNotEmpty", bucket)
+			return
+		}
+		delete(f.buckets, bucket)
+		delete(f.policies, bucket)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && key == "":
+		keys := make([]string, 0, len(objects))
+		for k := range objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.Header().Set("Content-Type", "application/xml")
+		if query.Has("versions") {
+			fmt.Fprintf(w, `<ListVersionsResult><Name>%s</Name><IsTruncated>false</IsTruncated>`, bucket)
+			for _, k := range keys {
+				fmt.Fprintf(w, `<Version><Key>%s</Key><VersionId>null</VersionId><IsLatest>true</IsLatest><Size>%d</Size>`+
+					`<LastModified>2024-01-01T00:00:00.000Z</LastModified></Version>`, k, objects[k])
+			}
+			fmt.Fprint(w, `</ListVersionsResult>`)
+			return
+		}
+		fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>`, bucket, len(keys))
+		for _, k := range keys {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>2024-01-01T00:00:00.000Z</LastModified></Contents>`, k, objects[k])
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", bucket)
+	}
+}
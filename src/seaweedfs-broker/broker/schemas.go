@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+)
+
+// planSchemas returns the schemas a plan's requests are validated against:
+// the configured ones, with the bucket parameters as the default instance
+// schemas and the bind parameters as the default binding schema
+func planSchemas(plan *config.PlanConfig) config.PlanSchemas {
+	var schemas config.PlanSchemas
+	if plan.Schemas != nil {
+		schemas = *plan.Schemas
+	}
+	if schemas.BindingCreate == nil {
+		schemas.BindingCreate = bindingParametersSchema(plan)
+	}
+	if schemas.InstanceCreate == nil {
+		schemas.InstanceCreate = bucketParametersSchema(plan)
+	}
+	if schemas.InstanceUpdate == nil {
+		schemas.InstanceUpdate = bucketParametersSchema(plan)
+	}
+	return schemas
+}
+
+// catalogSchemas returns the schemas object of a plan's catalog entry, or
+// nil if the plan has none
+func catalogSchemas(plan *config.PlanConfig) map[string]any {
+	schemas := planSchemas(plan)
+	parameters := func(schema map[string]any) map[string]any {
+		return map[string]any{"parameters": withSchemaVersion(schema)}
+	}
+
+	result := make(map[string]any)
+	instance := make(map[string]any)
+	if schemas.InstanceCreate != nil {
+		instance["create"] = parameters(schemas.InstanceCreate)
+	}
+	if schemas.InstanceUpdate != nil {
+		instance["update"] = parameters(schemas.InstanceUpdate)
+	}
+	if len(instance) > 0 {
+		result["service_instance"] = instance
+	}
+	if schemas.BindingCreate != nil {
+		result["service_binding"] = map[string]any{
+			"create": parameters(schemas.BindingCreate),
+		}
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// withSchemaVersion returns schema with $schema set, which the OSB spec
+// requires of published schemas
+func withSchemaVersion(schema map[string]any) map[string]any {
+	if _, ok := schema["$schema"]; ok {
+		return schema
+	}
+	c := make(map[string]any, len(schema)+1)
+	for k, v := range schema {
+		c[k] = v
+	}
+	c["$schema"] = jsonSchemaDraft04
+	return c
+}
+
+// validateParameters checks request parameters against a schema. A nil
+// schema accepts any parameters.
+func validateParameters(schema map[string]any, params map[string]any) error {
+	if schema == nil {
+		return nil
+	}
+	var value any = params
+	if params == nil {
+		value = map[string]any{}
+	}
+	problems := validateSchema(schema, value, "parameters")
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid parameters: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// Access levels of bindings, and values of the shared_access instance
+// parameter
+const (
+	accessReadOnly  = "read-only"
+	accessReadWrite = "read-write"
+)
+
+// sharedAccessSchema describes the shared_access instance parameter
+func sharedAccessSchema() map[string]any {
+	return map[string]any{
+		"type":        "string",
+		"enum":        []any{accessReadOnly, accessReadWrite},
+		"description": "Access granted to bindings from spaces the instance is shared with (default read-only)",
+	}
+}
+
+// parseSharedAccess validates a shared_access parameter value
+func parseSharedAccess(value any) (string, error) {
+	access, ok := value.(string)
+	if !ok || (access != accessReadOnly && access != accessReadWrite) {
+		return "", fmt.Errorf("shared_access must be %q or %q", accessReadOnly, accessReadWrite)
+	}
+	return access, nil
+}
+
+// sharedAccess returns the access granted to bindings from spaces an
+// instance is shared with
+func sharedAccess(instance *store.ServiceInstance) string {
+	if access, _ := instance.Parameters["shared_access"].(string); access == accessReadWrite {
+		return accessReadWrite
+	}
+	return accessReadOnly
+}
+
+// bindSpaceGUID returns the space a bind request comes from, preferring
+// bind_resource over the request context
+func bindSpaceGUID(req *BindRequest) string {
+	if guid, ok := req.BindResource["space_guid"].(string); ok && guid != "" {
+		return guid
+	}
+	guid, _ := req.Context["space_guid"].(string)
+	return guid
+}
+
+// bindingAccess returns the access of a new binding. Bindings from the
+// instance's own space get read-write access; bindings from spaces the
+// instance was shared with get the instance's shared_access.
+func bindingAccess(instance *store.ServiceInstance, binding *store.ServiceBinding) string {
+	if binding.SpaceGUID == "" || instance.SpaceGUID == "" || binding.SpaceGUID == instance.SpaceGUID {
+		return accessReadWrite
+	}
+	return sharedAccess(instance)
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// exportStateHandler returns the complete broker state as a store.Export
+// document. Secrets are returned as stored, so they stay encrypted when
+// state store encryption is enabled.
+func (b *Broker) exportStateHandler(w http.ResponseWriter, r *http.Request) {
+	exp, err := store.ExportState(b.store)
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+	b.writeJSON(w, http.StatusOK, exp)
+}
+
+// importStateHandler loads a store.Export document into the state store.
+// Query parameters dry_run=true and overwrite=true map to
+// store.ImportOptions.
+func (b *Broker) importStateHandler(w http.ResponseWriter, r *http.Request) {
+	var exp store.Export
+	if err := json.NewDecoder(r.Body).Decode(&exp); err != nil {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "Invalid JSON body")
+		return
+	}
+
+	opts := store.ImportOptions{
+		DryRun:    r.URL.Query().Get("dry_run") == "true",
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+	}
+	report, err := store.ImportState(b.store, &exp, opts)
+	switch {
+	case errors.Is(err, store.ErrInvalidExport):
+		b.writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":       "InvalidExport",
+			"description": err.Error(),
+			"report":      report,
+		})
+	case store.IsConflict(err):
+		b.writeJSON(w, http.StatusConflict, map[string]any{
+			"error":       "ImportConflict",
+			"description": err.Error(),
+			"report":      report,
+		})
+	case err != nil:
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+	default:
+		b.writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,378 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+	"github.com/gorilla/mux"
+)
+
+func (b *Broker) updateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+
+	instance, err := b.store.GetInstance(instanceID)
+	if err != nil {
+		b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+		return
+	}
+	if instance == nil || instance.Tombstoned() {
+		b.writeError(w, http.StatusNotFound, "InstanceNotFound", "Service instance not found")
+		return
+	}
+
+	var req UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "Invalid JSON body")
+		return
+	}
+	if req.ServiceID != "" && req.ServiceID != instance.ServiceID {
+		b.writeError(w, http.StatusBadRequest, "BadRequest", "service_id does not match the service instance")
+		return
+	}
+
+	currentPlan := b.findPlan(instance.ServiceID, instance.PlanID)
+	if currentPlan == nil {
+		b.writeError(w, http.StatusInternalServerError, "PlanNotFound",
+			fmt.Sprintf("Plan %s not found for service %s", instance.PlanID, instance.ServiceID))
+		return
+	}
+	plan := currentPlan
+	if req.PlanID != "" && req.PlanID != instance.PlanID {
+		plan = b.findPlan(instance.ServiceID, req.PlanID)
+		if plan == nil {
+			b.writeError(w, http.StatusBadRequest, "InvalidPlan", "Unknown plan ID")
+			return
+		}
+		if err := checkPlanChange(currentPlan, plan); err != nil {
+			b.writeError(w, http.StatusUnprocessableEntity, "PlanChangeNotSupported", err.Error())
+			return
+		}
+	}
+
+	if len(req.Parameters) > 0 {
+		if err := validateParameters(planSchemas(plan).InstanceUpdate, req.Parameters); err != nil {
+			b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+			return
+		}
+	}
+
+	if err := b.checkMaintenanceInfo(plan, req.MaintenanceInfo); err != nil {
+		b.writeError(w, http.StatusUnprocessableEntity, "MaintenanceInfoConflict", err.Error())
+		return
+	}
+
+	// A retry while the update runs joins it instead of starting another
+	if instance.State == "updating" && retriesUpdate(instance, plan, &req) {
+		if r.URL.Query().Get("accepts_incomplete") != "true" {
+			b.writeError(w, http.StatusUnprocessableEntity, "AsyncRequired",
+				"This plan requires asynchronous updates")
+			return
+		}
+		b.writeJSON(w, http.StatusAccepted, map[string]any{
+			"operation": "update",
+		})
+		return
+	}
+
+	if instance.State != "succeeded" && instance.State != "failed" {
+		b.writeError(w, http.StatusUnprocessableEntity, "ConcurrencyError",
+			"Another operation for this service instance is in progress")
+		return
+	}
+
+	if req.Context != nil {
+		instance.Context = req.Context
+	}
+
+	if plan.PlanType == PlanTypeShared {
+		b.updateSharedInstance(w, r, instance, plan, &req)
+	} else {
+		b.updateDedicatedInstance(w, r, instance, plan, &req)
+	}
+}
+
+// retriesUpdate reports whether req repeats the update in progress: it asks
+// for the same plan, for an upgrade if the update is one, and changes no
+// parameters
+func retriesUpdate(instance *store.ServiceInstance, plan *config.PlanConfig, req *UpdateRequest) bool {
+	if instance.UpdatePlanID == "" || plan.ID != instance.UpdatePlanID {
+		return false
+	}
+	if plan.ID == instance.PlanID && req.MaintenanceInfo == nil {
+		return false
+	}
+	return len(req.Parameters) == 0 || reflect.DeepEqual(mergeParameters(instance.Parameters, req.Parameters), instance.Parameters)
+}
+
+// parseBucketUpdate validates the parameters of an update request and
+// returns the complete bucket configuration after the update
+func parseBucketUpdate(instance *store.ServiceInstance, params map[string]any) (*bucketParameters, error) {
+	update, err := parseBucketParameters(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBucketUpdate(instance.Parameters, update); err != nil {
+		return nil, err
+	}
+	return parseBucketParameters(mergeParameters(instance.Parameters, params))
+}
+
+// updateSharedInstance applies parameter changes to the buckets of a shared
+// instance synchronously. The buckets are reconciled with all of the
+// instance's parameters, not only those in the request. A changed buckets
+// list creates and deletes buckets and rewrites the policies of the
+// bindings to match.
+func (b *Broker) updateSharedInstance(w http.ResponseWriter, r *http.Request, instance *store.ServiceInstance, plan *config.PlanConfig, req *UpdateRequest) {
+	params, err := parseBucketUpdate(instance, req.Parameters)
+	if err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+	if b.s3Client == nil {
+		b.writeError(w, http.StatusInternalServerError, "UpdateError", "shared cluster not configured")
+		return
+	}
+	_, bucketsUpdated := req.Parameters["buckets"]
+	if bucketsUpdated {
+		bindings, err := b.store.ListBindingsForInstance(instance.ID)
+		if err != nil {
+			b.writeError(w, http.StatusInternalServerError, "StoreError", err.Error())
+			return
+		}
+		if err := checkBucketRemoval(bindings, params.Buckets); err != nil {
+			b.writeError(w, http.StatusUnprocessableEntity, "BucketInUse", err.Error())
+			return
+		}
+	}
+
+	op := b.startOperation(r, store.OperationUpdate, instance.ID, "")
+	ctx := operationContext(op)
+	if bucketsUpdated {
+		if err := b.reconcileBuckets(ctx, instance, params.Buckets, params); err != nil {
+			// Record the buckets created or deleted before the failure
+			if saveErr := b.store.SaveInstance(instance); saveErr != nil {
+				logf(r.Context(), "Warning: could not record buckets of instance %s: %v", instance.ID, saveErr)
+			} else if refreshErr := b.refreshBindingPolicies(r.Context(), instance); refreshErr != nil {
+				logf(r.Context(), "Warning: could not update binding policies of instance %s: %v", instance.ID, refreshErr)
+			}
+			b.finishOperation(op, err)
+			switch {
+			case errors.Is(err, errBucketNotEmpty):
+				b.writeError(w, http.StatusUnprocessableEntity, "BucketNotEmpty", err.Error())
+			case errors.Is(err, errBucketNameTaken):
+				b.writeError(w, http.StatusUnprocessableEntity, "BucketNameTaken", err.Error())
+			default:
+				b.writeError(w, http.StatusInternalServerError, "UpdateError", err.Error())
+			}
+			return
+		}
+	}
+	if len(req.Parameters) > 0 {
+		if err := b.configureSharedBuckets(ctx, instance, params); err != nil {
+			b.finishOperation(op, err)
+			b.writeError(w, http.StatusInternalServerError, "UpdateError", err.Error())
+			return
+		}
+	}
+
+	instance.PlanID = plan.ID
+	instance.Parameters = mergeParameters(instance.Parameters, req.Parameters)
+	instance.State = "succeeded"
+	instance.StateMessage = ""
+	if err := b.store.SaveInstance(instance); err != nil {
+		b.finishOperation(op, err)
+		b.writeStoreError(w, err)
+		return
+	}
+
+	// Retried on every update that lists the buckets, so a failure here is
+	// repaired by repeating the update
+	if bucketsUpdated {
+		if err := b.refreshBindingPolicies(r.Context(), instance); err != nil {
+			b.finishOperation(op, err)
+			b.writeError(w, http.StatusInternalServerError, "UpdateError",
+				fmt.Sprintf("buckets were updated, but the policies of existing bindings were not: %v", err))
+			return
+		}
+	}
+
+	b.finishOperation(op, nil)
+	b.writeJSON(w, http.StatusOK, map[string]any{})
+}
+
+// updateDedicatedInstance starts a redeployment of a dedicated cluster with
+// the manifest of its new plan, or of its current plan if the request asks
+// for a newer maintenance_info version. Parameters configure the cluster's
+// default bucket and take effect without a redeployment.
+func (b *Broker) updateDedicatedInstance(w http.ResponseWriter, r *http.Request, instance *store.ServiceInstance, plan *config.PlanConfig, req *UpdateRequest) {
+	params, err := parseBucketUpdate(instance, req.Parameters)
+	if err != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+	if params.Buckets != nil {
+		b.writeError(w, http.StatusBadRequest, "InvalidParameters", "invalid parameters: buckets is only supported by shared plans")
+		return
+	}
+
+	// Every precondition is checked before the bucket is touched, so a
+	// rejected request leaves no partial changes behind
+	upgrade := req.MaintenanceInfo != nil && req.MaintenanceInfo.Version != instance.MaintenanceVersion
+	redeploy := plan.ID != instance.PlanID || upgrade
+	if redeploy {
+		if r.URL.Query().Get("accepts_incomplete") != "true" {
+			b.writeError(w, http.StatusUnprocessableEntity, "AsyncRequired",
+				"This plan requires asynchronous updates")
+			return
+		}
+		if b.boshClient == nil {
+			b.writeError(w, http.StatusInternalServerError, "BOSHNotConfigured", "BOSH director not configured")
+			return
+		}
+	}
+
+	if len(req.Parameters) > 0 {
+		if params.configuresBucket() {
+			target, err := b.dedicatedBucket(instance)
+			if err == nil {
+				err = applyBucketParameters(context.Background(), target, params)
+			}
+			if err != nil {
+				b.writeError(w, http.StatusInternalServerError, "UpdateError", err.Error())
+				return
+			}
+		}
+		instance.Parameters = mergeParameters(instance.Parameters, req.Parameters)
+	}
+
+	if !redeploy {
+		// Nothing to redeploy; only the context or parameters may have changed
+		if len(req.Parameters) > 0 {
+			op := b.startOperation(r, store.OperationUpdate, instance.ID, "")
+			err := b.store.SaveInstance(instance)
+			b.finishOperation(op, err)
+			if err != nil {
+				b.writeStoreError(w, err)
+				return
+			}
+		} else if req.Context != nil {
+			if err := b.store.SaveInstance(instance); err != nil {
+				b.writeStoreError(w, err)
+				return
+			}
+		}
+		b.writeJSON(w, http.StatusOK, map[string]any{})
+		return
+	}
+
+	opType := store.OperationUpdate
+	instance.State = "updating"
+	instance.UpdatePlanID = plan.ID
+	instance.StateMessage = fmt.Sprintf("Updating to plan %s", plan.Name)
+	if plan.ID == instance.PlanID {
+		opType = store.OperationUpgrade
+		instance.StateMessage = fmt.Sprintf("Upgrading to %s", req.MaintenanceInfo.Version)
+	}
+	if err := b.store.SaveInstance(instance); err != nil {
+		b.writeStoreError(w, err)
+		return
+	}
+
+	op := b.startOperation(r, opType, instance.ID, "")
+	go b.updateDedicatedCluster(instance, plan, op)
+	b.writeJSON(w, http.StatusAccepted, map[string]any{
+		"operation": "update",
+	})
+}
+
+// updateDedicatedCluster redeploys a dedicated cluster with the manifest of
+// plan. The instance keeps its previous plan ID until the deployment succeeds.
+func (b *Broker) updateDedicatedCluster(instance *store.ServiceInstance, plan *config.PlanConfig, op *store.Operation) {
+	ctx := operationContext(op)
+	plan = b.resolvePlanAZs(ctx, plan)
+	manifest := b.generateDedicatedManifest(instance, plan)
+	logf(ctx, "Updating deployment %s to plan %s", instance.DeploymentName, plan.Name)
+
+	task, err := b.boshClient.Deploy(manifest, op.RequestIdentity)
+	if err != nil {
+		b.failOperation(instance, op, "updating", fmt.Sprintf("Failed to start deployment: %v", err))
+		return
+	}
+	b.recordTask(op, task.ID)
+
+	instance.StateMessage = fmt.Sprintf("Update started, task ID: %d", task.ID)
+	if err := b.saveOperationState(ctx, instance, "updating"); err != nil {
+		logf(ctx, "Instance %s: stopping update: %v", instance.ID, err)
+		b.finishOperation(op, err)
+		return
+	}
+
+	task, err = b.boshClient.WaitForTask(task.ID, 30*time.Minute)
+	if err != nil {
+		b.failOperation(instance, op, "updating", fmt.Sprintf("Update failed: %v", err))
+		return
+	}
+
+	// Recreated VMs may have new addresses
+	b.discoverDedicatedEndpoints(ctx, instance, plan)
+
+	instance.PlanID = plan.ID
+	instance.UpdatePlanID = ""
+	if info := b.planMaintenanceInfo(plan); info != nil {
+		instance.MaintenanceVersion = info.Version
+	}
+	instance.State = "succeeded"
+	instance.StateMessage = "Update complete"
+	if err := b.saveOperationState(ctx, instance, "updating"); err != nil {
+		logf(ctx, "Instance %s: could not record completed update: %v", instance.ID, err)
+		b.finishOperation(op, err)
+		return
+	}
+	b.finishOperation(op, nil)
+
+	logf(ctx, "Updated deployment %s to plan %s (task %d)", instance.DeploymentName, plan.Name, task.ID)
+}
+
+// checkPlanChange returns an error explaining why an instance cannot move
+// from one plan to another, or nil if the move is supported
+func checkPlanChange(from, to *config.PlanConfig) error {
+	if from.PlanType != to.PlanType {
+		return fmt.Errorf("cannot change from a %s plan to a %s plan: the data would have to move to a different cluster",
+			from.PlanType, to.PlanType)
+	}
+	if from.PlanType != PlanTypeDedicated {
+		return nil
+	}
+
+	fromCfg, toCfg := from.DedicatedConfig, to.DedicatedConfig
+	if fromCfg == nil || toCfg == nil {
+		return fmt.Errorf("plan %s or %s has no dedicated cluster configuration", from.Name, to.Name)
+	}
+	if toCfg.MasterNodes != fromCfg.MasterNodes {
+		return fmt.Errorf("cannot change the number of master nodes from %d to %d: the master Raft cluster cannot be resized in place",
+			fromCfg.MasterNodes, toCfg.MasterNodes)
+	}
+	if toCfg.VolumeNodes < fromCfg.VolumeNodes {
+		return fmt.Errorf("cannot reduce volume nodes from %d to %d: removed volume servers would take their data with them",
+			fromCfg.VolumeNodes, toCfg.VolumeNodes)
+	}
+	if toCfg.FilerNodes < fromCfg.FilerNodes {
+		return fmt.Errorf("cannot reduce filer nodes from %d to %d", fromCfg.FilerNodes, toCfg.FilerNodes)
+	}
+	if toCfg.Replication != fromCfg.Replication {
+		return fmt.Errorf("cannot change replication from %s to %s: existing volumes keep the replication they were created with",
+			fromCfg.Replication, toCfg.Replication)
+	}
+	if toCfg.Network != fromCfg.Network {
+		return fmt.Errorf("cannot move the cluster from network %s to %s", fromCfg.Network, toCfg.Network)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudfoundry/seaweedfs-broker/broker"
+	"github.com/cloudfoundry/seaweedfs-broker/config"
+	"github.com/cloudfoundry/seaweedfs-broker/store"
+)
+
+// runCommand runs a maintenance subcommand instead of the broker server.
+// With the file state store, stop the broker before importing: both
+// processes would otherwise write state.json.
+func runCommand(cfg *config.Config, name string, args []string) error {
+	switch name {
+	case "export":
+		return exportCommand(cfg, args)
+	case "import":
+		return importCommand(cfg, args)
+	default:
+		return fmt.Errorf("unknown command %q, expected export or import", name)
+	}
+}
+
+// exportCommand writes the state store to a store.Export document
+func exportCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("output", "-", "file to write the export to, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	stateStore, err := broker.OpenStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	exp, err := store.ExportState(stateStore)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(exp, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *output == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0600)
+}
+
+// importCommand loads a store.Export document into the state store and
+// prints the import report
+func importCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "validate and report without writing")
+	overwrite := flags.Bool("overwrite", false, "replace records that already exist")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import [-dry-run] [-overwrite] <file|->")
+	}
+
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	var exp store.Export
+	if err := json.Unmarshal(data, &exp); err != nil {
+		return fmt.Errorf("invalid export document: %w", err)
+	}
+
+	stateStore, err := broker.OpenStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	report, importErr := store.ImportState(stateStore, &exp, store.ImportOptions{
+		DryRun:    *dryRun,
+		Overwrite: *overwrite,
+	})
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return importErr
+}
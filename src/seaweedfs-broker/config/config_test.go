@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadYAML(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoadOrphanMitigationAttempts(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    int
+		wantErr bool
+	}{
+		{yaml: `{}`, want: 3},
+		{yaml: `bosh: {orphan_mitigation: {max_attempts: 1}}`, want: 1},
+		{yaml: `bosh: {orphan_mitigation: {max_attempts: -1}}`, wantErr: true},
+	}
+	for _, test := range tests {
+		cfg, err := loadYAML(t, test.yaml)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got max_attempts %d", test.yaml, cfg.BOSH.OrphanMitigation.MaxAttempts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Load: %v", test.yaml, err)
+		}
+		if got := cfg.BOSH.OrphanMitigation.MaxAttempts; got != test.want {
+			t.Errorf("%s: expected max_attempts %d, got %d", test.yaml, test.want, got)
+		}
+	}
+}
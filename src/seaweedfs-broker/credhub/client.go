@@ -152,6 +152,59 @@ func (c *Client) SetJSON(path string, value map[string]interface{}) error {
 	return nil
 }
 
+// GetJSON reads the current value of a JSON credential from CredHub.
+func (c *Client) GetJSON(path string) (map[string]interface{}, error) {
+	if err := c.authenticate(); err != nil {
+		return nil, err
+	}
+
+	reqURL := c.apiURL + "/api/v1/data?current=true&name=" + url.QueryEscape(path)
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("credhub: failed to create get request: %w", err)
+	}
+
+	c.mu.Lock()
+	token := c.accessToken
+	c.mu.Unlock()
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("credhub: get request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("credhub: failed to read get response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("credhub: get credential returned %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		Data []struct {
+			Type  string                 `json:"type"`
+			Value map[string]interface{} `json:"value"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("credhub: failed to parse get response: %w", err)
+	}
+
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("credhub: credential %s not found", path)
+	}
+	if result.Data[0].Type != "json" {
+		return nil, fmt.Errorf("credhub: credential %s has type %s, expected json", path, result.Data[0].Type)
+	}
+
+	return result.Data[0].Value, nil
+}
+
 // Delete removes a credential by name from CredHub.
 func (c *Client) Delete(path string) error {
 	if err := c.authenticate(); err != nil {
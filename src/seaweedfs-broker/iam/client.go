@@ -2,12 +2,15 @@ package iam
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -23,6 +26,10 @@ type Client struct {
 	region     string
 	useSSL     bool
 	httpClient *http.Client
+
+	// requestID is sent with every call so IAM requests can be correlated
+	// with the broker request that caused them
+	requestID string
 }
 
 // NewClient creates a new IAM client
@@ -47,6 +54,24 @@ func NewClient(endpoint, accessKey, secretKey, region string, useSSL bool) *Clie
 	}
 }
 
+// WithRequestID returns a copy of the client that sends requestID in the
+// X-Request-Id header of every call
+func (c *Client) WithRequestID(requestID string) *Client {
+	clone := *c
+	clone.requestID = requestID
+	return &clone
+}
+
+// logf logs a message, prefixed with the request ID of the client like the
+// broker's own request logs
+func (c *Client) logf(format string, args ...any) {
+	if c.requestID == "" {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[request=%s] %s", c.requestID, fmt.Sprintf(format, args...))
+}
+
 // AccessKey represents an IAM access key
 type AccessKey struct {
 	UserName        string
@@ -86,14 +111,14 @@ func (c *Client) CreateUser(userName string) error {
 	params.Set("UserName", userName)
 	params.Set("Version", "2010-05-08")
 
-	log.Printf("IAM: Creating user %s at endpoint %s", userName, c.endpoint)
+	c.logf("IAM: Creating user %s at endpoint %s", userName, c.endpoint)
 
 	_, err := c.doRequest(params)
 	if err != nil {
 		return fmt.Errorf("CreateUser failed: %w", err)
 	}
 
-	log.Printf("IAM: Created user %s", userName)
+	c.logf("IAM: Created user %s", userName)
 	return nil
 }
 
@@ -104,7 +129,7 @@ func (c *Client) DeleteUser(userName string) error {
 	params.Set("UserName", userName)
 	params.Set("Version", "2010-05-08")
 
-	log.Printf("IAM: Deleting user %s", userName)
+	c.logf("IAM: Deleting user %s", userName)
 
 	_, err := c.doRequest(params)
 	if err != nil {
@@ -114,6 +139,75 @@ func (c *Client) DeleteUser(userName string) error {
 	return nil
 }
 
+// User is an IAM user
+type User struct {
+	UserName string `xml:"UserName"`
+	UserID   string `xml:"UserId"`
+	Arn      string `xml:"Arn"`
+	Path     string `xml:"Path"`
+	// CreateDate is in RFC 3339 format; SeaweedFS leaves it empty
+	CreateDate string `xml:"CreateDate"`
+}
+
+// GetUserResponse is the XML response from GetUser
+type GetUserResponse struct {
+	XMLName xml.Name `xml:"GetUserResponse"`
+	Result  struct {
+		User User `xml:"User"`
+	} `xml:"GetUserResult"`
+}
+
+// ListUsersResponse is the XML response from ListUsers
+type ListUsersResponse struct {
+	XMLName xml.Name `xml:"ListUsersResponse"`
+	Result  struct {
+		Users       []User `xml:"Users>member"`
+		IsTruncated bool   `xml:"IsTruncated"`
+		Marker      string `xml:"Marker"`
+	} `xml:"ListUsersResult"`
+}
+
+// GetUser returns an IAM user. A missing user is an error for which
+// IsNoSuchEntity is true.
+func (c *Client) GetUser(userName string) (*User, error) {
+	params := url.Values{}
+	params.Set("Action", "GetUser")
+	params.Set("UserName", userName)
+	params.Set("Version", "2010-05-08")
+
+	body, err := c.doRequest(params)
+	if err != nil {
+		return nil, fmt.Errorf("GetUser failed: %w", err)
+	}
+
+	var resp GetUserResponse
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse GetUser response: %w (body: %s)", err, string(body))
+	}
+	return &resp.Result.User, nil
+}
+
+// ListUsers returns all IAM users
+func (c *Client) ListUsers() ([]User, error) {
+	params := url.Values{}
+	params.Set("Action", "ListUsers")
+	params.Set("Version", "2010-05-08")
+
+	users := make([]User, 0)
+	err := c.listAll(params, func(body []byte) (bool, string, error) {
+		var resp ListUsersResponse
+		if err := xml.Unmarshal(body, &resp); err != nil {
+			return false, "", fmt.Errorf("failed to parse ListUsers response: %w (body: %s)", err, string(body))
+		}
+		users = append(users, resp.Result.Users...)
+		return resp.Result.IsTruncated, resp.Result.Marker, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListUsers failed: %w", err)
+	}
+	return users, nil
+}
+
 // CreateAccessKey creates a new access key for the specified user.
 // The user must already exist (call CreateUser first).
 func (c *Client) CreateAccessKey(userName string) (*AccessKey, error) {
@@ -122,7 +216,7 @@ func (c *Client) CreateAccessKey(userName string) (*AccessKey, error) {
 	params.Set("UserName", userName)
 	params.Set("Version", "2010-05-08")
 
-	log.Printf("IAM: Creating access key for user %s at endpoint %s", userName, c.endpoint)
+	c.logf("IAM: Creating access key for user %s at endpoint %s", userName, c.endpoint)
 
 	body, err := c.doRequest(params)
 	if err != nil {
@@ -134,7 +228,7 @@ func (c *Client) CreateAccessKey(userName string) (*AccessKey, error) {
 		return nil, fmt.Errorf("failed to parse CreateAccessKey response: %w (body: %s)", err, string(body))
 	}
 
-	log.Printf("IAM: Created access key %s for user %s", resp.Result.AccessKey.AccessKeyId, userName)
+	c.logf("IAM: Created access key %s for user %s", resp.Result.AccessKey.AccessKeyId, userName)
 
 	return &AccessKey{
 		UserName:        resp.Result.AccessKey.UserName,
@@ -152,7 +246,7 @@ func (c *Client) DeleteAccessKey(userName, accessKeyID string) error {
 	params.Set("AccessKeyId", accessKeyID)
 	params.Set("Version", "2010-05-08")
 
-	log.Printf("IAM: Deleting access key %s for user %s", accessKeyID, userName)
+	c.logf("IAM: Deleting access key %s for user %s", accessKeyID, userName)
 
 	_, err := c.doRequest(params)
 	if err != nil {
@@ -162,29 +256,242 @@ func (c *Client) DeleteAccessKey(userName, accessKeyID string) error {
 	return nil
 }
 
-// PutUserPolicy attaches a policy to a user to grant bucket access
-func (c *Client) PutUserPolicy(userName, policyName, bucketName string) error {
-	policy := fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:*"],"Resource":["arn:aws:s3:::%s","arn:aws:s3:::%s/*"]}]}`, bucketName, bucketName)
+// UpdateAccessKey sets the status of an access key to Active or Inactive
+func (c *Client) UpdateAccessKey(userName, accessKeyID, status string) error {
+	params := url.Values{}
+	params.Set("Action", "UpdateAccessKey")
+	params.Set("UserName", userName)
+	params.Set("AccessKeyId", accessKeyID)
+	params.Set("Status", status)
+	params.Set("Version", "2010-05-08")
+
+	c.logf("IAM: Setting access key %s for user %s to %s", accessKeyID, userName, status)
+
+	_, err := c.doRequest(params)
+	if err != nil {
+		return fmt.Errorf("UpdateAccessKey failed: %w", err)
+	}
+
+	return nil
+}
+
+// ListAccessKeysResponse is the XML response from ListAccessKeys
+type ListAccessKeysResponse struct {
+	XMLName xml.Name `xml:"ListAccessKeysResponse"`
+	Result  struct {
+		AccessKeyMetadata []struct {
+			UserName    string `xml:"UserName"`
+			AccessKeyId string `xml:"AccessKeyId"`
+			Status      string `xml:"Status"`
+		} `xml:"AccessKeyMetadata>member"`
+		IsTruncated bool   `xml:"IsTruncated"`
+		Marker      string `xml:"Marker"`
+	} `xml:"ListAccessKeysResult"`
+}
+
+// ListAccessKeys returns the access keys of a user, without their secrets
+func (c *Client) ListAccessKeys(userName string) ([]AccessKey, error) {
+	params := url.Values{}
+	params.Set("Action", "ListAccessKeys")
+	params.Set("UserName", userName)
+	params.Set("Version", "2010-05-08")
+
+	keys := make([]AccessKey, 0)
+	err := c.listAll(params, func(body []byte) (bool, string, error) {
+		var resp ListAccessKeysResponse
+		if err := xml.Unmarshal(body, &resp); err != nil {
+			return false, "", fmt.Errorf("failed to parse ListAccessKeys response: %w (body: %s)", err, string(body))
+		}
+		for _, key := range resp.Result.AccessKeyMetadata {
+			keys = append(keys, AccessKey{
+				UserName:    key.UserName,
+				AccessKeyID: key.AccessKeyId,
+				Status:      key.Status,
+			})
+		}
+		return resp.Result.IsTruncated, resp.Result.Marker, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListAccessKeys failed: %w", err)
+	}
+	return keys, nil
+}
+
+// Actions are the S3 actions a policy grants on buckets themselves and on
+// the objects in them
+type Actions struct {
+	Bucket []string
+	Object []string
+}
+
+// Empty reports whether no action is granted
+func (a Actions) Empty() bool {
+	return len(a.Bucket) == 0 && len(a.Object) == 0
+}
+
+// bucketListActions list a bucket's objects without touching its
+// configuration
+var bucketListActions = []string{"s3:ListBucket*", "s3:GetBucketLocation"}
+
+// Bucket access granted by BucketPolicy. Only AdminActions include bucket
+// configuration, such as the bucket policy, versioning or lifecycle rules.
+var (
+	AdminActions     = Actions{Bucket: []string{"s3:*"}, Object: []string{"s3:*"}}
+	ReadWriteActions = Actions{Bucket: bucketListActions, Object: []string{
+		"s3:GetObject*", "s3:PutObject*", "s3:DeleteObject*", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"}}
+	ReadOnlyActions  = Actions{Bucket: bucketListActions, Object: []string{"s3:GetObject*"}}
+	WriteOnlyActions = Actions{Object: []string{"s3:PutObject*", "s3:DeleteObject*", "s3:AbortMultipartUpload"}}
+)
+
+// PolicyDocument is an IAM policy document
+type PolicyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+// PolicyStatement is a statement of an IAM policy document
+type PolicyStatement struct {
+	Effect    string         `json:"Effect"`
+	Action    []string       `json:"Action"`
+	Resource  []string       `json:"Resource"`
+	Condition map[string]any `json:"Condition,omitempty"`
+}
+
+// BucketPolicy returns a policy that grants actions on buckets: bucket
+// actions on the buckets and object actions on their objects. With a prefix,
+// object actions only apply to keys starting with it and bucket actions are
+// not granted at all: SeaweedFS ignores the s3:prefix condition that would
+// limit listing to the prefix, so it would expose the key names of other
+// tenants.
+func BucketPolicy(bucketNames []string, prefix string, actions Actions) PolicyDocument {
+	policy := PolicyDocument{Version: "2012-10-17", Statement: make([]PolicyStatement, 0, 2)}
+
+	if len(actions.Bucket) > 0 && prefix == "" {
+		resources := make([]string, 0, len(bucketNames))
+		for _, bucketName := range bucketNames {
+			resources = append(resources, fmt.Sprintf("arn:aws:s3:::%s", bucketName))
+		}
+		policy.Statement = append(policy.Statement, PolicyStatement{Effect: "Allow", Action: actions.Bucket, Resource: resources})
+	}
+	if len(actions.Object) > 0 {
+		resources := make([]string, 0, len(bucketNames))
+		for _, bucketName := range bucketNames {
+			resources = append(resources, fmt.Sprintf("arn:aws:s3:::%s/%s*", bucketName, prefix))
+		}
+		policy.Statement = append(policy.Statement, PolicyStatement{Effect: "Allow", Action: actions.Object, Resource: resources})
+	}
+	return policy
+}
+
+// PutUserPolicy attaches a policy to a user
+func (c *Client) PutUserPolicy(userName, policyName string, policy PolicyDocument) error {
+	document, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
 
 	params := url.Values{}
 	params.Set("Action", "PutUserPolicy")
 	params.Set("UserName", userName)
 	params.Set("PolicyName", policyName)
-	params.Set("PolicyDocument", policy)
+	params.Set("PolicyDocument", string(document))
 	params.Set("Version", "2010-05-08")
 
-	log.Printf("IAM: Attaching policy %s to user %s for bucket %s", policyName, userName, bucketName)
+	c.logf("IAM: Attaching policy %s to user %s: %s", policyName, userName, document)
 
-	_, err := c.doRequest(params)
+	_, err = c.doRequest(params)
 	if err != nil {
-		log.Printf("Warning: PutUserPolicy failed (may not be supported): %v", err)
-		return nil
+		return fmt.Errorf("PutUserPolicy failed: %w", err)
 	}
 
 	return nil
 }
 
-// DeleteUserPolicy removes a policy from a user
+// GetUserPolicyResponse is the XML response from GetUserPolicy
+type GetUserPolicyResponse struct {
+	XMLName xml.Name `xml:"GetUserPolicyResponse"`
+	Result  struct {
+		UserName       string `xml:"UserName"`
+		PolicyName     string `xml:"PolicyName"`
+		PolicyDocument string `xml:"PolicyDocument"`
+	} `xml:"GetUserPolicyResult"`
+}
+
+// GetUserPolicy returns a policy attached to a user. AWS returns the
+// document URL-encoded and SeaweedFS returns it as is; both are decoded to
+// the document that was put.
+func (c *Client) GetUserPolicy(userName, policyName string) (*PolicyDocument, error) {
+	params := url.Values{}
+	params.Set("Action", "GetUserPolicy")
+	params.Set("UserName", userName)
+	params.Set("PolicyName", policyName)
+	params.Set("Version", "2010-05-08")
+
+	body, err := c.doRequest(params)
+	if err != nil {
+		return nil, fmt.Errorf("GetUserPolicy failed: %w", err)
+	}
+
+	var resp GetUserPolicyResponse
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse GetUserPolicy response: %w (body: %s)", err, string(body))
+	}
+
+	// AWS URL-encodes the document, SeaweedFS does not
+	document := strings.TrimSpace(resp.Result.PolicyDocument)
+	if !strings.HasPrefix(document, "{") {
+		if decoded, err := url.QueryUnescape(document); err == nil {
+			document = decoded
+		}
+	}
+	var policy PolicyDocument
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy document %s of user %s: %w", policyName, userName, err)
+	}
+	return &policy, nil
+}
+
+// Grants returns the statements of a policy as sorted
+// "effect action resource condition" entries, one per action and resource,
+// so that documents differing only in the order or grouping of statements,
+// actions and resources compare equal. Effects, resources and conditions
+// are compared exactly: a bucket ARN does not cover the bucket's objects,
+// and Deny statements count like Allow statements.
+func (p PolicyDocument) Grants() []string {
+	seen := make(map[string]bool)
+	for _, statement := range p.Statement {
+		condition := ""
+		if len(statement.Condition) > 0 {
+			// Map keys are marshaled in sorted order
+			data, err := json.Marshal(statement.Condition)
+			if err != nil {
+				data = []byte(fmt.Sprint(statement.Condition))
+			}
+			condition = " " + string(data)
+		}
+		for _, action := range statement.Action {
+			for _, resource := range statement.Resource {
+				seen[statement.Effect+" "+action+" "+resource+condition] = true
+			}
+		}
+	}
+	grants := make([]string, 0, len(seen))
+	for grant := range seen {
+		grants = append(grants, grant)
+	}
+	sort.Strings(grants)
+	return grants
+}
+
+// Equivalent reports whether two policies have the same statements, up to
+// their order and grouping
+func (p PolicyDocument) Equivalent(other PolicyDocument) bool {
+	return p.Version == other.Version && slices.Equal(p.Grants(), other.Grants())
+}
+
+// DeleteUserPolicy removes a policy from a user. The returned error wraps
+// the *Error of a failed request; a missing policy is an error for which
+// IsNoSuchEntity is true.
 func (c *Client) DeleteUserPolicy(userName, policyName string) error {
 	params := url.Values{}
 	params.Set("Action", "DeleteUserPolicy")
@@ -192,12 +499,67 @@ func (c *Client) DeleteUserPolicy(userName, policyName string) error {
 	params.Set("PolicyName", policyName)
 	params.Set("Version", "2010-05-08")
 
-	_, err := c.doRequest(params)
+	if _, err := c.doRequest(params); err != nil {
+		return fmt.Errorf("DeleteUserPolicy failed: %w", err)
+	}
+	return nil
+}
+
+// ListUserPoliciesResponse is the XML response from ListUserPolicies
+type ListUserPoliciesResponse struct {
+	XMLName xml.Name `xml:"ListUserPoliciesResponse"`
+	Result  struct {
+		PolicyNames []string `xml:"PolicyNames>member"`
+		IsTruncated bool     `xml:"IsTruncated"`
+		Marker      string   `xml:"Marker"`
+	} `xml:"ListUserPoliciesResult"`
+}
+
+// ListUserPolicies returns the names of the policies attached to a user
+func (c *Client) ListUserPolicies(userName string) ([]string, error) {
+	params := url.Values{}
+	params.Set("Action", "ListUserPolicies")
+	params.Set("UserName", userName)
+	params.Set("Version", "2010-05-08")
+
+	names := make([]string, 0)
+	err := c.listAll(params, func(body []byte) (bool, string, error) {
+		var resp ListUserPoliciesResponse
+		if err := xml.Unmarshal(body, &resp); err != nil {
+			return false, "", fmt.Errorf("failed to parse ListUserPolicies response: %w (body: %s)", err, string(body))
+		}
+		names = append(names, resp.Result.PolicyNames...)
+		return resp.Result.IsTruncated, resp.Result.Marker, nil
+	})
 	if err != nil {
-		log.Printf("Warning: DeleteUserPolicy failed: %v", err)
+		return nil, fmt.Errorf("ListUserPolicies failed: %w", err)
 	}
+	return names, nil
+}
 
-	return nil
+// listAll requests every page of a paginated IAM action. page parses one
+// response and returns whether it was truncated and the marker of the next
+// page.
+func (c *Client) listAll(params url.Values, page func(body []byte) (bool, string, error)) error {
+	seen := make(map[string]bool)
+	for {
+		body, err := c.doRequest(params)
+		if err != nil {
+			return err
+		}
+		truncated, marker, err := page(body)
+		if err != nil {
+			return err
+		}
+		if !truncated {
+			return nil
+		}
+		if marker == "" || seen[marker] {
+			return fmt.Errorf("truncated response without a new marker")
+		}
+		seen[marker] = true
+		params.Set("Marker", marker)
+	}
 }
 
 // doRequest makes a signed request to the IAM API using minio-go's SignV4
@@ -224,8 +586,12 @@ func (c *Client) doRequest(params url.Values) ([]byte, error) {
 	// Use minio-go's proven SignV4 implementation (same code that signs
 	// our working S3 bucket operations)
 	signedReq := signer.SignV4(*req, c.accessKey, c.secretKey, "", c.region)
+	if c.requestID != "" {
+		// Set after signing; the header is informational and not signed
+		signedReq.Header.Set("X-Request-Id", c.requestID)
+	}
 
-	log.Printf("IAM Request: %s %s (Action=%s, body_len=%d, auth=%s)",
+	c.logf("IAM Request: %s %s (Action=%s, body_len=%d, auth=%s)",
 		signedReq.Method, endpointURL, params.Get("Action"), len(bodyStr),
 		signedReq.Header.Get("Authorization")[:80]+"...")
 
@@ -240,14 +606,19 @@ func (c *Client) doRequest(params url.Values) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	log.Printf("IAM Response: status=%d, body=%s", resp.StatusCode, string(respBody))
+	c.logf("IAM Response: status=%d, body=%s", resp.StatusCode, string(respBody))
 
 	if resp.StatusCode != http.StatusOK {
 		var errResp ErrorResponse
 		if xmlErr := xml.Unmarshal(respBody, &errResp); xmlErr == nil && errResp.Error.Code != "" {
-			return nil, fmt.Errorf("IAM error %s: %s", errResp.Error.Code, errResp.Error.Message)
+			return nil, &Error{
+				StatusCode: resp.StatusCode,
+				Code:       errResp.Error.Code,
+				Message:    errResp.Error.Message,
+				RequestID:  errResp.RequestId,
+			}
 		}
-		return nil, fmt.Errorf("IAM request failed with status %d: %s", resp.StatusCode, string(respBody))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: string(respBody)}
 	}
 
 	return respBody, nil
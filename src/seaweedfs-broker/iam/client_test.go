@@ -0,0 +1,316 @@
+package iam
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIAM answers IAM actions with the responses set for them and records
+// the requests it received
+type fakeIAM struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]func(form url.Values) (int, string)
+	requests  []url.Values
+	requestID string
+}
+
+func newFakeIAM(t *testing.T) (*fakeIAM, *Client) {
+	f := &fakeIAM{responses: make(map[string]func(form url.Values) (int, string))}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f, NewClient(strings.TrimPrefix(f.URL, "http://"), "admin", "secret", "us-east-1", false)
+}
+
+func (f *fakeIAM) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, r.PostForm)
+	f.requestID = r.Header.Get("X-Request-Id")
+	respond := f.responses[r.PostForm.Get("Action")]
+	f.mu.Unlock()
+
+	if respond == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, errorResponse("NotImplemented", "action not supported"))
+		return
+	}
+	status, body := respond(r.PostForm)
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+func (f *fakeIAM) respond(action string, respond func(form url.Values) (int, string)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[action] = respond
+}
+
+func errorResponse(code, message string) string {
+	return fmt.Sprintf(`<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>req-1</RequestId></ErrorResponse>`,
+		code, message)
+}
+
+func TestListUsersPaginates(t *testing.T) {
+	f, c := newFakeIAM(t)
+	f.respond("ListUsers", func(form url.Values) (int, string) {
+		if form.Get("Marker") == "" {
+			return http.StatusOK, `<ListUsersResponse><ListUsersResult><Users>
+				<member><UserName>u1</UserName></member><member><UserName>u2</UserName></member>
+				</Users><IsTruncated>true</IsTruncated><Marker>page-2</Marker></ListUsersResult></ListUsersResponse>`
+		}
+		return http.StatusOK, `<ListUsersResponse><ListUsersResult><Users>
+			<member><UserName>u3</UserName></member>
+			</Users><IsTruncated>false</IsTruncated></ListUsersResult></ListUsersResponse>`
+	})
+
+	users, err := c.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.UserName)
+	}
+	if !slices.Equal(names, []string{"u1", "u2", "u3"}) {
+		t.Errorf("expected the users of both pages, got %v", names)
+	}
+	if len(f.requests) != 2 || f.requests[1].Get("Marker") != "page-2" {
+		t.Errorf("expected a second request with the marker, got %v", f.requests)
+	}
+}
+
+func TestListAllStopsOnRepeatedMarker(t *testing.T) {
+	f, c := newFakeIAM(t)
+	f.respond("ListUserPolicies", func(url.Values) (int, string) {
+		return http.StatusOK, `<ListUserPoliciesResponse><ListUserPoliciesResult><PolicyNames><member>p</member></PolicyNames>
+			<IsTruncated>true</IsTruncated><Marker>same</Marker></ListUserPoliciesResult></ListUserPoliciesResponse>`
+	})
+
+	if _, err := c.ListUserPolicies("u1"); err == nil {
+		t.Errorf("expected an error for a marker that does not advance")
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	f, c := newFakeIAM(t)
+	f.respond("DeleteUserPolicy", func(url.Values) (int, string) {
+		return http.StatusNotFound, errorResponse(ErrCodeNoSuchEntity, "policy not found")
+	})
+	f.respond("CreateUser", func(url.Values) (int, string) {
+		return http.StatusConflict, errorResponse(ErrCodeEntityAlreadyExists, "user exists")
+	})
+	f.respond("DeleteUser", func(url.Values) (int, string) {
+		return http.StatusInternalServerError, "internal error"
+	})
+
+	err := c.DeleteUserPolicy("u1", "p1")
+	var iamErr *Error
+	if !errors.As(err, &iamErr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if iamErr.StatusCode != http.StatusNotFound || iamErr.Code != ErrCodeNoSuchEntity ||
+		iamErr.Message != "policy not found" || iamErr.RequestID != "req-1" {
+		t.Errorf("unexpected error %+v", iamErr)
+	}
+	if !IsNoSuchEntity(err) || IsEntityAlreadyExists(err) {
+		t.Errorf("expected only IsNoSuchEntity for %v", err)
+	}
+
+	if err := c.CreateUser("u1"); !IsEntityAlreadyExists(err) {
+		t.Errorf("expected EntityAlreadyExists, got %v", err)
+	}
+
+	err = c.DeleteUser("u1")
+	if !errors.As(err, &iamErr) || iamErr.Code != "" || iamErr.Message != "internal error" {
+		t.Errorf("expected an *Error without a code, got %v", err)
+	}
+	if ErrorCode(err) != "" || IsNoSuchEntity(err) {
+		t.Errorf("a response without an error document has no code: %v", err)
+	}
+
+	// Actions the fake does not know fail like those of older SeaweedFS
+	// versions
+	if _, err := c.ListGroups(); !IsNotImplemented(err) {
+		t.Errorf("expected NotImplemented, got %v", err)
+	}
+	if err := c.TagUser("u1", []Tag{{Key: "k", Value: "v"}}); !IsNotImplemented(err) {
+		t.Errorf("expected NotImplemented, got %v", err)
+	}
+}
+
+func TestUserPolicyRoundTrip(t *testing.T) {
+	f, c := newFakeIAM(t)
+	var stored string
+	f.respond("PutUserPolicy", func(form url.Values) (int, string) {
+		stored = form.Get("PolicyDocument")
+		return http.StatusOK, `<PutUserPolicyResponse></PutUserPolicyResponse>`
+	})
+
+	policy := BucketPolicy([]string{"b1"}, "tenant a/", ReadWriteActions)
+	if err := c.PutUserPolicy("u1", "p1", policy); err != nil {
+		t.Fatalf("PutUserPolicy: %v", err)
+	}
+
+	for name, document := range map[string]string{
+		"as put":      stored,
+		"URL-encoded": url.QueryEscape(stored),
+	} {
+		document := document
+		f.respond("GetUserPolicy", func(form url.Values) (int, string) {
+			if form.Get("UserName") != "u1" || form.Get("PolicyName") != "p1" {
+				return http.StatusNotFound, errorResponse(ErrCodeNoSuchEntity, "no such policy")
+			}
+			return http.StatusOK, fmt.Sprintf(`<GetUserPolicyResponse><GetUserPolicyResult><UserName>u1</UserName>
+				<PolicyName>p1</PolicyName><PolicyDocument>%s</PolicyDocument></GetUserPolicyResult></GetUserPolicyResponse>`,
+				xmlEscape(document))
+		})
+
+		got, err := c.GetUserPolicy("u1", "p1")
+		if err != nil {
+			t.Fatalf("%s: GetUserPolicy: %v", name, err)
+		}
+		if !got.Equivalent(policy) {
+			t.Errorf("%s: got grants %v, want %v", name, got.Grants(), policy.Grants())
+		}
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	if err := xml.EscapeText(&b, []byte(s)); err != nil {
+		panic(err)
+	}
+	return b.String()
+}
+
+func TestUserTags(t *testing.T) {
+	f, c := newFakeIAM(t)
+	f.respond("TagUser", func(url.Values) (int, string) { return http.StatusOK, `<TagUserResponse></TagUserResponse>` })
+	f.respond("UntagUser", func(url.Values) (int, string) { return http.StatusOK, `<UntagUserResponse></UntagUserResponse>` })
+	f.respond("ListUserTags", func(url.Values) (int, string) {
+		return http.StatusOK, `<ListUserTagsResponse><ListUserTagsResult><Tags>
+			<member><Key>binding</Key><Value>b1</Value></member></Tags>
+			<IsTruncated>false</IsTruncated></ListUserTagsResult></ListUserTagsResponse>`
+	})
+
+	c = c.WithRequestID("request-1")
+	if err := c.TagUser("u1", []Tag{{Key: "binding", Value: "b1"}, {Key: "instance", Value: "i1"}}); err != nil {
+		t.Fatalf("TagUser: %v", err)
+	}
+	form := f.requests[len(f.requests)-1]
+	if form.Get("Tags.member.1.Key") != "binding" || form.Get("Tags.member.2.Value") != "i1" {
+		t.Errorf("unexpected TagUser request %v", form)
+	}
+	if f.requestID != "request-1" {
+		t.Errorf("expected the request ID header, got %q", f.requestID)
+	}
+
+	if err := c.UntagUser("u1", []string{"instance"}); err != nil {
+		t.Fatalf("UntagUser: %v", err)
+	}
+	if form := f.requests[len(f.requests)-1]; form.Get("TagKeys.member.1") != "instance" {
+		t.Errorf("unexpected UntagUser request %v", form)
+	}
+
+	tags, err := c.ListUserTags("u1")
+	if err != nil {
+		t.Fatalf("ListUserTags: %v", err)
+	}
+	if !slices.Equal(tags, []Tag{{Key: "binding", Value: "b1"}}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
+
+func TestBucketPolicy(t *testing.T) {
+	buckets := []string{"b1", "b2"}
+	tests := []struct {
+		name    string
+		prefix  string
+		actions Actions
+		want    []string
+	}{
+		{
+			name:    "readwrite",
+			actions: ReadWriteActions,
+			want: []string{
+				"Allow s3:AbortMultipartUpload arn:aws:s3:::b1/*",
+				"Allow s3:AbortMultipartUpload arn:aws:s3:::b2/*",
+				"Allow s3:DeleteObject* arn:aws:s3:::b1/*",
+				"Allow s3:DeleteObject* arn:aws:s3:::b2/*",
+				"Allow s3:GetBucketLocation arn:aws:s3:::b1",
+				"Allow s3:GetBucketLocation arn:aws:s3:::b2",
+				"Allow s3:GetObject* arn:aws:s3:::b1/*",
+				"Allow s3:GetObject* arn:aws:s3:::b2/*",
+				"Allow s3:ListBucket* arn:aws:s3:::b1",
+				"Allow s3:ListBucket* arn:aws:s3:::b2",
+				"Allow s3:ListMultipartUploadParts arn:aws:s3:::b1/*",
+				"Allow s3:ListMultipartUploadParts arn:aws:s3:::b2/*",
+				"Allow s3:PutObject* arn:aws:s3:::b1/*",
+				"Allow s3:PutObject* arn:aws:s3:::b2/*",
+			},
+		},
+		{
+			name:    "write only",
+			actions: WriteOnlyActions,
+			want: []string{
+				"Allow s3:AbortMultipartUpload arn:aws:s3:::b1/*",
+				"Allow s3:AbortMultipartUpload arn:aws:s3:::b2/*",
+				"Allow s3:DeleteObject* arn:aws:s3:::b1/*",
+				"Allow s3:DeleteObject* arn:aws:s3:::b2/*",
+				"Allow s3:PutObject* arn:aws:s3:::b1/*",
+				"Allow s3:PutObject* arn:aws:s3:::b2/*",
+			},
+		},
+		{
+			name:    "read with a prefix",
+			prefix:  "tenant-a/",
+			actions: ReadOnlyActions,
+			want: []string{
+				"Allow s3:GetObject* arn:aws:s3:::b1/tenant-a/*",
+				"Allow s3:GetObject* arn:aws:s3:::b2/tenant-a/*",
+			},
+		},
+		{
+			name:    "admin",
+			actions: AdminActions,
+			want: []string{
+				"Allow s3:* arn:aws:s3:::b1",
+				"Allow s3:* arn:aws:s3:::b1/*",
+				"Allow s3:* arn:aws:s3:::b2",
+				"Allow s3:* arn:aws:s3:::b2/*",
+			},
+		},
+		{name: "no access", actions: Actions{}, want: []string{}},
+	}
+	for _, test := range tests {
+		got := BucketPolicy(buckets, test.prefix, test.actions).Grants()
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got grants\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestBucketPolicyKeepsBucketConfigurationForAdmins(t *testing.T) {
+	for name, actions := range map[string]Actions{"read": ReadOnlyActions, "write": WriteOnlyActions, "readwrite": ReadWriteActions} {
+		for _, grant := range BucketPolicy([]string{"b1"}, "", actions).Grants() {
+			effect, rest, _ := strings.Cut(grant, " ")
+			action, resource, _ := strings.Cut(rest, " ")
+			if effect == "Allow" && resource == "arn:aws:s3:::b1" && action != "s3:ListBucket*" && action != "s3:GetBucketLocation" {
+				t.Errorf("%s: %s granted on the bucket itself", name, action)
+			}
+		}
+	}
+}
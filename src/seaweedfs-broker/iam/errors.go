@@ -0,0 +1,62 @@
+package iam
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error codes returned by the IAM API
+const (
+	ErrCodeNoSuchEntity        = "NoSuchEntity"
+	ErrCodeEntityAlreadyExists = "EntityAlreadyExists"
+	ErrCodeDeleteConflict      = "DeleteConflict"
+	ErrCodeLimitExceeded       = "LimitExceeded"
+	ErrCodeInvalidInput        = "InvalidInput"
+	ErrCodeMalformedPolicy     = "MalformedPolicyDocument"
+	ErrCodeServiceFailure      = "ServiceFailure"
+	ErrCodeNotImplemented      = "NotImplemented"
+)
+
+// Error is an error response of the IAM API. Code is empty if the response
+// body was not an IAM error document.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("IAM request failed with status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("IAM error %s: %s", e.Code, e.Message)
+}
+
+// ErrorCode returns the IAM error code of err, or an empty string if err is
+// not an IAM error response
+func ErrorCode(err error) string {
+	var iamErr *Error
+	if errors.As(err, &iamErr) {
+		return iamErr.Code
+	}
+	return ""
+}
+
+// IsNoSuchEntity reports whether err says the user, key, policy or group
+// does not exist
+func IsNoSuchEntity(err error) bool {
+	return ErrorCode(err) == ErrCodeNoSuchEntity
+}
+
+// IsEntityAlreadyExists reports whether err says the user, key or group
+// already exists
+func IsEntityAlreadyExists(err error) bool {
+	return ErrorCode(err) == ErrCodeEntityAlreadyExists
+}
+
+// IsNotImplemented reports whether err says the IAM API does not support
+// the action, as older SeaweedFS versions answer for newer actions
+func IsNotImplemented(err error) bool {
+	return ErrorCode(err) == ErrCodeNotImplemented
+}
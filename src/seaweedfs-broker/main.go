@@ -20,6 +20,14 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Maintenance subcommands, e.g. "seaweedfs-broker export"
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	b, err := broker.New(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create broker: %v", err)
@@ -0,0 +1,554 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks a secret field value that was sealed by EncryptedStore.
+// The full format is enc:v2:<key id>:<wrapped data key>:<nonce+ciphertext>,
+// with both binary parts base64 encoded. Both are authenticated with the
+// record and field the value belongs to, so a sealed value copied into
+// another record or field does not open.
+const encryptedPrefix = "enc:v2:"
+
+// legacyEncryptedPrefix marks values sealed before they were bound to their
+// record and field. They still open, and are resealed by Rotate.
+const legacyEncryptedPrefix = "enc:v1:"
+
+// isSealed reports whether value was sealed by EncryptedStore
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix) || strings.HasPrefix(value, legacyEncryptedPrefix)
+}
+
+// Keyring holds the key-encryption keys used by EncryptedStore.
+// New records are always sealed with the active key; the other keys are kept
+// so that existing records can still be opened during a rotation.
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// NewKeyring creates a keyring from base64-encoded 256-bit keys indexed by key ID
+func NewKeyring(activeID string, keys map[string]string) (*Keyring, error) {
+	if activeID == "" {
+		return nil, fmt.Errorf("active encryption key ID is required")
+	}
+
+	kr := &Keyring{
+		activeID: activeID,
+		keys:     make(map[string][]byte, len(keys)),
+	}
+	for id, encoded := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key ID %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not valid base64: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %s must be 32 bytes, got %d", id, len(key))
+		}
+		kr.keys[id] = key
+	}
+
+	if _, ok := kr.keys[activeID]; !ok {
+		return nil, fmt.Errorf("active encryption key %s is not in the keyring", activeID)
+	}
+
+	return kr, nil
+}
+
+// ActiveKeyID returns the ID of the key used to seal new values
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.activeID
+}
+
+// seal encrypts value with a fresh data key and wraps that data key with the
+// active key-encryption key, authenticating both with aad
+func (kr *Keyring) seal(value, aad string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := gcmSeal(kr.keys[kr.activeID], dataKey, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := gcmSeal(dataKey, []byte(value), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + kr.activeID + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// open decrypts a value produced by seal with the same aad. Values without
+// the encrypted prefix are returned unchanged so that plaintext records from
+// before encryption was enabled remain readable until they are re-encrypted.
+func (kr *Keyring) open(value, aad string) (string, error) {
+	var additionalData []byte
+	switch {
+	case strings.HasPrefix(value, encryptedPrefix):
+		value = strings.TrimPrefix(value, encryptedPrefix)
+		additionalData = []byte(aad)
+	case strings.HasPrefix(value, legacyEncryptedPrefix):
+		value = strings.TrimPrefix(value, legacyEncryptedPrefix)
+	default:
+		return value, nil
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	kek, ok := kr.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("encryption key %s is not in the keyring", parts[0])
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed data key: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed ciphertext: %w", err)
+	}
+
+	dataKey, err := gcmOpen(kek, wrappedKey, additionalData)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key with key %s: %w", parts[0], err)
+	}
+	plaintext, err := gcmOpen(dataKey, ciphertext, additionalData)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// current reports whether value is empty or already sealed with the active key
+func (kr *Keyring) current(value string) bool {
+	return value == "" || strings.HasPrefix(value, encryptedPrefix+kr.activeID+":")
+}
+
+func gcmSeal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// secretField is a field that is encrypted at rest. aad identifies the record
+// and field, and is authenticated with the sealed value.
+type secretField struct {
+	value *string
+	aad   string
+}
+
+// instanceSecrets returns the secret fields of an instance that are encrypted at rest
+func instanceSecrets(instance *ServiceInstance) []secretField {
+	aad := "instance/" + instance.ID + "/"
+	return []secretField{
+		{&instance.AdminAccessKey, aad + "admin_access_key"},
+		{&instance.AdminSecretKey, aad + "admin_secret_key"},
+		{&instance.AdminPassword, aad + "admin_password"},
+	}
+}
+
+// bindingSecrets returns the secret fields of a binding that are encrypted at rest
+func bindingSecrets(binding *ServiceBinding) []secretField {
+	return []secretField{{&binding.SecretKey, "binding/" + binding.ID + "/secret_key"}}
+}
+
+// EncryptedStore wraps another Store and encrypts the secret fields of
+// instances and bindings before they reach it. Callers always see plaintext.
+type EncryptedStore struct {
+	inner   Store
+	keyring *Keyring
+}
+
+// NewEncryptedStore wraps inner so that secrets are sealed with keyring
+func NewEncryptedStore(inner Store, keyring *Keyring) *EncryptedStore {
+	return &EncryptedStore{inner: inner, keyring: keyring}
+}
+
+func (s *EncryptedStore) openInstance(raw *ServiceInstance) (*ServiceInstance, error) {
+	instance := *raw
+	for _, field := range instanceSecrets(&instance) {
+		value, err := s.keyring.open(*field.value, field.aad)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", raw.ID, err)
+		}
+		*field.value = value
+	}
+	return &instance, nil
+}
+
+func (s *EncryptedStore) openBinding(raw *ServiceBinding) (*ServiceBinding, error) {
+	binding := *raw
+	for _, field := range bindingSecrets(&binding) {
+		value, err := s.keyring.open(*field.value, field.aad)
+		if err != nil {
+			return nil, fmt.Errorf("binding %s: %w", raw.ID, err)
+		}
+		*field.value = value
+	}
+	return &binding, nil
+}
+
+// GetInstance retrieves a service instance by ID
+func (s *EncryptedStore) GetInstance(instanceID string) (*ServiceInstance, error) {
+	raw, err := s.inner.GetInstance(instanceID)
+	if err != nil || raw == nil {
+		return raw, err
+	}
+	return s.openInstance(raw)
+}
+
+// SaveInstance saves a service instance
+func (s *EncryptedStore) SaveInstance(instance *ServiceInstance) error {
+	sealed := *instance
+	for _, field := range instanceSecrets(&sealed) {
+		if *field.value == "" {
+			continue
+		}
+		value, err := s.keyring.seal(*field.value, field.aad)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt instance %s: %w", instance.ID, err)
+		}
+		*field.value = value
+	}
+
+	if err := s.inner.SaveInstance(&sealed); err != nil {
+		return err
+	}
+	instance.Revision = sealed.Revision
+	instance.UpdatedAt = sealed.UpdatedAt
+	return nil
+}
+
+// DeleteInstance deletes a service instance
+func (s *EncryptedStore) DeleteInstance(instanceID string) error {
+	return s.inner.DeleteInstance(instanceID)
+}
+
+// ListInstances returns all service instances
+func (s *EncryptedStore) ListInstances() ([]*ServiceInstance, error) {
+	raw, err := s.inner.ListInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]*ServiceInstance, 0, len(raw))
+	for _, r := range raw {
+		instance, err := s.openInstance(r)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// GetBinding retrieves a service binding by ID
+func (s *EncryptedStore) GetBinding(bindingID string) (*ServiceBinding, error) {
+	raw, err := s.inner.GetBinding(bindingID)
+	if err != nil || raw == nil {
+		return raw, err
+	}
+	return s.openBinding(raw)
+}
+
+// SaveBinding saves a service binding
+func (s *EncryptedStore) SaveBinding(binding *ServiceBinding) error {
+	sealed := *binding
+	for _, field := range bindingSecrets(&sealed) {
+		if *field.value == "" {
+			continue
+		}
+		value, err := s.keyring.seal(*field.value, field.aad)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt binding %s: %w", binding.ID, err)
+		}
+		*field.value = value
+	}
+
+	if err := s.inner.SaveBinding(&sealed); err != nil {
+		return err
+	}
+	binding.Revision = sealed.Revision
+	return nil
+}
+
+// DeleteBinding deletes a service binding
+func (s *EncryptedStore) DeleteBinding(bindingID string) error {
+	return s.inner.DeleteBinding(bindingID)
+}
+
+// ListBindings returns all service bindings
+func (s *EncryptedStore) ListBindings() ([]*ServiceBinding, error) {
+	raw, err := s.inner.ListBindings()
+	if err != nil {
+		return nil, err
+	}
+	return s.openBindings(raw)
+}
+
+// ListBindingsForInstance returns all bindings for a service instance
+func (s *EncryptedStore) ListBindingsForInstance(instanceID string) ([]*ServiceBinding, error) {
+	raw, err := s.inner.ListBindingsForInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return s.openBindings(raw)
+}
+
+func (s *EncryptedStore) openBindings(raw []*ServiceBinding) ([]*ServiceBinding, error) {
+	bindings := make([]*ServiceBinding, 0, len(raw))
+	for _, r := range raw {
+		binding, err := s.openBinding(r)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+// Verify checks that every stored secret can be decrypted with the keyring.
+// It is run at startup so that a missing or wrong key fails fast instead of
+// surfacing later as broken bindings.
+func (s *EncryptedStore) Verify() error {
+	instances, err := s.inner.ListInstances()
+	if err != nil {
+		return err
+	}
+	bindings, err := s.inner.ListBindings()
+	if err != nil {
+		return err
+	}
+
+	failed := make([]string, 0)
+	for _, raw := range instances {
+		if _, err := s.openInstance(raw); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	for _, raw := range bindings {
+		if _, err := s.openBinding(raw); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d record(s) cannot be decrypted, first error: %s", len(failed), failed[0])
+	}
+	return nil
+}
+
+// rotateRetries bounds how often Rotate re-reads a record that another
+// writer changed while it was being re-encrypted
+const rotateRetries = 5
+
+// Rotate re-encrypts every record whose secrets are stored in plaintext or
+// sealed with a key other than the active one, or in the legacy format. It
+// returns the number of records that were rewritten. Once every record is
+// current, the snapshots of a wrapped FileStore are removed, as they hold the
+// secrets as they were before; backups taken before migrations are kept. A record changed by another writer is read
+// again and retried; records still conflicting after rotateRetries attempts
+// are reported in the error, after all other records were rotated.
+func (s *EncryptedStore) Rotate() (int, error) {
+	instances, err := s.inner.ListInstances()
+	if err != nil {
+		return 0, err
+	}
+	bindings, err := s.inner.ListBindings()
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	conflicted := make([]string, 0)
+	for _, raw := range instances {
+		saved, err := s.rotateInstance(raw)
+		if IsConflict(err) {
+			conflicted = append(conflicted, "instance "+raw.ID)
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		if saved {
+			rotated++
+		}
+	}
+
+	for _, raw := range bindings {
+		saved, err := s.rotateBinding(raw)
+		if IsConflict(err) {
+			conflicted = append(conflicted, "binding "+raw.ID)
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		if saved {
+			rotated++
+		}
+	}
+
+	if len(conflicted) > 0 {
+		return rotated, fmt.Errorf("%d record(s) kept changing and were not re-encrypted: %s",
+			len(conflicted), strings.Join(conflicted, ", "))
+	}
+
+	// Snapshots of a file store still hold the values as they were before
+	if fileStore, ok := s.inner.(*FileStore); ok && rotated > 0 {
+		if err := fileStore.PurgeSnapshots(); err != nil {
+			return rotated, fmt.Errorf("failed to remove state snapshots holding secrets that were re-encrypted: %w", err)
+		}
+	}
+	return rotated, nil
+}
+
+// rotateInstance re-encrypts an instance unless its secrets are current,
+// reading it again after a conflict. It reports whether it was rewritten.
+func (s *EncryptedStore) rotateInstance(raw *ServiceInstance) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		if raw == nil || s.instanceCurrent(raw) {
+			return false, nil
+		}
+		instance, err := s.openInstance(raw)
+		if err != nil {
+			return false, err
+		}
+		err = s.SaveInstance(instance)
+		if err == nil {
+			return true, nil
+		}
+		if !IsConflict(err) || attempt >= rotateRetries {
+			return false, err
+		}
+		if raw, err = s.inner.GetInstance(raw.ID); err != nil {
+			return false, err
+		}
+	}
+}
+
+// rotateBinding is rotateInstance for bindings
+func (s *EncryptedStore) rotateBinding(raw *ServiceBinding) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		if raw == nil || s.bindingCurrent(raw) {
+			return false, nil
+		}
+		binding, err := s.openBinding(raw)
+		if err != nil {
+			return false, err
+		}
+		err = s.SaveBinding(binding)
+		if err == nil {
+			return true, nil
+		}
+		if !IsConflict(err) || attempt >= rotateRetries {
+			return false, err
+		}
+		if raw, err = s.inner.GetBinding(raw.ID); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (s *EncryptedStore) instanceCurrent(raw *ServiceInstance) bool {
+	for _, field := range instanceSecrets(raw) {
+		if !s.keyring.current(*field.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *EncryptedStore) bindingCurrent(raw *ServiceBinding) bool {
+	for _, field := range bindingSecrets(raw) {
+		if !s.keyring.current(*field.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// SaveOperation saves an operation history entry; entries hold no secrets
+func (s *EncryptedStore) SaveOperation(op *Operation) error {
+	return s.inner.SaveOperation(op)
+}
+
+// ListOperations returns the complete operation history
+func (s *EncryptedStore) ListOperations() ([]*Operation, error) {
+	return s.inner.ListOperations()
+}
+
+// ListOperationsForInstance returns the operation history of a service instance
+func (s *EncryptedStore) ListOperationsForInstance(instanceID string) ([]*Operation, error) {
+	return s.inner.ListOperationsForInstance(instanceID)
+}
+
+// SchemaVersion returns the schema version of the wrapped store
+func (s *EncryptedStore) SchemaVersion() (int, error) {
+	versioned, ok := s.inner.(Versioned)
+	if !ok {
+		return 0, fmt.Errorf("state store does not support schema versioning")
+	}
+	return versioned.SchemaVersion()
+}
+
+// SetSchemaVersion records the schema version in the wrapped store
+func (s *EncryptedStore) SetSchemaVersion(version int) error {
+	versioned, ok := s.inner.(Versioned)
+	if !ok {
+		return fmt.Errorf("state store does not support schema versioning")
+	}
+	return versioned.SetSchemaVersion(version)
+}
+
+// Backup backs up the wrapped store; secrets stay encrypted in the backup
+func (s *EncryptedStore) Backup(label string) (string, error) {
+	versioned, ok := s.inner.(Versioned)
+	if !ok {
+		return "", fmt.Errorf("state store does not support schema versioning")
+	}
+	return versioned.Backup(label)
+}
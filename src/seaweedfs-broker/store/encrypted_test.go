@@ -0,0 +1,200 @@
+package store
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, activeID string, ids ...string) *Keyring {
+	t.Helper()
+	keys := make(map[string]string)
+	for _, id := range ids {
+		keys[id] = base64.StdEncoding.EncodeToString([]byte(strings.Repeat(id[:1], 32)))
+	}
+	kr, err := NewKeyring(activeID, keys)
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return kr
+}
+
+func TestEncryptedStoreCopies(t *testing.T) {
+	testStoreCopies(t, NewEncryptedStore(newTestFileStore(t), testKeyring(t, "a", "a")))
+}
+
+func TestEncryptedStoreConflicts(t *testing.T) {
+	testStoreConflicts(t, NewEncryptedStore(newTestFileStore(t), testKeyring(t, "a", "a")))
+}
+
+func TestEncryptedStoreSealsSecrets(t *testing.T) {
+	inner := newTestFileStore(t)
+	s := NewEncryptedStore(inner, testKeyring(t, "a", "a"))
+
+	instance := testInstance("i1")
+	instance.AdminSecretKey = "admin-secret"
+	if err := s.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	if instance.AdminSecretKey != "admin-secret" {
+		t.Errorf("SaveInstance changed the caller's secret to %q", instance.AdminSecretKey)
+	}
+
+	raw, _ := inner.GetInstance("i1")
+	if !strings.HasPrefix(raw.AdminSecretKey, encryptedPrefix+"a:") {
+		t.Errorf("secret stored unsealed: %q", raw.AdminSecretKey)
+	}
+	got, _ := s.GetInstance("i1")
+	if got.AdminSecretKey != "admin-secret" {
+		t.Errorf("expected the opened secret, got %q", got.AdminSecretKey)
+	}
+}
+
+func TestEncryptedStoreRotate(t *testing.T) {
+	inner := newTestFileStore(t)
+	old := NewEncryptedStore(inner, testKeyring(t, "a", "a"))
+	if err := old.SaveInstance(testInstance("i1")); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	if err := old.SaveBinding(testBinding("b1", "i1")); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+
+	rotating := NewEncryptedStore(inner, testKeyring(t, "b", "a", "b"))
+	rotated, err := rotating.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	// The instance has no secrets, so only the binding is rewritten
+	if rotated != 1 {
+		t.Errorf("expected 1 rotated record, got %d", rotated)
+	}
+
+	raw, _ := inner.GetBinding("b1")
+	if !strings.HasPrefix(raw.SecretKey, encryptedPrefix+"b:") {
+		t.Errorf("secret not resealed with the active key: %q", raw.SecretKey)
+	}
+	if err := NewEncryptedStore(inner, testKeyring(t, "b", "b")).Verify(); err != nil {
+		t.Errorf("records still need the old key: %v", err)
+	}
+}
+
+// racingStore saves each binding once more, unchanged, before the first
+// save of it, as a concurrent writer would
+type racingStore struct {
+	*FileStore
+	raced map[string]bool
+}
+
+func (s *racingStore) SaveBinding(binding *ServiceBinding) error {
+	if !s.raced[binding.ID] {
+		s.raced[binding.ID] = true
+		current, _ := s.FileStore.GetBinding(binding.ID)
+		if err := s.FileStore.SaveBinding(current); err != nil {
+			return err
+		}
+	}
+	return s.FileStore.SaveBinding(binding)
+}
+
+func TestEncryptedStoreRotateRetriesConflicts(t *testing.T) {
+	inner := &racingStore{FileStore: newTestFileStore(t), raced: make(map[string]bool)}
+	old := NewEncryptedStore(inner.FileStore, testKeyring(t, "a", "a"))
+	if err := old.SaveBinding(testBinding("b1", "i1")); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+
+	rotated, err := NewEncryptedStore(inner, testKeyring(t, "b", "a", "b")).Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if rotated != 1 {
+		t.Errorf("expected 1 rotated record, got %d", rotated)
+	}
+	raw, _ := inner.GetBinding("b1")
+	if !strings.HasPrefix(raw.SecretKey, encryptedPrefix+"b:") {
+		t.Errorf("secret of the conflicting binding not resealed: %q", raw.SecretKey)
+	}
+	if raw.Revision != 3 {
+		t.Errorf("expected the concurrent save and the retry, got revision %d", raw.Revision)
+	}
+}
+
+func TestEncryptedStoreBindsSecretsToRecords(t *testing.T) {
+	inner := newTestFileStore(t)
+	s := NewEncryptedStore(inner, testKeyring(t, "a", "a"))
+	for _, id := range []string{"i1", "i2"} {
+		instance := testInstance(id)
+		instance.AdminSecretKey = "secret-of-" + id
+		instance.AdminPassword = "password-of-" + id
+		if err := s.SaveInstance(instance); err != nil {
+			t.Fatalf("SaveInstance: %v", err)
+		}
+	}
+
+	// Sealed values copied into another record or field must not open
+	raw1, _ := inner.GetInstance("i1")
+	raw2, _ := inner.GetInstance("i2")
+	raw2.AdminSecretKey = raw1.AdminSecretKey
+	if _, err := s.openInstance(raw2); err == nil {
+		t.Error("a secret copied from another instance was opened")
+	}
+	raw1.AdminPassword = raw1.AdminSecretKey
+	if _, err := s.openInstance(raw1); err == nil {
+		t.Error("a secret copied from another field was opened")
+	}
+}
+
+func TestEncryptedStoreResealsLegacyValues(t *testing.T) {
+	inner := newTestFileStore(t)
+	kr := testKeyring(t, "a", "a")
+
+	// Values sealed before they were bound to their record and field
+	dataKey := []byte(strings.Repeat("d", 32))
+	wrappedKey, _ := gcmSeal(kr.keys["a"], dataKey, nil)
+	ciphertext, _ := gcmSeal(dataKey, []byte("legacy-secret"), nil)
+	binding := testBinding("b1", "i1")
+	binding.SecretKey = legacyEncryptedPrefix + "a:" + base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext)
+	if err := inner.SaveBinding(binding); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+
+	s := NewEncryptedStore(inner, kr)
+	got, err := s.GetBinding("b1")
+	if err != nil || got.SecretKey != "legacy-secret" {
+		t.Fatalf("expected the legacy secret to open, got %q, %v", got.SecretKey, err)
+	}
+	if rotated, err := s.Rotate(); err != nil || rotated != 1 {
+		t.Fatalf("expected 1 rotated record, got %d, %v", rotated, err)
+	}
+	raw, _ := inner.GetBinding("b1")
+	if !strings.HasPrefix(raw.SecretKey, encryptedPrefix+"a:") {
+		t.Errorf("legacy secret not resealed: %q", raw.SecretKey)
+	}
+	if got, _ := s.GetBinding("b1"); got.SecretKey != "legacy-secret" {
+		t.Errorf("expected the resealed secret, got %q", got.SecretKey)
+	}
+}
+
+func TestEncryptedStoreRotatePurgesSnapshots(t *testing.T) {
+	inner := newTestFileStore(t)
+	for _, id := range []string{"b1", "b2"} {
+		if err := inner.SaveBinding(testBinding(id, "i1")); err != nil {
+			t.Fatalf("SaveBinding: %v", err)
+		}
+	}
+	if _, err := os.Stat(inner.snapshotPath(1)); err != nil {
+		t.Fatalf("expected a snapshot of the plaintext state: %v", err)
+	}
+
+	if _, err := NewEncryptedStore(inner, testKeyring(t, "a", "a")).Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	for n := 1; n <= inner.snapshots; n++ {
+		if _, err := os.Stat(inner.snapshotPath(n)); !os.IsNotExist(err) {
+			t.Errorf("snapshot %d holding plaintext secrets was kept", n)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportFormatVersion is the version of the Export document format
+const ExportFormatVersion = 1
+
+// Export is a portable copy of the complete broker state. Secrets are
+// exported exactly as stored, so an export taken from an encrypted store
+// stays encrypted and can only be imported where the keys in KeyIDs are
+// available.
+type Export struct {
+	FormatVersion int                `json:"format_version"`
+	SchemaVersion int                `json:"schema_version"`
+	ExportedAt    time.Time          `json:"exported_at"`
+	KeyIDs        []string           `json:"key_ids,omitempty"`
+	Instances     []*ServiceInstance `json:"instances"`
+	Bindings      []*ServiceBinding  `json:"bindings"`
+	Operations    []*Operation       `json:"operations"`
+}
+
+// ImportOptions controls ImportState
+type ImportOptions struct {
+	// DryRun validates the export and reports what would change without writing
+	DryRun bool
+	// Overwrite replaces records that already exist in the target store
+	Overwrite bool
+}
+
+// ImportReport describes the outcome of ImportState
+type ImportReport struct {
+	DryRun     bool     `json:"dry_run"`
+	Instances  int      `json:"instances"`
+	Bindings   int      `json:"bindings"`
+	Operations int      `json:"operations"`
+	Conflicts  []string `json:"conflicts,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// ErrInvalidExport is returned by ImportState when the export fails validation
+var ErrInvalidExport = errors.New("invalid state export")
+
+// rawStore returns the store holding records as persisted, bypassing
+// decryption
+func rawStore(s Store) Store {
+	if encrypted, ok := s.(*EncryptedStore); ok {
+		return encrypted.inner
+	}
+	return s
+}
+
+// ExportState copies every record out of s. Records are read below any
+// encryption layer, so secrets are exported as they are stored.
+func ExportState(s Store) (*Export, error) {
+	raw := rawStore(s)
+
+	exp := &Export{
+		FormatVersion: ExportFormatVersion,
+		ExportedAt:    time.Now().UTC(),
+	}
+
+	if versioned, ok := raw.(Versioned); ok {
+		version, err := versioned.SchemaVersion()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema version: %w", err)
+		}
+		exp.SchemaVersion = version
+	}
+
+	var err error
+	if exp.Instances, err = raw.ListInstances(); err != nil {
+		return nil, err
+	}
+	if exp.Bindings, err = raw.ListBindings(); err != nil {
+		return nil, err
+	}
+	if exp.Operations, err = raw.ListOperations(); err != nil {
+		return nil, err
+	}
+
+	keyIDs := make(map[string]bool)
+	for _, instance := range exp.Instances {
+		collectKeyIDs(keyIDs, instanceSecrets(instance))
+	}
+	for _, binding := range exp.Bindings {
+		collectKeyIDs(keyIDs, bindingSecrets(binding))
+	}
+	for id := range keyIDs {
+		exp.KeyIDs = append(exp.KeyIDs, id)
+	}
+	sort.Strings(exp.KeyIDs)
+
+	return exp, nil
+}
+
+func collectKeyIDs(keyIDs map[string]bool, fields []secretField) {
+	for _, field := range fields {
+		if !isSealed(*field.value) {
+			continue
+		}
+		// enc:<version>:<key id>:...
+		if parts := strings.SplitN(*field.value, ":", 4); len(parts) == 4 {
+			keyIDs[parts[2]] = true
+		}
+	}
+}
+
+// ImportState writes the records of exp into dst. The whole export is
+// validated and checked for conflicts before anything is written. Records
+// that already exist in dst are conflicts, reported with an error matching
+// ErrConflict, unless opts.Overwrite is set. Validation failures are
+// listed in the report and return ErrInvalidExport.
+//
+// Writes are not transactional, so a store failure part way through leaves
+// a partial import that can be completed by importing again with Overwrite.
+//
+// If dst is an EncryptedStore, encrypted secrets are opened with its keyring
+// and re-sealed with its active key; plaintext secrets are sealed as well.
+func ImportState(dst Store, exp *Export, opts ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: opts.DryRun}
+	encrypted, _ := dst.(*EncryptedStore)
+
+	instances, bindings, err := openExport(dst, exp, encrypted, report)
+	if err != nil {
+		return report, err
+	}
+	adoptVersion, err := checkSchemaVersion(dst, exp, report)
+	if err != nil {
+		return report, err
+	}
+
+	// Existing revisions are needed both to report conflicts and to overwrite
+	instanceRevisions := make(map[string]int64, len(instances))
+	for _, instance := range instances {
+		existing, err := dst.GetInstance(instance.ID)
+		if err != nil {
+			return report, err
+		}
+		if existing != nil {
+			instanceRevisions[instance.ID] = existing.Revision
+			report.Conflicts = append(report.Conflicts, "instance "+instance.ID)
+		}
+	}
+	bindingRevisions := make(map[string]int64, len(bindings))
+	for _, binding := range bindings {
+		existing, err := dst.GetBinding(binding.ID)
+		if err != nil {
+			return report, err
+		}
+		if existing != nil {
+			bindingRevisions[binding.ID] = existing.Revision
+			report.Conflicts = append(report.Conflicts, "binding "+binding.ID)
+		}
+	}
+	if len(report.Conflicts) > 0 && !opts.Overwrite {
+		return report, fmt.Errorf("%d record(s) already exist in the target store: %w", len(report.Conflicts), ErrConflict)
+	}
+
+	report.Instances = len(instances)
+	report.Bindings = len(bindings)
+	report.Operations = len(exp.Operations)
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, instance := range instances {
+		instance.Revision = instanceRevisions[instance.ID]
+		if err := dst.SaveInstance(instance); err != nil {
+			return report, fmt.Errorf("failed to import instance %s: %w", instance.ID, err)
+		}
+	}
+	for _, binding := range bindings {
+		binding.Revision = bindingRevisions[binding.ID]
+		if err := dst.SaveBinding(binding); err != nil {
+			return report, fmt.Errorf("failed to import binding %s: %w", binding.ID, err)
+		}
+	}
+	for _, op := range exp.Operations {
+		if err := dst.SaveOperation(op); err != nil {
+			return report, fmt.Errorf("failed to import operation %s: %w", op.ID, err)
+		}
+	}
+
+	if adoptVersion {
+		if err := dst.(Versioned).SetSchemaVersion(exp.SchemaVersion); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// openExport validates the records of exp and returns copies ready to be
+// saved to the target store, with secrets decrypted if the target encrypts
+func openExport(dst Store, exp *Export, encrypted *EncryptedStore, report *ImportReport) ([]*ServiceInstance, []*ServiceBinding, error) {
+	if exp.FormatVersion != ExportFormatVersion {
+		report.Errors = append(report.Errors, fmt.Sprintf("unsupported export format version %d", exp.FormatVersion))
+		return nil, nil, ErrInvalidExport
+	}
+
+	instanceIDs := make(map[string]bool, len(exp.Instances))
+	instances := make([]*ServiceInstance, 0, len(exp.Instances))
+	for i, raw := range exp.Instances {
+		if raw == nil || raw.ID == "" {
+			report.Errors = append(report.Errors, fmt.Sprintf("instance %d has no ID", i))
+			continue
+		}
+		if instanceIDs[raw.ID] {
+			report.Errors = append(report.Errors, fmt.Sprintf("duplicate instance %s", raw.ID))
+			continue
+		}
+		instanceIDs[raw.ID] = true
+
+		instance := raw.Clone()
+		if err := openSecrets(encrypted, instanceSecrets(instance)); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("instance %s: %v", raw.ID, err))
+			continue
+		}
+		instances = append(instances, instance)
+	}
+
+	bindingIDs := make(map[string]bool, len(exp.Bindings))
+	bindings := make([]*ServiceBinding, 0, len(exp.Bindings))
+	for i, raw := range exp.Bindings {
+		if raw == nil || raw.ID == "" {
+			report.Errors = append(report.Errors, fmt.Sprintf("binding %d has no ID", i))
+			continue
+		}
+		if bindingIDs[raw.ID] {
+			report.Errors = append(report.Errors, fmt.Sprintf("duplicate binding %s", raw.ID))
+			continue
+		}
+		bindingIDs[raw.ID] = true
+		if !instanceIDs[raw.InstanceID] {
+			existing, err := dst.GetInstance(raw.InstanceID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if existing == nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("binding %s references unknown instance %s", raw.ID, raw.InstanceID))
+				continue
+			}
+		}
+
+		binding := raw.Clone()
+		if err := openSecrets(encrypted, bindingSecrets(binding)); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("binding %s: %v", raw.ID, err))
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+
+	for i, op := range exp.Operations {
+		if op == nil || op.ID == "" || op.InstanceID == "" {
+			report.Errors = append(report.Errors, fmt.Sprintf("operation %d has no ID or instance ID", i))
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		return nil, nil, ErrInvalidExport
+	}
+	return instances, bindings, nil
+}
+
+// openSecrets decrypts sealed secret fields in place with the keyring of
+// encrypted. Without an encrypted target, sealed values cannot be imported.
+func openSecrets(encrypted *EncryptedStore, fields []secretField) error {
+	for _, field := range fields {
+		if !isSealed(*field.value) {
+			continue
+		}
+		if encrypted == nil {
+			return fmt.Errorf("secrets are encrypted but the target store has no encryption keys")
+		}
+		value, err := encrypted.keyring.open(*field.value, field.aad)
+		if err != nil {
+			return err
+		}
+		*field.value = value
+	}
+	return nil
+}
+
+// checkSchemaVersion rejects an export whose schema version differs from a
+// target store that already holds records. It reports whether the target
+// is empty and should adopt the export's version, so that the broker
+// migrates the imported records forward on its next start.
+func checkSchemaVersion(dst Store, exp *Export, report *ImportReport) (bool, error) {
+	versioned, ok := dst.(Versioned)
+	if !ok {
+		return false, nil
+	}
+	current, err := versioned.SchemaVersion()
+	if err != nil {
+		return false, err
+	}
+	if current == exp.SchemaVersion {
+		return false, nil
+	}
+
+	instances, err := dst.ListInstances()
+	if err != nil {
+		return false, err
+	}
+	if len(instances) == 0 {
+		return true, nil
+	}
+	report.Errors = append(report.Errors, fmt.Sprintf(
+		"export has schema version %d but the target store holds records at version %d", exp.SchemaVersion, current))
+	return false, ErrInvalidExport
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Migration upgrades records written by an older broker to a newer schema
+// version. Instance and Binding are called for every stored record and
+// report whether they changed it; either may be nil.
+type Migration struct {
+	Version     int
+	Description string
+	Instance    func(instance *ServiceInstance) (bool, error)
+	Binding     func(binding *ServiceBinding) (bool, error)
+}
+
+// Versioned is implemented by stores that track a schema version
+type Versioned interface {
+	// SchemaVersion returns the version of the last migration applied to the store
+	SchemaVersion() (int, error)
+	// SetSchemaVersion records that all migrations up to version have been applied
+	SetSchemaVersion(version int) error
+	// Backup copies the current state aside and returns where it was written
+	Backup(label string) (string, error)
+}
+
+// Migrate applies every migration newer than the store's schema version, in
+// order. A backup is taken before the first pending migration runs, and the
+// schema version is recorded after each migration so that an interrupted run
+// resumes where it stopped.
+func Migrate(s Store, migrations []Migration) error {
+	versioned, ok := s.(Versioned)
+	if !ok {
+		return fmt.Errorf("state store does not support schema versioning")
+	}
+
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i, m := range sorted {
+		if m.Version <= 0 || (i > 0 && m.Version == sorted[i-1].Version) {
+			return fmt.Errorf("invalid or duplicate migration version %d", m.Version)
+		}
+	}
+
+	current, err := versioned.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	pending := make([]Migration, 0)
+	for _, m := range sorted {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	target := pending[len(pending)-1].Version
+	backup, err := versioned.Backup(fmt.Sprintf("v%d-to-v%d", current, target))
+	if err != nil {
+		return fmt.Errorf("failed to back up state before migration: %w", err)
+	}
+	log.Printf("Migrating state store from schema version %d to %d (backup: %s)", current, target, backup)
+
+	for _, m := range pending {
+		changed, err := applyMigration(s, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+		if err := versioned.SetSchemaVersion(m.Version); err != nil {
+			return fmt.Errorf("failed to record schema version %d: %w", m.Version, err)
+		}
+		log.Printf("Applied state migration %d (%s): %d record(s) changed", m.Version, m.Description, changed)
+	}
+
+	return nil
+}
+
+func applyMigration(s Store, m Migration) (int, error) {
+	changed := 0
+
+	if m.Instance != nil {
+		instances, err := s.ListInstances()
+		if err != nil {
+			return changed, err
+		}
+		for _, instance := range instances {
+			ok, err := m.Instance(instance)
+			if err != nil {
+				return changed, fmt.Errorf("instance %s: %w", instance.ID, err)
+			}
+			if !ok {
+				continue
+			}
+			if err := s.SaveInstance(instance); err != nil {
+				return changed, fmt.Errorf("instance %s: %w", instance.ID, err)
+			}
+			changed++
+		}
+	}
+
+	if m.Binding != nil {
+		bindings, err := s.ListBindings()
+		if err != nil {
+			return changed, err
+		}
+		for _, binding := range bindings {
+			ok, err := m.Binding(binding)
+			if err != nil {
+				return changed, fmt.Errorf("binding %s: %w", binding.ID, err)
+			}
+			if !ok {
+				continue
+			}
+			if err := s.SaveBinding(binding); err != nil {
+				return changed, fmt.Errorf("binding %s: %w", binding.ID, err)
+			}
+			changed++
+		}
+	}
+
+	return changed, nil
+}
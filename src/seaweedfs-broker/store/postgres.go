@@ -0,0 +1,473 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultPsqlPath is the psql binary installed by the postgresql-client package
+const DefaultPsqlPath = "/var/vcap/packages/postgresql-client/bin/psql"
+
+// postgresMigrations are applied in order by NewPostgresStore. Each entry runs
+// in its own transaction and is recorded in broker_schema_migrations, so new
+// entries must only ever be appended.
+var postgresMigrations = []string{
+	// 1: initial instance and binding tables
+	`CREATE TABLE IF NOT EXISTS service_instances (
+		id         text PRIMARY KEY,
+		data       jsonb NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS service_bindings (
+		id          text PRIMARY KEY,
+		instance_id text NOT NULL,
+		data        jsonb NOT NULL,
+		created_at  timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS service_bindings_instance_id_idx ON service_bindings (instance_id);`,
+
+	// 2: revision columns for optimistic concurrency
+	`ALTER TABLE service_instances ADD COLUMN IF NOT EXISTS revision bigint NOT NULL DEFAULT 0;
+	ALTER TABLE service_bindings ADD COLUMN IF NOT EXISTS revision bigint NOT NULL DEFAULT 0;
+	UPDATE service_instances SET revision = coalesce((data->>'revision')::bigint, 0);
+	UPDATE service_bindings SET revision = coalesce((data->>'revision')::bigint, 0);`,
+
+	// 3: broker metadata, holding the state schema version used by store.Migrate
+	`CREATE TABLE IF NOT EXISTS broker_metadata (
+		key   text PRIMARY KEY,
+		value text NOT NULL
+	);`,
+
+	// 4: operation history
+	`CREATE TABLE IF NOT EXISTS service_operations (
+		id          text PRIMARY KEY,
+		instance_id text NOT NULL,
+		data        jsonb NOT NULL,
+		started_at  timestamptz NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS service_operations_instance_id_idx ON service_operations (instance_id);`,
+}
+
+// PostgresStore implements Store using a PostgreSQL database.
+// Statements are executed through the psql client from the postgresql-client
+// package, so the broker binary needs no cgo or vendored database driver.
+type PostgresStore struct {
+	psqlPath string
+	env      []string
+	timeout  time.Duration
+}
+
+// NewPostgresStore creates a new PostgreSQL-backed store and migrates its schema
+func NewPostgresStore(databaseURL, psqlPath string) (*PostgresStore, error) {
+	if databaseURL == "" {
+		return nil, fmt.Errorf("database_url is required for the database state store")
+	}
+	if psqlPath == "" {
+		psqlPath = DefaultPsqlPath
+	}
+
+	env, err := connectionEnv(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &PostgresStore{
+		psqlPath: psqlPath,
+		env:      env,
+		timeout:  30 * time.Second,
+	}
+
+	if err := store.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database schema: %w", err)
+	}
+
+	return store, nil
+}
+
+// connectionEnv translates a postgres:// URL into libpq environment variables.
+// Passing the connection through the environment keeps the password out of
+// the process list.
+func connectionEnv(databaseURL string) ([]string, error) {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database_url: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("invalid database_url: unsupported scheme %q", u.Scheme)
+	}
+
+	env := []string{"PGCONNECT_TIMEOUT=10", "PGAPPNAME=seaweedfs-broker"}
+	if host := u.Hostname(); host != "" {
+		env = append(env, "PGHOST="+host)
+	}
+	if port := u.Port(); port != "" {
+		env = append(env, "PGPORT="+port)
+	}
+	if u.User != nil {
+		env = append(env, "PGUSER="+u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			env = append(env, "PGPASSWORD="+password)
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		env = append(env, "PGDATABASE="+db)
+	}
+	query := u.Query()
+	if sslMode := query.Get("sslmode"); sslMode != "" {
+		env = append(env, "PGSSLMODE="+sslMode)
+	}
+	if sslRootCert := query.Get("sslrootcert"); sslRootCert != "" {
+		env = append(env, "PGSSLROOTCERT="+sslRootCert)
+	}
+
+	return env, nil
+}
+
+func (s *PostgresStore) migrate() error {
+	if _, err := s.exec(`CREATE TABLE IF NOT EXISTS broker_schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	);`); err != nil {
+		return err
+	}
+
+	rows, err := s.exec(`SELECT coalesce(max(version), 0) FROM broker_schema_migrations;`)
+	if err != nil {
+		return err
+	}
+	current := 0
+	if len(rows) > 0 {
+		if _, err := fmt.Sscanf(rows[0], "%d", &current); err != nil {
+			return fmt.Errorf("invalid migration version %q: %w", rows[0], err)
+		}
+	}
+
+	for i := current; i < len(postgresMigrations); i++ {
+		version := i + 1
+		sql := fmt.Sprintf("%s\nINSERT INTO broker_schema_migrations (version) VALUES (%d) ON CONFLICT DO NOTHING;",
+			postgresMigrations[i], version)
+		if _, err := s.exec(sql); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// exec runs a SQL script in a single transaction and returns one entry per
+// result row. Scripts are fed on stdin so that data never appears in argv.
+func (s *PostgresStore) exec(sql string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.psqlPath,
+		"--no-psqlrc",
+		"--quiet",
+		"--tuples-only",
+		"--no-align",
+		"--single-transaction",
+		"--set", "ON_ERROR_STOP=1",
+		"--file", "-",
+	)
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdin = strings.NewReader("SET standard_conforming_strings = on;\n" + sql)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("psql failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	rows := make([]string, 0)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			rows = append(rows, line)
+		}
+	}
+	return rows, nil
+}
+
+// quoteLiteral quotes a string for use as a SQL literal.
+// Relies on standard_conforming_strings, which exec always enables.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// GetInstance retrieves a service instance by ID
+func (s *PostgresStore) GetInstance(instanceID string) (*ServiceInstance, error) {
+	rows, err := s.exec(fmt.Sprintf(`SELECT data FROM service_instances WHERE id = %s;`,
+		quoteLiteral(instanceID)))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	var instance ServiceInstance
+	if err := json.Unmarshal([]byte(rows[0]), &instance); err != nil {
+		return nil, fmt.Errorf("failed to decode instance %s: %w", instanceID, err)
+	}
+	return &instance, nil
+}
+
+// SaveInstance saves a service instance
+func (s *PostgresStore) SaveInstance(instance *ServiceInstance) error {
+	saved := instance.Clone()
+	saved.Revision++
+	saved.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	var sql string
+	if instance.Revision == 0 {
+		sql = fmt.Sprintf(`INSERT INTO service_instances (id, data, revision, created_at, updated_at)
+			VALUES (%s, %s::jsonb, %d, now(), now())
+			ON CONFLICT (id) DO NOTHING RETURNING id;`,
+			quoteLiteral(instance.ID), quoteLiteral(string(data)), saved.Revision)
+	} else {
+		sql = fmt.Sprintf(`UPDATE service_instances SET data = %s::jsonb, revision = %d, updated_at = now()
+			WHERE id = %s AND revision = %d RETURNING id;`,
+			quoteLiteral(string(data)), saved.Revision, quoteLiteral(instance.ID), instance.Revision)
+	}
+
+	rows, err := s.exec(sql)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return &ConflictError{Kind: "instance", ID: instance.ID, Revision: instance.Revision}
+	}
+
+	instance.Revision = saved.Revision
+	instance.UpdatedAt = saved.UpdatedAt
+	return nil
+}
+
+// DeleteInstance deletes a service instance
+func (s *PostgresStore) DeleteInstance(instanceID string) error {
+	_, err := s.exec(fmt.Sprintf(`DELETE FROM service_instances WHERE id = %s;`,
+		quoteLiteral(instanceID)))
+	return err
+}
+
+// ListInstances returns all service instances
+func (s *PostgresStore) ListInstances() ([]*ServiceInstance, error) {
+	rows, err := s.exec(`SELECT data FROM service_instances ORDER BY created_at;`)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]*ServiceInstance, 0, len(rows))
+	for _, row := range rows {
+		var instance ServiceInstance
+		if err := json.Unmarshal([]byte(row), &instance); err != nil {
+			return nil, fmt.Errorf("failed to decode instance: %w", err)
+		}
+		instances = append(instances, &instance)
+	}
+	return instances, nil
+}
+
+// GetBinding retrieves a service binding by ID
+func (s *PostgresStore) GetBinding(bindingID string) (*ServiceBinding, error) {
+	rows, err := s.exec(fmt.Sprintf(`SELECT data FROM service_bindings WHERE id = %s;`,
+		quoteLiteral(bindingID)))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	var binding ServiceBinding
+	if err := json.Unmarshal([]byte(rows[0]), &binding); err != nil {
+		return nil, fmt.Errorf("failed to decode binding %s: %w", bindingID, err)
+	}
+	return &binding, nil
+}
+
+// SaveBinding saves a service binding
+func (s *PostgresStore) SaveBinding(binding *ServiceBinding) error {
+	saved := binding.Clone()
+	saved.Revision++
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	var sql string
+	if binding.Revision == 0 {
+		sql = fmt.Sprintf(`INSERT INTO service_bindings (id, instance_id, data, revision, created_at)
+			VALUES (%s, %s, %s::jsonb, %d, now())
+			ON CONFLICT (id) DO NOTHING RETURNING id;`,
+			quoteLiteral(binding.ID), quoteLiteral(binding.InstanceID), quoteLiteral(string(data)), saved.Revision)
+	} else {
+		sql = fmt.Sprintf(`UPDATE service_bindings SET instance_id = %s, data = %s::jsonb, revision = %d
+			WHERE id = %s AND revision = %d RETURNING id;`,
+			quoteLiteral(binding.InstanceID), quoteLiteral(string(data)), saved.Revision,
+			quoteLiteral(binding.ID), binding.Revision)
+	}
+
+	rows, err := s.exec(sql)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return &ConflictError{Kind: "binding", ID: binding.ID, Revision: binding.Revision}
+	}
+
+	binding.Revision = saved.Revision
+	return nil
+}
+
+// DeleteBinding deletes a service binding
+func (s *PostgresStore) DeleteBinding(bindingID string) error {
+	_, err := s.exec(fmt.Sprintf(`DELETE FROM service_bindings WHERE id = %s;`,
+		quoteLiteral(bindingID)))
+	return err
+}
+
+// ListBindings returns all service bindings
+func (s *PostgresStore) ListBindings() ([]*ServiceBinding, error) {
+	rows, err := s.exec(`SELECT data FROM service_bindings ORDER BY created_at;`)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBindings(rows)
+}
+
+// ListBindingsForInstance returns all bindings for a service instance
+func (s *PostgresStore) ListBindingsForInstance(instanceID string) ([]*ServiceBinding, error) {
+	rows, err := s.exec(fmt.Sprintf(`SELECT data FROM service_bindings WHERE instance_id = %s ORDER BY created_at;`,
+		quoteLiteral(instanceID)))
+	if err != nil {
+		return nil, err
+	}
+	return decodeBindings(rows)
+}
+
+func decodeBindings(rows []string) ([]*ServiceBinding, error) {
+	bindings := make([]*ServiceBinding, 0, len(rows))
+	for _, row := range rows {
+		var binding ServiceBinding
+		if err := json.Unmarshal([]byte(row), &binding); err != nil {
+			return nil, fmt.Errorf("failed to decode binding: %w", err)
+		}
+		bindings = append(bindings, &binding)
+	}
+	return bindings, nil
+}
+
+// SaveOperation adds or updates an entry in the operation history
+func (s *PostgresStore) SaveOperation(op *Operation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	// Entries of finished operations are pruned after OperationRetention
+	cutoff := time.Now().Add(-OperationRetention).UTC().Format(time.RFC3339Nano)
+	_, err = s.exec(fmt.Sprintf(`INSERT INTO service_operations (id, instance_id, data, started_at)
+		VALUES (%s, %s, %s::jsonb, %s)
+		ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data;
+		DELETE FROM service_operations
+		WHERE data->>'finished_at' IS NOT NULL AND (data->>'finished_at')::timestamptz < %s;`,
+		quoteLiteral(op.ID), quoteLiteral(op.InstanceID), quoteLiteral(string(data)),
+		quoteLiteral(op.StartedAt.UTC().Format(time.RFC3339Nano)), quoteLiteral(cutoff)))
+	return err
+}
+
+// ListOperations returns the complete operation history, oldest first
+func (s *PostgresStore) ListOperations() ([]*Operation, error) {
+	rows, err := s.exec(`SELECT data FROM service_operations ORDER BY started_at, id;`)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOperations(rows)
+}
+
+// ListOperationsForInstance returns the operation history of a service
+// instance and its bindings, oldest first
+func (s *PostgresStore) ListOperationsForInstance(instanceID string) ([]*Operation, error) {
+	rows, err := s.exec(fmt.Sprintf(`SELECT data FROM service_operations WHERE instance_id = %s ORDER BY started_at, id;`,
+		quoteLiteral(instanceID)))
+	if err != nil {
+		return nil, err
+	}
+	return decodeOperations(rows)
+}
+
+func decodeOperations(rows []string) ([]*Operation, error) {
+	ops := make([]*Operation, 0, len(rows))
+	for _, row := range rows {
+		var op Operation
+		if err := json.Unmarshal([]byte(row), &op); err != nil {
+			return nil, fmt.Errorf("failed to decode operation: %w", err)
+		}
+		ops = append(ops, &op)
+	}
+	return ops, nil
+}
+
+// SchemaVersion returns the state schema version stored in broker_metadata
+func (s *PostgresStore) SchemaVersion() (int, error) {
+	rows, err := s.exec(`SELECT value FROM broker_metadata WHERE key = 'schema_version';`)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(rows[0], "%d", &version); err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", rows[0], err)
+	}
+	return version, nil
+}
+
+// SetSchemaVersion records the state schema version in broker_metadata
+func (s *PostgresStore) SetSchemaVersion(version int) error {
+	_, err := s.exec(fmt.Sprintf(`INSERT INTO broker_metadata (key, value) VALUES ('schema_version', '%d')
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value;`, version))
+	return err
+}
+
+// Backup copies the instance and binding tables into timestamped backup tables
+func (s *PostgresStore) Backup(label string) (string, error) {
+	// Table names cannot be quoted as literals, so reduce the label to [a-z0-9_]
+	safeLabel := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return '_'
+	}, label)
+	suffix := safeLabel + "_" + time.Now().UTC().Format("20060102t150405z")
+	instancesTable := "service_instances_backup_" + suffix
+	bindingsTable := "service_bindings_backup_" + suffix
+
+	_, err := s.exec(fmt.Sprintf(`CREATE TABLE %s AS TABLE service_instances;
+		CREATE TABLE %s AS TABLE service_bindings;`, instancesTable, bindingsTable))
+	if err != nil {
+		return "", err
+	}
+	return instancesTable + ", " + bindingsTable, nil
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePsql is a PostgresStore whose psql records the script it is fed and
+// prints the rows set with respond
+type fakePsql struct {
+	*PostgresStore
+	sqlPath string
+	rows    string
+}
+
+func newFakePsql(t *testing.T) *fakePsql {
+	t.Helper()
+	dir := t.TempDir()
+	psqlPath := filepath.Join(dir, "psql")
+	script := "#!/bin/sh\ncat > \"$FAKE_PSQL_SQL\"\nprintf '%s' \"$FAKE_PSQL_ROWS\"\n"
+	if err := os.WriteFile(psqlPath, []byte(script), 0700); err != nil {
+		t.Fatalf("writing fake psql: %v", err)
+	}
+	return &fakePsql{
+		PostgresStore: &PostgresStore{psqlPath: psqlPath, timeout: 10 * time.Second},
+		sqlPath:       filepath.Join(dir, "script.sql"),
+	}
+}
+
+func (f *fakePsql) respond(rows ...string) {
+	f.env = []string{"FAKE_PSQL_SQL=" + f.sqlPath, "FAKE_PSQL_ROWS=" + strings.Join(rows, "\n")}
+}
+
+func (f *fakePsql) lastSQL(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile(f.sqlPath)
+	if err != nil {
+		t.Fatalf("reading executed SQL: %v", err)
+	}
+	return string(data)
+}
+
+func TestPostgresSaveInstanceSQL(t *testing.T) {
+	s := newFakePsql(t)
+	instance := testInstance("i1")
+	instance.StateMessage = "it's quoted"
+
+	s.respond("i1")
+	if err := s.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	sql := s.lastSQL(t)
+	if !strings.Contains(sql, "INSERT INTO service_instances") || !strings.Contains(sql, "ON CONFLICT (id) DO NOTHING RETURNING id") {
+		t.Errorf("expected a conditional insert for a new instance, got:\n%s", sql)
+	}
+	if !strings.Contains(sql, "it''s quoted") {
+		t.Errorf("expected quotes in the data to be escaped, got:\n%s", sql)
+	}
+	if instance.Revision != 1 {
+		t.Errorf("expected revision 1, got %d", instance.Revision)
+	}
+
+	instance.State = "updated"
+	if err := s.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	sql = s.lastSQL(t)
+	if !strings.Contains(sql, "revision = 2") || !strings.Contains(sql, "WHERE id = 'i1' AND revision = 1 RETURNING id") {
+		t.Errorf("expected an update guarded by the previous revision, got:\n%s", sql)
+	}
+	if instance.Revision != 2 {
+		t.Errorf("expected revision 2, got %d", instance.Revision)
+	}
+}
+
+func TestPostgresSaveInstanceConflict(t *testing.T) {
+	s := newFakePsql(t)
+	instance := testInstance("i1")
+	instance.Revision = 3
+
+	// No row returned means the guarded update matched nothing
+	s.respond()
+	err := s.SaveInstance(instance)
+	if !IsConflict(err) {
+		t.Fatalf("expected a ConflictError, got %v", err)
+	}
+	if instance.Revision != 3 {
+		t.Errorf("a failed save changed the caller's revision to %d", instance.Revision)
+	}
+}
+
+func TestPostgresSaveBindingSQL(t *testing.T) {
+	s := newFakePsql(t)
+	binding := testBinding("b1", "i1")
+
+	s.respond("b1")
+	if err := s.SaveBinding(binding); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+	if sql := s.lastSQL(t); !strings.Contains(sql, "INSERT INTO service_bindings") || !strings.Contains(sql, "'i1'") {
+		t.Errorf("expected an insert with the instance ID, got:\n%s", sql)
+	}
+
+	s.respond()
+	if err := s.SaveBinding(binding); !IsConflict(err) {
+		t.Fatalf("expected a ConflictError, got %v", err)
+	}
+	if sql := s.lastSQL(t); !strings.Contains(sql, "WHERE id = 'b1' AND revision = 1 RETURNING id") {
+		t.Errorf("expected an update guarded by the previous revision, got:\n%s", sql)
+	}
+	if binding.Revision != 1 {
+		t.Errorf("a failed save changed the caller's revision to %d", binding.Revision)
+	}
+}
+
+func TestPostgresGetInstanceDecodes(t *testing.T) {
+	s := newFakePsql(t)
+	data, err := json.Marshal(testInstance("i1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.respond(string(data))
+	got, err := s.GetInstance("i1")
+	if err != nil || got == nil {
+		t.Fatalf("GetInstance: %v, %v", got, err)
+	}
+	assertInstanceUnchanged(t, got)
+	if sql := s.lastSQL(t); !strings.Contains(sql, "WHERE id = 'i1'") {
+		t.Errorf("unexpected query:\n%s", sql)
+	}
+
+	s.respond()
+	if got, err := s.GetInstance("missing"); got != nil || err != nil {
+		t.Errorf("expected no instance, got %v, %v", got, err)
+	}
+}
+
+func TestPostgresMigrateRejectsInvalidVersion(t *testing.T) {
+	s := newFakePsql(t)
+	s.respond("not-a-number")
+	err := s.migrate()
+	if err == nil || !strings.Contains(err.Error(), "invalid migration version") {
+		t.Fatalf("expected an invalid migration version error, got %v", err)
+	}
+	// No migration may run against a database in an unknown state
+	if strings.Contains(s.lastSQL(t), "INSERT INTO broker_schema_migrations") {
+		t.Error("migrations ran despite the unreadable version")
+	}
+}
@@ -2,9 +2,13 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,6 +27,8 @@ type ServiceInstance struct {
 
 	// For shared plan instances
 	BucketName string `json:"bucket_name,omitempty"`
+	// Buckets are the instance's buckets besides BucketName
+	Buckets []Bucket `json:"buckets,omitempty"`
 
 	// For dedicated plan instances
 	DeploymentName string `json:"deployment_name,omitempty"`
@@ -37,9 +43,33 @@ type ServiceInstance struct {
 	AdminSecretKey string `json:"admin_secret_key,omitempty"`
 	AdminPassword  string `json:"admin_password,omitempty"`
 
+	// MaintenanceVersion is the maintenance_info version the dedicated
+	// cluster was last deployed with
+	MaintenanceVersion string `json:"maintenance_version,omitempty"`
+	// UpdatePlanID is the plan a dedicated cluster is being redeployed with
+	// while it is updating
+	UpdatePlanID string `json:"update_plan_id,omitempty"`
+
 	// Provisioning state
 	State        string `json:"state"` // provisioning, succeeded, failed
 	StateMessage string `json:"state_message,omitempty"`
+
+	// Set when a deprovisioned instance is kept for the retention period
+	TombstonedAt *time.Time `json:"tombstoned_at,omitempty"`
+	PurgeAt      *time.Time `json:"purge_at,omitempty"`
+
+	// Storage usage of a shared bucket, as last measured against its plan's
+	// quota. While QuotaExceeded is set its bindings have read-only access.
+	UsageBytes     int64      `json:"usage_bytes,omitempty"`
+	UsageCheckedAt *time.Time `json:"usage_checked_at,omitempty"`
+	QuotaExceeded  bool       `json:"quota_exceeded,omitempty"`
+
+	// Identities of the provision request that created the instance
+	OriginatingIdentity *Identity `json:"originating_identity,omitempty"`
+	RequestIdentity     string    `json:"request_identity,omitempty"`
+
+	// Revision is incremented on every save and used to reject stale writes
+	Revision int64 `json:"revision"`
 }
 
 // ServiceBinding represents a service binding
@@ -50,21 +80,279 @@ type ServiceBinding struct {
 	Parameters map[string]any `json:"parameters,omitempty"`
 	CreatedAt  time.Time      `json:"created_at"`
 
+	// SpaceGUID is the space the binding was created from; it differs from
+	// the instance's space when the instance is shared
+	SpaceGUID string `json:"space_guid,omitempty"`
+	// Buckets are the names of the instance buckets the binding can access;
+	// empty for all of them
+	Buckets []string `json:"buckets,omitempty"`
+	// Access is read-only or read-write; empty for older bindings, which
+	// have read-write access
+	Access string `json:"access,omitempty"`
+	// Permissions are the effective permissions of the binding's key: read,
+	// write, readwrite or admin; empty for older bindings, whose access
+	// follows Access alone
+	Permissions string `json:"permissions,omitempty"`
+	// Prefix restricts object access to keys starting with it
+	Prefix string `json:"prefix,omitempty"`
+
 	// Credentials
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
 
 	// IAM identity info for cleanup
 	IAMUserName string `json:"iam_user_name,omitempty"`
+
+	// Binding state; empty for bindings created synchronously by older
+	// broker versions, which are complete
+	State        string `json:"state,omitempty"` // binding, succeeded, unbinding, failed
+	StateMessage string `json:"state_message,omitempty"`
+
+	// ExpiresAt is when the binding's credentials expire, if it has a TTL
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Credential rotation. A binding created with predecessor_binding_id
+	// records its predecessor; the predecessor records its successor and when
+	// its access key is deactivated.
+	PredecessorBindingID string     `json:"predecessor_binding_id,omitempty"`
+	SuccessorBindingID   string     `json:"successor_binding_id,omitempty"`
+	KeyDeactivateAt      *time.Time `json:"key_deactivate_at,omitempty"`
+	KeyDeactivated       bool       `json:"key_deactivated,omitempty"`
+
+	// Identities of the bind request that created the binding
+	OriginatingIdentity *Identity `json:"originating_identity,omitempty"`
+	RequestIdentity     string    `json:"request_identity,omitempty"`
+
+	// Revision is incremented on every save and used to reject stale writes
+	Revision int64 `json:"revision"`
+}
+
+// Bucket is an additional bucket of a shared instance
+type Bucket struct {
+	// Name identifies the bucket in parameters and binding credentials
+	Name string `json:"name"`
+	// BucketName is the name of the bucket on the cluster
+	BucketName string `json:"bucket_name"`
+}
+
+// Operation types recorded in the operation history
+const (
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationBind        = "bind"
+	OperationUnbind      = "unbind"
+	OperationUpgrade     = "upgrade"
+	OperationRecreate    = "recreate"
+	OperationDeprovision = "deprovision"
+	OperationRestore     = "restore"
+	OperationPurge       = "purge"
+)
+
+// Operation states, matching the OSB last_operation states
+const (
+	OperationInProgress = "in progress"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+)
+
+// Identity is the caller identity sent by the platform in the
+// X-Broker-API-Originating-Identity header
+type Identity struct {
+	Platform string         `json:"platform"`
+	Value    map[string]any `json:"value,omitempty"`
+}
+
+// UserID returns the user_id sent by Cloud Foundry, or an empty string for
+// other platforms
+func (i *Identity) UserID() string {
+	if i == nil {
+		return ""
+	}
+	userID, _ := i.Value["user_id"].(string)
+	return userID
+}
+
+// Operation is one entry in the history of a service instance or binding.
+// Entries are kept after the instance is deleted and are only updated to
+// record the outcome of the operation they describe.
+type Operation struct {
+	ID                  string     `json:"id"`
+	InstanceID          string     `json:"instance_id"`
+	BindingID           string     `json:"binding_id,omitempty"`
+	Type                string     `json:"type"`
+	State               string     `json:"state"`
+	StartedAt           time.Time  `json:"started_at"`
+	FinishedAt          *time.Time `json:"finished_at,omitempty"`
+	BOSHTaskIDs         []int      `json:"bosh_task_ids,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	OriginatingIdentity *Identity  `json:"originating_identity,omitempty"`
+	RequestIdentity     string     `json:"request_identity,omitempty"`
+}
+
+// Clone returns a deep copy of the instance
+func (i *ServiceInstance) Clone() *ServiceInstance {
+	c := *i
+	c.Parameters = cloneMap(i.Parameters)
+	c.Context = cloneMap(i.Context)
+	c.TombstonedAt = cloneTime(i.TombstonedAt)
+	c.PurgeAt = cloneTime(i.PurgeAt)
+	c.UsageCheckedAt = cloneTime(i.UsageCheckedAt)
+	c.Buckets = append([]Bucket(nil), i.Buckets...)
+	c.OriginatingIdentity = cloneIdentity(i.OriginatingIdentity)
+	return &c
+}
+
+// AllBuckets returns the names on the cluster of all of the instance's
+// buckets, starting with BucketName
+func (i *ServiceInstance) AllBuckets() []string {
+	if i.BucketName == "" {
+		return nil
+	}
+	names := []string{i.BucketName}
+	for _, bucket := range i.Buckets {
+		names = append(names, bucket.BucketName)
+	}
+	return names
+}
+
+// Tombstoned reports whether the instance was deprovisioned and is only
+// kept until its data is purged
+func (i *ServiceInstance) Tombstoned() bool {
+	return i.TombstonedAt != nil
+}
+
+// Clone returns a deep copy of the binding
+func (b *ServiceBinding) Clone() *ServiceBinding {
+	c := *b
+	c.Parameters = cloneMap(b.Parameters)
+	c.Buckets = append([]string(nil), b.Buckets...)
+	c.ExpiresAt = cloneTime(b.ExpiresAt)
+	c.KeyDeactivateAt = cloneTime(b.KeyDeactivateAt)
+	c.OriginatingIdentity = cloneIdentity(b.OriginatingIdentity)
+	return &c
+}
+
+// Ready reports whether the binding's credentials have been created
+func (b *ServiceBinding) Ready() bool {
+	return b.State == "" || b.State == "succeeded"
+}
+
+// KeyExpiry returns when the binding's access key is deactivated, because
+// the binding expires or was rotated, or nil if the key does not expire
+func (b *ServiceBinding) KeyExpiry() *time.Time {
+	expiry := b.ExpiresAt
+	if b.KeyDeactivateAt != nil && (expiry == nil || b.KeyDeactivateAt.Before(*expiry)) {
+		expiry = b.KeyDeactivateAt
+	}
+	return expiry
+}
+
+// Clone returns a deep copy of the operation
+func (o *Operation) Clone() *Operation {
+	c := *o
+	c.FinishedAt = cloneTime(o.FinishedAt)
+	if o.BOSHTaskIDs != nil {
+		c.BOSHTaskIDs = append([]int(nil), o.BOSHTaskIDs...)
+	}
+	c.OriginatingIdentity = cloneIdentity(o.OriginatingIdentity)
+	return &c
+}
+
+func cloneIdentity(i *Identity) *Identity {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	c.Value = cloneMap(i.Value)
+	return &c
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func cloneMap(m map[string]any) map[string]any {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]any, len(m))
+	for k, v := range m {
+		c[k] = cloneValue(v)
+	}
+	return c
+}
+
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return cloneMap(v)
+	case []any:
+		c := make([]any, len(v))
+		for i, item := range v {
+			c[i] = cloneValue(item)
+		}
+		return c
+	default:
+		return v
+	}
 }
 
 // State represents the complete broker state
 type State struct {
-	Instances map[string]*ServiceInstance `json:"instances"`
-	Bindings  map[string]*ServiceBinding  `json:"bindings"`
+	// SchemaVersion is the version of the last migration applied (see Migrate)
+	SchemaVersion int                         `json:"schema_version"`
+	Instances     map[string]*ServiceInstance `json:"instances"`
+	Bindings      map[string]*ServiceBinding  `json:"bindings"`
+	// Operations is only read, from state files written before FileStore
+	// kept the operation history in a file of its own
+	Operations map[string]*Operation `json:"operations,omitempty"`
 }
 
-// Store is the interface for persisting broker state
+// OperationRetention is how long the operation history keeps entries of
+// finished operations
+const OperationRetention = 90 * 24 * time.Hour
+
+// maxFileOperations caps the entries in the operation history of a
+// FileStore, which rewrites the whole history on every operation update
+const maxFileOperations = 10000
+
+// ErrConflict is matched by errors.Is for every *ConflictError
+var ErrConflict = errors.New("revision conflict")
+
+// ConflictError is returned by SaveInstance and SaveBinding when the record
+// was changed or deleted since the caller read it
+type ConflictError struct {
+	Kind     string // "instance" or "binding"
+	ID       string
+	Revision int64 // revision the caller attempted to update
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s was modified concurrently (expected revision %d)", e.Kind, e.ID, e.Revision)
+}
+
+// Is makes errors.Is(err, ErrConflict) match any ConflictError
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// IsConflict reports whether err is a revision conflict
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// Store is the interface for persisting broker state.
+// Getters return copies that callers may modify freely. Save methods only
+// succeed if the record's Revision still matches the stored one (0 for a new
+// record); on success they increment Revision on the caller's copy, and on a
+// stale write they return a *ConflictError.
+// Operations are a history: SaveOperation adds an entry or updates the
+// entry with the same ID. Entries are only deleted once their operation has
+// finished, after OperationRetention.
 type Store interface {
 	GetInstance(instanceID string) (*ServiceInstance, error)
 	SaveInstance(instance *ServiceInstance) error
@@ -74,49 +362,171 @@ type Store interface {
 	GetBinding(bindingID string) (*ServiceBinding, error)
 	SaveBinding(binding *ServiceBinding) error
 	DeleteBinding(bindingID string) error
+	ListBindings() ([]*ServiceBinding, error)
 	ListBindingsForInstance(instanceID string) ([]*ServiceBinding, error)
+
+	SaveOperation(op *Operation) error
+	ListOperations() ([]*Operation, error)
+	ListOperationsForInstance(instanceID string) ([]*Operation, error)
 }
 
-// FileStore implements Store using a JSON file
+// FileStore implements Store using a JSON file.
+// Every save is written to a temporary file, fsynced and atomically renamed
+// over the state file, so a crash can never leave a truncated state.json.
+// The previous generations are kept as state.json.1 (newest) to
+// state.json.N and are used as a fallback when the state file is unreadable.
+// The operation history changes far more often than the state, so it is
+// kept in state.operations.json, which is written the same way but without
+// snapshots.
 type FileStore struct {
-	path  string
-	mu    sync.RWMutex
-	state *State
+	path           string
+	operationsPath string
+	snapshots      int
+	mu             sync.RWMutex
+	state          *State
+	operations     map[string]*Operation
 }
 
-// NewFileStore creates a new file-based store
-func NewFileStore(path string) (*FileStore, error) {
+// NewFileStore creates a new file-based store that keeps the given number of
+// previous state generations
+func NewFileStore(path string, snapshots int) (*FileStore, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create state directory: %w", err)
 	}
 
 	store := &FileStore{
-		path: path,
+		path:           path,
+		operationsPath: strings.TrimSuffix(path, ".json") + ".operations.json",
+		snapshots:      snapshots,
 		state: &State{
 			Instances: make(map[string]*ServiceInstance),
 			Bindings:  make(map[string]*ServiceBinding),
 		},
+		operations: make(map[string]*Operation),
 	}
 
-	// Load existing state if file exists
-	if _, err := os.Stat(path); err == nil {
+	// Load existing state if the file or any snapshot exists
+	if store.hasState() {
 		if err := store.load(); err != nil {
 			return nil, fmt.Errorf("failed to load state: %w", err)
 		}
 	}
+	if err := store.loadOperations(); err != nil {
+		return nil, fmt.Errorf("failed to load operation history: %w", err)
+	}
 
 	return store, nil
 }
 
+// snapshotPath returns the path of the n-th previous generation (1 is newest)
+func (s *FileStore) snapshotPath(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// PurgeSnapshots removes the previous generations of the state file, for
+// example once the secrets they hold in plaintext were re-encrypted
+func (s *FileStore) PurgeSnapshots() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n := 1; n <= s.snapshots; n++ {
+		if err := os.Remove(s.snapshotPath(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) hasState() bool {
+	if _, err := os.Stat(s.path); err == nil {
+		return true
+	}
+	for n := 1; n <= s.snapshots; n++ {
+		if _, err := os.Stat(s.snapshotPath(n)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the state file, falling back to the newest readable snapshot
+// if the state file is missing or corrupt
 func (s *FileStore) load() error {
-	data, err := os.ReadFile(s.path)
+	err := s.loadFrom(s.path)
+	if err == nil {
+		return nil
+	}
+
+	for n := 1; n <= s.snapshots; n++ {
+		snapshot := s.snapshotPath(n)
+		if snapErr := s.loadFrom(snapshot); snapErr != nil {
+			if !os.IsNotExist(snapErr) {
+				log.Printf("Warning: state snapshot %s is unreadable: %v", snapshot, snapErr)
+			}
+			continue
+		}
+		log.Printf("WARNING: state file %s is unreadable (%v), recovered state from snapshot %s", s.path, err, snapshot)
+		return nil
+	}
+
+	return err
+}
+
+func (s *FileStore) loadFrom(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(data, s.state)
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("corrupt state in %s: %w", path, err)
+	}
+	if state.Instances == nil {
+		state.Instances = make(map[string]*ServiceInstance)
+	}
+	if state.Bindings == nil {
+		state.Bindings = make(map[string]*ServiceBinding)
+	}
+
+	s.state = state
+	return nil
+}
+
+// loadOperations reads the operation history file and moves the entries of
+// state files written by older versions into it. A state file keeps them
+// until it is next saved, so the move is repeated if it is interrupted.
+func (s *FileStore) loadOperations() error {
+	data, err := os.ReadFile(s.operationsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.operations); err != nil {
+			return fmt.Errorf("corrupt operation history in %s: %w", s.operationsPath, err)
+		}
+		if s.operations == nil {
+			s.operations = make(map[string]*Operation)
+		}
+	}
+
+	if len(s.state.Operations) == 0 {
+		s.state.Operations = nil
+		return nil
+	}
+	for id, op := range s.state.Operations {
+		if _, exists := s.operations[id]; !exists {
+			s.operations[id] = op
+		}
+	}
+	s.pruneOperations(time.Now())
+	if err := s.saveOperations(); err != nil {
+		return err
+	}
+	s.state.Operations = nil
+	return nil
 }
 
 func (s *FileStore) save() error {
@@ -124,8 +534,105 @@ func (s *FileStore) save() error {
 	if err != nil {
 		return err
 	}
+	return writeFile(s.path, data, func() {
+		if err := s.rotateSnapshots(); err != nil {
+			log.Printf("Warning: failed to rotate state snapshots: %v", err)
+		}
+	})
+}
 
-	return os.WriteFile(s.path, data, 0644)
+func (s *FileStore) saveOperations() error {
+	data, err := json.MarshalIndent(s.operations, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.operationsPath, data, nil)
+}
+
+// writeFile atomically replaces path with data, calling beforeReplace, if
+// set, once data is durable and just before path is replaced
+func writeFile(path string, data []byte, beforeReplace func()) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary state file: %w", err)
+	}
+
+	if beforeReplace != nil {
+		beforeReplace()
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// rotateSnapshots shifts state.json.N-1 to state.json.N and hard-links the
+// current state file to state.json.1. The current file stays in place until
+// it is replaced by rename, so there is no window without a state file.
+func (s *FileStore) rotateSnapshots() error {
+	if s.snapshots <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for n := s.snapshots - 1; n >= 1; n-- {
+		if err := os.Rename(s.snapshotPath(n), s.snapshotPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	newest := s.snapshotPath(1)
+	os.Remove(newest)
+	if err := os.Link(s.path, newest); err != nil {
+		return copyFile(s.path, newest)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0600)
+}
+
+// syncDir fsyncs a directory so that a preceding rename is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkRevision returns a ConflictError unless expected matches the stored
+// revision, where a missing record has revision 0
+func checkRevision(kind, id string, exists bool, stored, expected int64) error {
+	if (!exists && expected != 0) || (exists && stored != expected) {
+		return &ConflictError{Kind: kind, ID: id, Revision: expected}
+	}
+	return nil
 }
 
 // GetInstance retrieves a service instance by ID
@@ -137,7 +644,7 @@ func (s *FileStore) GetInstance(instanceID string) (*ServiceInstance, error) {
 	if !ok {
 		return nil, nil
 	}
-	return instance, nil
+	return instance.Clone(), nil
 }
 
 // SaveInstance saves a service instance
@@ -145,9 +652,31 @@ func (s *FileStore) SaveInstance(instance *ServiceInstance) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	instance.UpdatedAt = time.Now()
-	s.state.Instances[instance.ID] = instance
-	return s.save()
+	previous, exists := s.state.Instances[instance.ID]
+	var storedRevision int64
+	if exists {
+		storedRevision = previous.Revision
+	}
+	if err := checkRevision("instance", instance.ID, exists, storedRevision, instance.Revision); err != nil {
+		return err
+	}
+
+	saved := instance.Clone()
+	saved.Revision++
+	saved.UpdatedAt = time.Now()
+	s.state.Instances[instance.ID] = saved
+	if err := s.save(); err != nil {
+		if exists {
+			s.state.Instances[instance.ID] = previous
+		} else {
+			delete(s.state.Instances, instance.ID)
+		}
+		return err
+	}
+
+	instance.Revision = saved.Revision
+	instance.UpdatedAt = saved.UpdatedAt
+	return nil
 }
 
 // DeleteInstance deletes a service instance
@@ -155,8 +684,15 @@ func (s *FileStore) DeleteInstance(instanceID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	previous, exists := s.state.Instances[instanceID]
 	delete(s.state.Instances, instanceID)
-	return s.save()
+	if err := s.save(); err != nil {
+		if exists {
+			s.state.Instances[instanceID] = previous
+		}
+		return err
+	}
+	return nil
 }
 
 // ListInstances returns all service instances
@@ -166,7 +702,7 @@ func (s *FileStore) ListInstances() ([]*ServiceInstance, error) {
 
 	instances := make([]*ServiceInstance, 0, len(s.state.Instances))
 	for _, instance := range s.state.Instances {
-		instances = append(instances, instance)
+		instances = append(instances, instance.Clone())
 	}
 	return instances, nil
 }
@@ -180,7 +716,7 @@ func (s *FileStore) GetBinding(bindingID string) (*ServiceBinding, error) {
 	if !ok {
 		return nil, nil
 	}
-	return binding, nil
+	return binding.Clone(), nil
 }
 
 // SaveBinding saves a service binding
@@ -188,8 +724,29 @@ func (s *FileStore) SaveBinding(binding *ServiceBinding) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.state.Bindings[binding.ID] = binding
-	return s.save()
+	previous, exists := s.state.Bindings[binding.ID]
+	var storedRevision int64
+	if exists {
+		storedRevision = previous.Revision
+	}
+	if err := checkRevision("binding", binding.ID, exists, storedRevision, binding.Revision); err != nil {
+		return err
+	}
+
+	saved := binding.Clone()
+	saved.Revision++
+	s.state.Bindings[binding.ID] = saved
+	if err := s.save(); err != nil {
+		if exists {
+			s.state.Bindings[binding.ID] = previous
+		} else {
+			delete(s.state.Bindings, binding.ID)
+		}
+		return err
+	}
+
+	binding.Revision = saved.Revision
+	return nil
 }
 
 // DeleteBinding deletes a service binding
@@ -197,8 +754,27 @@ func (s *FileStore) DeleteBinding(bindingID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	previous, exists := s.state.Bindings[bindingID]
 	delete(s.state.Bindings, bindingID)
-	return s.save()
+	if err := s.save(); err != nil {
+		if exists {
+			s.state.Bindings[bindingID] = previous
+		}
+		return err
+	}
+	return nil
+}
+
+// ListBindings returns all service bindings
+func (s *FileStore) ListBindings() ([]*ServiceBinding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bindings := make([]*ServiceBinding, 0, len(s.state.Bindings))
+	for _, binding := range s.state.Bindings {
+		bindings = append(bindings, binding.Clone())
+	}
+	return bindings, nil
 }
 
 // ListBindingsForInstance returns all bindings for a service instance
@@ -209,8 +785,123 @@ func (s *FileStore) ListBindingsForInstance(instanceID string) ([]*ServiceBindin
 	bindings := make([]*ServiceBinding, 0)
 	for _, binding := range s.state.Bindings {
 		if binding.InstanceID == instanceID {
-			bindings = append(bindings, binding)
+			bindings = append(bindings, binding.Clone())
 		}
 	}
 	return bindings, nil
 }
+
+// SaveOperation adds or updates an entry in the operation history
+func (s *FileStore) SaveOperation(op *Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := s.operations[op.ID]
+	s.operations[op.ID] = op.Clone()
+	s.pruneOperations(time.Now())
+	if err := s.saveOperations(); err != nil {
+		if exists {
+			s.operations[op.ID] = previous
+		} else {
+			delete(s.operations, op.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// pruneOperations deletes the entries of operations that finished more than
+// OperationRetention ago, then the oldest finished entries beyond
+// maxFileOperations. Entries of operations in progress are always kept.
+func (s *FileStore) pruneOperations(now time.Time) {
+	cutoff := now.Add(-OperationRetention)
+	finished := make([]*Operation, 0, len(s.operations))
+	for id, op := range s.operations {
+		if op.FinishedAt == nil {
+			continue
+		}
+		if op.FinishedAt.Before(cutoff) {
+			delete(s.operations, id)
+			continue
+		}
+		finished = append(finished, op)
+	}
+
+	excess := len(s.operations) - maxFileOperations
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].StartedAt.Before(finished[j].StartedAt) })
+	for _, op := range finished[:min(excess, len(finished))] {
+		delete(s.operations, op.ID)
+	}
+}
+
+// ListOperations returns the complete operation history, oldest first
+func (s *FileStore) ListOperations() ([]*Operation, error) {
+	return s.listOperations(func(op *Operation) bool { return true }), nil
+}
+
+// ListOperationsForInstance returns the operation history of a service
+// instance and its bindings, oldest first
+func (s *FileStore) ListOperationsForInstance(instanceID string) ([]*Operation, error) {
+	return s.listOperations(func(op *Operation) bool { return op.InstanceID == instanceID }), nil
+}
+
+func (s *FileStore) listOperations(match func(op *Operation) bool) []*Operation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ops := make([]*Operation, 0)
+	for _, op := range s.operations {
+		if match(op) {
+			ops = append(ops, op.Clone())
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].StartedAt.Equal(ops[j].StartedAt) {
+			return ops[i].ID < ops[j].ID
+		}
+		return ops[i].StartedAt.Before(ops[j].StartedAt)
+	})
+	return ops
+}
+
+// SchemaVersion returns the schema version recorded in the state file
+func (s *FileStore) SchemaVersion() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state.SchemaVersion, nil
+}
+
+// SetSchemaVersion records the schema version in the state file
+func (s *FileStore) SetSchemaVersion(version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.state.SchemaVersion
+	s.state.SchemaVersion = version
+	if err := s.save(); err != nil {
+		s.state.SchemaVersion = previous
+		return err
+	}
+	return nil
+}
+
+// Backup writes a copy of the current state next to the state file
+func (s *FileStore) Backup(label string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	backupPath := fmt.Sprintf("%s.backup-%s-%s", s.path, label, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.WriteFile(backupPath, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write state backup: %w", err)
+	}
+	return backupPath, nil
+}
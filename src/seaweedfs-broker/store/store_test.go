@@ -0,0 +1,355 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T) *FileStore {
+	t.Helper()
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"), 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	return s
+}
+
+func testInstance(id string) *ServiceInstance {
+	purgeAt := time.Now().Add(time.Hour)
+	return &ServiceInstance{
+		ID:         id,
+		ServiceID:  "service",
+		PlanID:     "plan",
+		BucketName: "bucket-" + id,
+		Buckets:    []Bucket{{Name: "uploads", BucketName: "uploads-" + id}},
+		Parameters: map[string]any{
+			"buckets": []any{"uploads"},
+			"cors":    map[string]any{"allowed_origins": []any{"https://example.com"}},
+		},
+		Context:             map[string]any{"platform": "cloudfoundry"},
+		PurgeAt:             &purgeAt,
+		OriginatingIdentity: &Identity{Platform: "cloudfoundry", Value: map[string]any{"user_id": "user"}},
+		State:               "succeeded",
+	}
+}
+
+func testBinding(id, instanceID string) *ServiceBinding {
+	expiresAt := time.Now().Add(time.Hour)
+	return &ServiceBinding{
+		ID:                  id,
+		InstanceID:          instanceID,
+		Parameters:          map[string]any{"buckets": []any{"uploads"}},
+		Buckets:             []string{"uploads"},
+		AccessKey:           "access",
+		SecretKey:           "secret",
+		ExpiresAt:           &expiresAt,
+		OriginatingIdentity: &Identity{Platform: "cloudfoundry", Value: map[string]any{"user_id": "user"}},
+	}
+}
+
+// mutateInstance changes every field that Clone must copy deeply
+func mutateInstance(i *ServiceInstance) {
+	i.Buckets[0].BucketName = "changed"
+	i.Parameters["buckets"].([]any)[0] = "changed"
+	i.Parameters["cors"].(map[string]any)["allowed_origins"] = nil
+	i.Context["platform"] = "changed"
+	*i.PurgeAt = time.Time{}
+	i.OriginatingIdentity.Value["user_id"] = "changed"
+}
+
+func mutateBinding(b *ServiceBinding) {
+	b.Buckets[0] = "changed"
+	b.Parameters["buckets"].([]any)[0] = "changed"
+	*b.ExpiresAt = time.Time{}
+	b.OriginatingIdentity.Value["user_id"] = "changed"
+}
+
+func assertInstanceUnchanged(t *testing.T, i *ServiceInstance) {
+	t.Helper()
+	if i.Buckets[0].BucketName != "uploads-"+i.ID {
+		t.Errorf("Buckets shared with a copy: %v", i.Buckets)
+	}
+	if got := i.Parameters["buckets"].([]any)[0]; got != "uploads" {
+		t.Errorf("Parameters list shared with a copy: %v", got)
+	}
+	if i.Parameters["cors"].(map[string]any)["allowed_origins"] == nil {
+		t.Errorf("nested Parameters map shared with a copy")
+	}
+	if i.Context["platform"] != "cloudfoundry" {
+		t.Errorf("Context shared with a copy: %v", i.Context)
+	}
+	if i.PurgeAt.IsZero() {
+		t.Errorf("PurgeAt shared with a copy")
+	}
+	if i.OriginatingIdentity.UserID() != "user" {
+		t.Errorf("OriginatingIdentity shared with a copy: %v", i.OriginatingIdentity.Value)
+	}
+}
+
+func assertBindingUnchanged(t *testing.T, b *ServiceBinding) {
+	t.Helper()
+	if b.Buckets[0] != "uploads" {
+		t.Errorf("Buckets shared with a copy: %v", b.Buckets)
+	}
+	if got := b.Parameters["buckets"].([]any)[0]; got != "uploads" {
+		t.Errorf("Parameters list shared with a copy: %v", got)
+	}
+	if b.ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt shared with a copy")
+	}
+	if b.OriginatingIdentity.UserID() != "user" {
+		t.Errorf("OriginatingIdentity shared with a copy: %v", b.OriginatingIdentity.Value)
+	}
+}
+
+func TestCloneIsDeep(t *testing.T) {
+	instance := testInstance("i1")
+	mutateInstance(instance.Clone())
+	assertInstanceUnchanged(t, instance)
+
+	binding := testBinding("b1", "i1")
+	mutateBinding(binding.Clone())
+	assertBindingUnchanged(t, binding)
+
+	finishedAt := time.Now()
+	op := &Operation{ID: "op", BOSHTaskIDs: []int{1}, FinishedAt: &finishedAt}
+	c := op.Clone()
+	c.BOSHTaskIDs[0] = 2
+	*c.FinishedAt = time.Time{}
+	if op.BOSHTaskIDs[0] != 1 || op.FinishedAt.IsZero() {
+		t.Errorf("operation shares state with its clone: %+v", op)
+	}
+}
+
+// testStoreCopies checks that a store neither keeps the caller's records nor
+// hands out its own
+func testStoreCopies(t *testing.T, s Store) {
+	instance := testInstance("i1")
+	if err := s.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	mutateInstance(instance)
+
+	got, err := s.GetInstance("i1")
+	if err != nil || got == nil {
+		t.Fatalf("GetInstance: %v, %v", got, err)
+	}
+	assertInstanceUnchanged(t, got)
+	mutateInstance(got)
+
+	listed, err := s.ListInstances()
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("ListInstances: %v, %v", listed, err)
+	}
+	assertInstanceUnchanged(t, listed[0])
+
+	binding := testBinding("b1", "i1")
+	if err := s.SaveBinding(binding); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+	mutateBinding(binding)
+
+	gotBinding, err := s.GetBinding("b1")
+	if err != nil || gotBinding == nil {
+		t.Fatalf("GetBinding: %v, %v", gotBinding, err)
+	}
+	assertBindingUnchanged(t, gotBinding)
+	mutateBinding(gotBinding)
+
+	bindings, err := s.ListBindingsForInstance("i1")
+	if err != nil || len(bindings) != 1 {
+		t.Fatalf("ListBindingsForInstance: %v, %v", bindings, err)
+	}
+	assertBindingUnchanged(t, bindings[0])
+}
+
+// testStoreConflicts checks that saves of stale or deleted records fail
+// with a *ConflictError and leave the stored record alone
+func testStoreConflicts(t *testing.T, s Store) {
+	instance := testInstance("i1")
+	if err := s.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+	if instance.Revision != 1 {
+		t.Fatalf("expected revision 1 after the first save, got %d", instance.Revision)
+	}
+
+	stale, _ := s.GetInstance("i1")
+	instance.State = "updated"
+	if err := s.SaveInstance(instance); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+
+	stale.State = "stale"
+	err := s.SaveInstance(stale)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || !IsConflict(err) {
+		t.Fatalf("expected a ConflictError for a stale instance, got %v", err)
+	}
+	if conflict.Kind != "instance" || conflict.ID != "i1" || conflict.Revision != 1 {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+	if stale.Revision != 1 {
+		t.Errorf("a failed save changed the caller's revision to %d", stale.Revision)
+	}
+	if got, _ := s.GetInstance("i1"); got.State != "updated" || got.Revision != 2 {
+		t.Errorf("stale save overwrote the instance: %+v", got)
+	}
+
+	// A second create of the same ID is stale too
+	if err := s.SaveInstance(testInstance("i1")); !IsConflict(err) {
+		t.Errorf("expected a ConflictError creating an existing instance, got %v", err)
+	}
+
+	if err := s.DeleteInstance("i1"); err != nil {
+		t.Fatalf("DeleteInstance: %v", err)
+	}
+	if err := s.SaveInstance(instance); !IsConflict(err) {
+		t.Errorf("expected a ConflictError saving a deleted instance, got %v", err)
+	}
+
+	binding := testBinding("b1", "i1")
+	if err := s.SaveBinding(binding); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+	staleBinding, _ := s.GetBinding("b1")
+	if err := s.SaveBinding(binding); err != nil {
+		t.Fatalf("SaveBinding: %v", err)
+	}
+	err = s.SaveBinding(staleBinding)
+	if !errors.As(err, &conflict) || conflict.Kind != "binding" {
+		t.Errorf("expected a binding ConflictError, got %v", err)
+	}
+}
+
+func TestFileStoreCopies(t *testing.T) {
+	testStoreCopies(t, newTestFileStore(t))
+}
+
+func TestFileStoreConflicts(t *testing.T) {
+	testStoreConflicts(t, newTestFileStore(t))
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewFileStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if err := s.SaveInstance(testInstance("i1")); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+
+	reloaded, err := NewFileStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	got, err := reloaded.GetInstance("i1")
+	if err != nil || got == nil {
+		t.Fatalf("GetInstance after reload: %v, %v", got, err)
+	}
+	if got.Revision != 1 {
+		t.Errorf("expected revision 1 after reload, got %d", got.Revision)
+	}
+	assertInstanceUnchanged(t, got)
+}
+
+func TestFileStoreOperationsSkipSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewFileStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if err := s.SaveInstance(testInstance("i1")); err != nil {
+		t.Fatalf("SaveInstance: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		op := &Operation{ID: fmt.Sprintf("op-%d", i), InstanceID: "i1", State: OperationInProgress, StartedAt: time.Now()}
+		if err := s.SaveOperation(op); err != nil {
+			t.Fatalf("SaveOperation: %v", err)
+		}
+	}
+	// Only the instance save rotated state.json, into a first snapshot
+	if _, err := os.Stat(s.snapshotPath(1)); !os.IsNotExist(err) {
+		t.Errorf("operation writes rotated the state snapshots")
+	}
+	state, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(state), "op-0") {
+		t.Errorf("operations written to the state file")
+	}
+
+	reloaded, err := NewFileStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if ops, _ := reloaded.ListOperations(); len(ops) != 3 {
+		t.Errorf("expected 3 operations after reload, got %d", len(ops))
+	}
+}
+
+func TestFileStoreMovesOperationsOutOfState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	old := `{"schema_version": 1, "instances": {}, "bindings": {},
+		"operations": {"op-1": {"id": "op-1", "instance_id": "i1", "type": "provision", "state": "succeeded"}}}`
+	if err := os.WriteFile(path, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if ops, _ := s.ListOperationsForInstance("i1"); len(ops) != 1 || ops[0].ID != "op-1" {
+		t.Fatalf("expected the operation of the old state file, got %v", ops)
+	}
+	if err := s.SetSchemaVersion(2); err != nil {
+		t.Fatalf("SetSchemaVersion: %v", err)
+	}
+	if state, _ := os.ReadFile(path); strings.Contains(string(state), "op-1") {
+		t.Errorf("operation still in the state file after a save")
+	}
+
+	reloaded, err := NewFileStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if ops, _ := reloaded.ListOperations(); len(ops) != 1 {
+		t.Errorf("expected the moved operation after reload, got %v", ops)
+	}
+}
+
+func TestFileStorePrunesOperations(t *testing.T) {
+	s := newTestFileStore(t)
+	now := time.Now()
+	expired := now.Add(-OperationRetention - time.Hour)
+	recent := now.Add(-time.Hour)
+
+	ops := []*Operation{
+		{ID: "expired", State: OperationSucceeded, StartedAt: expired, FinishedAt: &expired},
+		{ID: "recent", State: OperationSucceeded, StartedAt: recent, FinishedAt: &recent},
+		{ID: "running", State: OperationInProgress, StartedAt: expired},
+	}
+	for _, op := range ops {
+		if err := s.SaveOperation(op); err != nil {
+			t.Fatalf("SaveOperation: %v", err)
+		}
+	}
+
+	listed, _ := s.ListOperations()
+	ids := make([]string, 0, len(listed))
+	for _, op := range listed {
+		ids = append(ids, op.ID)
+	}
+	if strings.Join(ids, ",") != "running,recent" {
+		t.Errorf("expected the expired entry to be pruned, got %v", ids)
+	}
+}